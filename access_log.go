@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// accessLogFormats are the accepted values of ACCESS_LOG
+var accessLogFormats = []string{"json", "logfmt", "combined"}
+
+// defaultRedactHeaders are always redacted, ACCESS_LOG_REDACT_HEADERS adds more
+var defaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-API-Key"}
+
+// defaultRedactQuery are always redacted, ACCESS_LOG_REDACT_QUERY adds more
+var defaultRedactQuery = []string{"access_token", "id_token", "refresh_token", "token", "code", "state", "api_key"}
+
+const redacted = "REDACTED"
+
+// accessLogEntry is a line of access log
+type accessLogEntry struct {
+	Time       time.Time         `json:"time"`
+	RemoteIP   string            `json:"remote_ip"`
+	Method     string            `json:"method"`
+	Host       string            `json:"host"`
+	Path       string            `json:"path"`
+	Query      string            `json:"query"`
+	Protocol   string            `json:"protocol"`
+	Status     int               `json:"status"`
+	Bytes      int64             `json:"bytes"`
+	DurationMs float64           `json:"duration_ms"`
+	Upstream   string            `json:"upstream"`
+	Subject    string            `json:"subject"`
+	AuthMethod string            `json:"auth_method"`
+	RequestID  string            `json:"request_id"`
+	UserAgent  string            `json:"user_agent"`
+	Referer    string            `json:"referer"`
+	Headers    map[string]string `json:"headers,omitempty"`
+}
+
+// accessLogRecord collects what the inner handlers learned about the request, the
+// identity and the upstream are only known after the access log middleware
+type accessLogRecord struct {
+	identity *Identity
+	upstream string
+}
+
+type accessLogContextKey struct{}
+
+func accessLogFromContext(ctx context.Context) *accessLogRecord {
+	record, _ := ctx.Value(accessLogContextKey{}).(*accessLogRecord)
+	return record
+}
+
+// AccessLogMiddleware writes a line for each request in ACCESS_LOG format
+type AccessLogMiddleware struct {
+	format        string
+	sink          *accessLogSink
+	headers       []string
+	redactHeaders []string
+	redactQuery   []string
+	proxies       trustedProxies
+}
+
+// accessLogSettings reads the redaction lists, the defaults with the api key names
+// and the configured ones
+func accessLogSettings() (headers []string, redactHeaders []string, redactQuery []string) {
+	headers = lo.Map(splitList(getenv("ACCESS_LOG_HEADERS")), func(h string, _ int) string {
+		return http.CanonicalHeaderKey(h)
+	})
+	redactHeaders = append(append([]string{}, defaultRedactHeaders...), splitList(getenv("ACCESS_LOG_REDACT_HEADERS"))...)
+	if h := getenv("API_KEY_HEADER"); len(h) > 0 {
+		redactHeaders = append(redactHeaders, h)
+	}
+	redactHeaders = lo.Uniq(lo.Map(redactHeaders, func(h string, _ int) string {
+		return http.CanonicalHeaderKey(h)
+	}))
+	redactQuery = append(append([]string{}, defaultRedactQuery...), splitList(getenv("ACCESS_LOG_REDACT_QUERY"))...)
+	if p := getenv("API_KEY_QUERY_PARAM"); len(p) > 0 {
+		redactQuery = append(redactQuery, p)
+	}
+	return headers, redactHeaders, lo.Uniq(redactQuery)
+}
+
+func NewAccessLogMiddleware() (*AccessLogMiddleware, error) {
+	format := getenv("ACCESS_LOG")
+	if len(format) == 0 {
+		return &AccessLogMiddleware{}, nil
+	}
+	if !lo.Contains(accessLogFormats, format) {
+		return nil, fmt.Errorf("ACCESS_LOG %q is unknown, must be one of %v", format, accessLogFormats)
+	}
+	sink, err := openAccessLogSink()
+	if err != nil {
+		return nil, fmt.Errorf("open access log output failed: %w", err)
+	}
+	proxies, err := parseTrustedProxies(getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES is invalid: %w", err)
+	}
+	headers, redactHeaders, redactQuery := accessLogSettings()
+	return &AccessLogMiddleware{
+		format:        format,
+		sink:          sink,
+		headers:       headers,
+		redactHeaders: redactHeaders,
+		redactQuery:   redactQuery,
+		proxies:       proxies,
+	}, nil
+}
+
+func (m *AccessLogMiddleware) Name() string {
+	return "AccessLogMiddleware"
+}
+
+func (m *AccessLogMiddleware) Enabled() bool {
+	return len(m.format) > 0
+}
+
+func (m *AccessLogMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// captured before inner handlers strip credentials or rewrite the url
+		entry := &accessLogEntry{
+			Time:      start,
+			RemoteIP:  m.proxies.clientIP(r),
+			Method:    r.Method,
+			Host:      r.Host,
+			Path:      r.URL.Path,
+			Query:     m.redactRawQuery(r.URL.RawQuery),
+			Protocol:  r.Proto,
+			RequestID: requestIDFromContext(r.Context()),
+			UserAgent: r.UserAgent(),
+			Referer:   m.redactURL(r.Referer()),
+		}
+		for _, h := range m.headers {
+			if v := r.Header.Get(h); len(v) > 0 {
+				if entry.Headers == nil {
+					entry.Headers = map[string]string{}
+				}
+				if lo.Contains(m.redactHeaders, h) {
+					v = redacted
+				}
+				entry.Headers[h] = v
+			}
+		}
+		record := &accessLogRecord{}
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			entry.Status = recorder.status
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+			entry.Bytes = recorder.size
+			entry.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+			entry.Upstream = record.upstream
+			if record.identity != nil {
+				entry.Subject = record.identity.Subject
+				entry.AuthMethod = record.identity.AuthMethod
+			}
+			if _, err := m.sink.Write(m.formatEntry(entry)); err != nil {
+				log.Printf("write access log failed %s", err)
+			}
+		}()
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), accessLogContextKey{}, record)))
+	})
+}
+
+// redactRawQuery replaces the values of sensitive query params
+func (m *AccessLogMiddleware) redactRawQuery(rawQuery string) string {
+	if len(rawQuery) == 0 {
+		return ""
+	}
+	parts := strings.Split(rawQuery, "&")
+	for i, part := range parts {
+		name, _, found := strings.Cut(part, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if found && lo.Contains(m.redactQuery, name) {
+			parts[i] = url.QueryEscape(name) + "=" + redacted
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// redactURL redacts the query of a full url like Referer
+func (m *AccessLogMiddleware) redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || len(u.RawQuery) == 0 {
+		return raw
+	}
+	u.RawQuery = m.redactRawQuery(u.RawQuery)
+	return u.String()
+}
+
+func (m *AccessLogMiddleware) formatEntry(e *accessLogEntry) []byte {
+	switch m.format {
+	case "logfmt":
+		return formatLogfmt(e)
+	case "combined":
+		return formatCombined(e)
+	}
+	line, _ := json.Marshal(e)
+	return append(line, '\n')
+}
+
+// formatLogfmt writes key=value pairs, values quoted when needed
+func formatLogfmt(e *accessLogEntry) []byte {
+	buf := &bytes.Buffer{}
+	pair := func(key string, value string) {
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		if len(value) == 0 || strings.ContainsAny(value, " =\"\\\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+	pair("time", e.Time.Format(time.RFC3339Nano))
+	pair("remote_ip", e.RemoteIP)
+	pair("method", e.Method)
+	pair("host", e.Host)
+	pair("path", e.Path)
+	pair("query", e.Query)
+	pair("protocol", e.Protocol)
+	pair("status", strconv.Itoa(e.Status))
+	pair("bytes", strconv.FormatInt(e.Bytes, 10))
+	pair("duration_ms", strconv.FormatFloat(e.DurationMs, 'f', 3, 64))
+	pair("upstream", e.Upstream)
+	pair("subject", e.Subject)
+	pair("auth_method", e.AuthMethod)
+	pair("request_id", e.RequestID)
+	pair("user_agent", e.UserAgent)
+	pair("referer", e.Referer)
+	headers := lo.Keys(e.Headers)
+	sort.Strings(headers)
+	for _, h := range headers {
+		pair("header_"+strings.ToLower(strings.ReplaceAll(h, "-", "_")), e.Headers[h])
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// combinedUser quotes the user field when it would break the space separated
+// fields, e.g. the DN of a client certificate
+func combinedUser(user string) string {
+	if strings.IndexFunc(user, func(r rune) bool { return r <= ' ' || r == '"' || r > '~' }) >= 0 {
+		return strconv.Quote(user)
+	}
+	return user
+}
+
+// formatCombined writes the Apache combined log format
+func formatCombined(e *accessLogEntry) []byte {
+	dash := func(v string) string {
+		if len(v) == 0 {
+			return "-"
+		}
+		return v
+	}
+	uri := e.Path
+	if len(e.Query) > 0 {
+		uri += "?" + e.Query
+	}
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	return []byte(fmt.Sprintf("%s - %s [%s] %s %d %s %s %s\n",
+		dash(e.RemoteIP),
+		combinedUser(dash(e.Subject)),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+uri+" "+e.Protocol),
+		e.Status,
+		size,
+		strconv.Quote(dash(e.Referer)),
+		strconv.Quote(dash(e.UserAgent)),
+	))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAccessLogMaxSize    = 100 // MB
+	defaultAccessLogMaxBackups = 5
+	// syslogPriority is facility local0 with severity info
+	syslogPriority = 16*8 + 6
+	// syslogWriteTimeout bounds how long a request waits for a stalled syslog server
+	syslogWriteTimeout = time.Second
+	// syslogRedialInterval throttles the reconnects while the syslog server is down
+	syslogRedialInterval = 5 * time.Second
+)
+
+// accessLogSink writes the access log lines, one Write per line
+type accessLogSink struct {
+	output string
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func (s *accessLogSink) Write(line []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(line)
+}
+
+func (s *accessLogSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closer.Close()
+}
+
+var (
+	sharedAccessLogSinkMu sync.Mutex
+	// sharedAccessLogSink keeps the output open across the rebuild of middlewares on
+	// config reload, it is only reopened when ACCESS_LOG_OUTPUT changed
+	sharedAccessLogSink *accessLogSink
+)
+
+// openAccessLogSink opens ACCESS_LOG_OUTPUT, stdout (default), stderr, syslog,
+// syslog://host:port (UDP), syslog+tcp://host:port or a file path
+func openAccessLogSink() (*accessLogSink, error) {
+	output := getenv("ACCESS_LOG_OUTPUT")
+	if len(output) == 0 {
+		output = "stdout"
+	}
+	maxSize, err := parseCountOr("ACCESS_LOG_MAX_SIZE", getenv("ACCESS_LOG_MAX_SIZE"), defaultAccessLogMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	maxBackups, err := parseCountOr("ACCESS_LOG_MAX_BACKUPS", getenv("ACCESS_LOG_MAX_BACKUPS"), defaultAccessLogMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s|%d|%d", output, maxSize, maxBackups)
+
+	sharedAccessLogSinkMu.Lock()
+	defer sharedAccessLogSinkMu.Unlock()
+	if sharedAccessLogSink != nil && sharedAccessLogSink.output == key {
+		return sharedAccessLogSink, nil
+	}
+	sink := &accessLogSink{output: key}
+	switch {
+	case output == "stdout":
+		sink.w = os.Stdout
+	case output == "stderr":
+		sink.w = os.Stderr
+	case output == "syslog":
+		w, err := dialSyslog("unixgram", "/dev/log")
+		if err != nil {
+			return nil, err
+		}
+		sink.w, sink.closer = w, w
+	case isSyslogURL(output):
+		u, err := url.Parse(output)
+		if err != nil {
+			return nil, err
+		}
+		network := "udp"
+		if u.Scheme == "syslog+tcp" {
+			network = "tcp"
+		}
+		w, err := dialSyslog(network, u.Host)
+		if err != nil {
+			return nil, err
+		}
+		sink.w, sink.closer = w, w
+	default:
+		f, err := openRotatingFile(output, int64(maxSize)<<20, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sink.w, sink.closer = f, f
+	}
+	if sharedAccessLogSink != nil {
+		sharedAccessLogSink.Close()
+	}
+	sharedAccessLogSink = sink
+	return sink, nil
+}
+
+func isSyslogURL(output string) bool {
+	u, err := url.Parse(output)
+	return err == nil && (u.Scheme == "syslog" || u.Scheme == "syslog+tcp")
+}
+
+// rotatingFile is a log file rotated to path.1, path.2 ... when it grows over maxSize
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write is serialized by accessLogSink
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	backup := func(i int) string { return f.path + "." + strconv.Itoa(i) }
+	os.Remove(backup(f.maxBackups))
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		os.Rename(backup(i), backup(i+1))
+	}
+	if f.maxBackups > 0 {
+		os.Rename(f.path, backup(1))
+	} else {
+		os.Remove(f.path)
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
+
+// syslogWriter sends each line as an RFC 5424 message, the connection is dialed
+// again after a failed write
+type syslogWriter struct {
+	network  string
+	addr     string
+	hostname string
+	conn     net.Conn
+	lastDial time.Time
+}
+
+func dialSyslog(network string, addr string) (*syslogWriter, error) {
+	hostname, _ := os.Hostname()
+	if len(hostname) == 0 {
+		hostname = "-"
+	}
+	w := &syslogWriter{network: network, addr: addr, hostname: hostname}
+	if err := w.dial(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) dial() error {
+	w.lastDial = time.Now()
+	conn, err := net.DialTimeout(w.network, w.addr, syslogWriteTimeout)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// Write is serialized by accessLogSink, the line is dropped when syslog server
+// is not reachable
+func (w *syslogWriter) Write(line []byte) (int, error) {
+	if w.conn == nil {
+		if time.Since(w.lastDial) < syslogRedialInterval {
+			return 0, fmt.Errorf("syslog %s is disconnected", w.addr)
+		}
+		if err := w.dial(); err != nil {
+			return 0, err
+		}
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s secure-app-proxy %d - - %s",
+		syslogPriority, time.Now().UTC().Format(time.RFC3339Nano), w.hostname, os.Getpid(), trimNewline(line))
+	if w.network == "tcp" {
+		// octet counting framing of RFC 6587
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	if _, err := w.conn.Write([]byte(msg)); err != nil {
+		// a partial message breaks the framing, the next line starts a new connection
+		w.conn.Close()
+		w.conn = nil
+		return 0, err
+	}
+	return len(line), nil
+}
+
+func (w *syslogWriter) Close() error {
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.Close()
+}
+
+func trimNewline(line []byte) []byte {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		return line[:n-1]
+	}
+	return line
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAccessLog(t *testing.T, file string) []accessLogEntry {
+	t.Helper()
+	content, err := os.ReadFile(file)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	entries := []accessLogEntry{}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		entry := accessLogEntry{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAccessLogMiddleware(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "logs", "access.log")
+	t.Setenv("ACCESS_LOG", "json")
+	t.Setenv("ACCESS_LOG_OUTPUT", file)
+	t.Setenv("ACCESS_LOG_HEADERS", "authorization,x-tenant")
+	t.Setenv("ACCESS_LOG_REDACT_QUERY", "secret")
+	handler := must(NewRequestIDMiddleware()).Handler(must(NewAccessLogMiddleware()).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		withIdentity(r, newIdentity("jwt", map[string]interface{}{"sub": "alice"}))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})))
+
+	req := httptest.NewRequest(http.MethodPost, "/orders?token=abc&page=2&secret=s", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("X-Request-Id", "req-1")
+	req.Header.Set("Referer", "https://app.example.com/callback?code=xyz")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := readAccessLog(t, file)
+	if !assert.Len(t, entries, 1) {
+		return
+	}
+	entry := entries[0]
+	assert.Equal(t, http.MethodPost, entry.Method)
+	assert.Equal(t, "/orders", entry.Path)
+	assert.Equal(t, "token=REDACTED&page=2&secret=REDACTED", entry.Query)
+	assert.Equal(t, http.StatusCreated, entry.Status)
+	assert.Equal(t, int64(5), entry.Bytes)
+	assert.Equal(t, "alice", entry.Subject)
+	assert.Equal(t, "jwt", entry.AuthMethod)
+	assert.Equal(t, "req-1", entry.RequestID)
+	assert.Equal(t, "192.0.2.1", entry.RemoteIP)
+	assert.Equal(t, "https://app.example.com/callback?code=REDACTED", entry.Referer)
+	assert.Equal(t, map[string]string{"Authorization": "REDACTED", "X-Tenant": "acme"}, entry.Headers)
+}
+
+func TestAccessLogMiddleware_Upstream(t *testing.T) {
+	api := newEchoUpstream(t, "api")
+	file := filepath.Join(t.TempDir(), "access.log")
+	t.Setenv("UPSTREAM", api.URL)
+	t.Setenv("ACCESS_LOG", "json")
+	t.Setenv("ACCESS_LOG_OUTPUT", file)
+	handler := must(createHandler())
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/a", nil))
+	// the sink is kept open on reload
+	must(createHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/b", nil))
+
+	entries := readAccessLog(t, file)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, api.URL, entries[0].Upstream)
+		assert.Equal(t, http.StatusOK, entries[0].Status)
+		assert.Equal(t, "/b", entries[1].Path)
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	entry := &accessLogEntry{
+		Time:       time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC),
+		RemoteIP:   "203.0.113.9",
+		Method:     "GET",
+		Host:       "app.example.com",
+		Path:       "/a b",
+		Query:      "page=2",
+		Protocol:   "HTTP/1.1",
+		Status:     200,
+		Bytes:      12,
+		DurationMs: 1.5,
+		Subject:    "alice",
+		UserAgent:  "curl/8.0",
+		Headers:    map[string]string{"X-Tenant": "acme"},
+	}
+	assert.Equal(t,
+		`time=2024-03-01T10:20:30Z remote_ip=203.0.113.9 method=GET host=app.example.com path="/a b" query="page=2" `+
+			`protocol=HTTP/1.1 status=200 bytes=12 duration_ms=1.500 upstream="" subject=alice auth_method="" `+
+			`request_id="" user_agent=curl/8.0 referer="" header_x_tenant=acme`+"\n",
+		string(formatLogfmt(entry)),
+	)
+	assert.Equal(t,
+		`203.0.113.9 - alice [01/Mar/2024:10:20:30 +0000] "GET /a b?page=2 HTTP/1.1" 200 12 "-" "curl/8.0"`+"\n",
+		string(formatCombined(entry)),
+	)
+
+	// the DN of client certificate is kept as one field
+	entry.Subject = "CN=Alice Smith,O=Acme"
+	assert.Equal(t,
+		`203.0.113.9 - "CN=Alice Smith,O=Acme" [01/Mar/2024:10:20:30 +0000] "GET /a b?page=2 HTTP/1.1" 200 12 "-" "curl/8.0"`+"\n",
+		string(formatCombined(entry)),
+	)
+}
+
+func TestRotatingFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(file, 10, 2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	for name, content := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		actual, err := os.ReadFile(file + name)
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(actual))
+	}
+	_, err = os.Stat(file + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAccessLogSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	t.Setenv("ACCESS_LOG_OUTPUT", "syslog://"+conn.LocalAddr().String())
+	sink, err := openAccessLogSink()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = sink.Write([]byte("status=200\n"))
+	assert.NoError(t, err)
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.Regexp(t, `^<134>1 \S+ \S+ secure-app-proxy \d+ - - status=200$`, string(buf[:n]))
+	}
+}
+
+func TestAccessLogSyslog_Redial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	lines := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 1024)
+			n, _ := conn.Read(buf)
+			lines <- string(buf[:n])
+			conn.Close()
+		}
+	}()
+	w, err := dialSyslog("tcp", listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer w.Close()
+	_, err = w.Write([]byte("status=200\n"))
+	assert.NoError(t, err)
+	assert.Contains(t, <-lines, "status=200")
+
+	// the broken connection is dropped, the next line dials again
+	w.conn.Close()
+	_, err = w.Write([]byte("status=500\n"))
+	assert.Error(t, err)
+	_, err = w.Write([]byte("status=201\n"))
+	assert.Error(t, err, "redial is throttled")
+	w.lastDial = w.lastDial.Add(-syslogRedialInterval)
+	_, err = w.Write([]byte("status=201\n"))
+	assert.NoError(t, err)
+	select {
+	case line := <-lines:
+		assert.Regexp(t, `^\d+ <134>1 .* status=201$`, line)
+	case <-time.After(time.Second):
+		t.Fatal("syslog line is not received")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultApiKeyHeader = "X-API-Key"
+
+// ApiKey maps a key to the identity using it, only the SHA-256 of the key is stored,
+// generate it with `printf %s "$KEY" | sha256sum`
+type ApiKey struct {
+	// ID names the key in rate limiting, the hash prefix when absent
+	ID string `yaml:"id" json:"id"`
+	// Hash is the hex SHA-256 of the key, optionally prefixed with sha256:
+	Hash    string   `yaml:"hash" json:"hash"`
+	Subject string   `yaml:"subject" json:"subject"`
+	Scopes  []string `yaml:"scopes" json:"scopes"`
+	Groups  []string `yaml:"groups" json:"groups"`
+}
+
+// ApiKeyConfig is the content of API_KEYS_FILE
+type ApiKeyConfig struct {
+	Keys []*ApiKey `yaml:"keys" json:"keys"`
+}
+
+// claims are the claims of identity using the key, scopes are space separated
+// like the scope of OAuth tokens
+func (k *ApiKey) claims() map[string]interface{} {
+	claims := map[string]interface{}{"sub": k.Subject, "key_id": k.ID}
+	if len(k.Scopes) > 0 {
+		claims["scope"] = strings.Join(k.Scopes, " ")
+	}
+	if len(k.Groups) > 0 {
+		groups := []interface{}{}
+		for _, g := range k.Groups {
+			groups = append(groups, g)
+		}
+		claims["groups"] = groups
+	}
+	return claims
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadApiKeys reads the keys file, indexed by hash
+func loadApiKeys(file string) (map[string]*ApiKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &ApiKeyConfig{}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, err
+	}
+	keys := map[string]*ApiKey{}
+	for i, key := range config.Keys {
+		hash := strings.ToLower(strings.TrimPrefix(key.Hash, "sha256:"))
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("key %d has no valid sha256 hash", i)
+		}
+		if len(key.Subject) == 0 {
+			return nil, fmt.Errorf("key %d has no subject", i)
+		}
+		if len(key.ID) == 0 {
+			key.ID = hash[:12]
+		}
+		keys[hash] = key
+	}
+	return keys, nil
+}
+
+// ApiKeyMiddleware authenticates requests by static API keys in a header or query parameter
+type ApiKeyMiddleware struct {
+	enabled    bool
+	keys       map[string]*ApiKey
+	header     string
+	queryParam string
+}
+
+func NewApiKeyMiddleware() (*ApiKeyMiddleware, error) {
+	file := getenv("API_KEYS_FILE")
+	if len(file) == 0 {
+		return &ApiKeyMiddleware{}, nil
+	}
+	keys, err := loadApiKeys(file)
+	if err != nil {
+		return nil, fmt.Errorf("load API_KEYS_FILE failed: %w", err)
+	}
+	header := getenv("API_KEY_HEADER")
+	if len(header) == 0 {
+		header = defaultApiKeyHeader
+	}
+	return &ApiKeyMiddleware{
+		enabled:    true,
+		keys:       keys,
+		header:     header,
+		queryParam: getenv("API_KEY_QUERY_PARAM"),
+	}, nil
+}
+
+func (m *ApiKeyMiddleware) Name() string {
+	return "ApiKeyMiddleware"
+}
+
+func (m *ApiKeyMiddleware) Enabled() bool {
+	return m.enabled
+}
+
+// extractKey takes the key out of request, so it is never forwarded to upstream
+func (m *ApiKeyMiddleware) extractKey(r *http.Request) string {
+	key := r.Header.Get(m.header)
+	r.Header.Del(m.header)
+	if len(m.queryParam) > 0 {
+		query := r.URL.Query()
+		if len(key) == 0 {
+			key = query.Get(m.queryParam)
+		}
+		if query.Has(m.queryParam) {
+			r.URL.RawQuery = removeQueryParam(r.URL.RawQuery, m.queryParam)
+		}
+	}
+	return key
+}
+
+// removeQueryParam drops the parameter from raw query, the other parameters are
+// forwarded as they are, without re-encoding or reordering
+func removeQueryParam(rawQuery string, name string) string {
+	kept := []string{}
+	for _, part := range strings.Split(rawQuery, "&") {
+		key, _, _ := strings.Cut(part, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, "&")
+}
+
+// authenticate looks up the key, the request has no credential of the method without a key
+func (m *ApiKeyMiddleware) authenticate(w http.ResponseWriter, r *http.Request) (*Identity, *authError) {
+	key := m.extractKey(r)
+	if len(key) == 0 {
+		return nil, nil
+	}
+	// lookup by hash does not leak the stored keys through timing
+	apiKey, ok := m.keys[hashApiKey(key)]
+	if !ok {
+		return nil, &authError{"API_KEY_INVALID", "api key is invalid", http.StatusUnauthorized}
+	}
+	return newIdentity("api_key", apiKey.claims()), nil
+}
+
+func (m *ApiKeyMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublicRequest(r) || identityFromContext(r.Context()) != nil {
+			m.extractKey(r)
+			next.ServeHTTP(w, r)
+			return
+		}
+		identity, err := m.authenticate(w, r)
+		if err != nil {
+			flushJsonErrorResponse(w, err.message, err.code, err.status)
+			return
+		}
+		if identity == nil {
+			flushHttpResponseError(w, "api key is required", "API_KEY_REQUIRED")
+			return
+		}
+		next.ServeHTTP(w, withIdentity(r, identity))
+	})
+}
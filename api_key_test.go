@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiKeyMiddleware(t *testing.T) {
+	t.Setenv("API_KEYS_FILE", writeConfig(t, "keys.yaml", `
+keys:
+  - hash: sha256:`+hashApiKey("ci-key")+`
+    subject: ci
+    scopes: [deploy, read]
+  - hash: `+hashApiKey("ops-key")+`
+    subject: ops
+    groups: [ops]
+`))
+	t.Setenv("API_KEY_QUERY_PARAM", "api_key")
+	m := must(NewApiKeyMiddleware())
+	assert.True(t, m.Enabled())
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := identityFromContext(r.Context())
+		w.Header().Set("X-Subject", identity.Subject)
+		w.Header().Set("X-Scope", formatClaim(identity.Claims["scope"]))
+		w.Header().Set("X-Forwarded-Key", r.Header.Get("X-API-Key"))
+		w.Header().Set("X-Query", r.URL.RawQuery)
+	}))
+	serve := func(target string, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if len(key) > 0 {
+			req.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("/", "ci-key")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ci", w.Header().Get("X-Subject"))
+	assert.Equal(t, "deploy read", w.Header().Get("X-Scope"))
+	assert.Empty(t, w.Header().Get("X-Forwarded-Key"))
+
+	// the query parameter is removed before forwarding
+	w = serve("/?api_key=ops-key&page=2", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ops", w.Header().Get("X-Subject"))
+	assert.Equal(t, "page=2", w.Header().Get("X-Query"))
+
+	// the other parameters are forwarded as sent
+	w = serve("/?z=1&q=a+b%2Fc&api%5Fkey=ops-key&a=%7E&api_key=x&flag", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "z=1&q=a+b%2Fc&a=%7E&flag", w.Header().Get("X-Query"))
+
+	w = serve("/", "unknown")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "API_KEY_INVALID")
+
+	w = serve("/", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "API_KEY_REQUIRED")
+}
+
+func TestLoadApiKeys(t *testing.T) {
+	_, err := loadApiKeys(writeConfig(t, "keys.yaml", "keys:\n  - hash: plain-key\n    subject: ci\n"))
+	assert.ErrorContains(t, err, "no valid sha256 hash")
+	_, err = loadApiKeys(writeConfig(t, "keys.yaml", "keys:\n  - hash: "+hashApiKey("k")+"\n"))
+	assert.ErrorContains(t, err, "no subject")
+}
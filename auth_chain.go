@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// defaultAuthMethods is the order the auth chain tries the methods
+const defaultAuthMethods = "jwt,api_key,basic_auth,session,mtls"
+
+// authError is a rejection with the error code reported to client
+type authError struct {
+	code    string
+	message string
+	status  int
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+// authMethod is an authentication method of the auth chain
+type authMethod interface {
+	Middleware
+	// authenticate returns the identity of the credential in request, nil identity
+	// and nil error when the request has no credential of the method
+	authenticate(w http.ResponseWriter, r *http.Request) (*Identity, *authError)
+}
+
+// authEndpoints is implemented by the methods serving their own pages under /_/
+type authEndpoints interface {
+	serveEndpoint(w http.ResponseWriter, r *http.Request) bool
+}
+
+// authChallenger is implemented by the methods asking for credentials with WWW-Authenticate
+type authChallenger interface {
+	challenge() string
+}
+
+// AuthChainMiddleware tries the enabled authentication methods in AUTH_METHODS order,
+// the first succeeded one authenticates the request
+type AuthChainMiddleware struct {
+	methods    []authMethod
+	clientCert *ClientCertMiddleware
+	form       *FormLoginMiddleware
+	oidc       *OidcMiddleware
+	// apiKey strips the key of all requests forwarded, not only the ones it authenticated
+	apiKey *ApiKeyMiddleware
+}
+
+// parseAuthMethods resolves the method keys to the methods, session is form login
+// then oidc, both share the session cookie
+func parseAuthMethods(keys string, byKey map[string][]authMethod) ([]authMethod, error) {
+	methods := []authMethod{}
+	for _, key := range splitList(keys) {
+		found, ok := byKey[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown auth method %q, must be one of %v", key, lo.Keys(byKey))
+		}
+		methods = append(methods, found...)
+	}
+	return methods, nil
+}
+
+func authMethodKeys() string {
+	if keys := getenv("AUTH_METHODS"); len(keys) > 0 {
+		return keys
+	}
+	return defaultAuthMethods
+}
+
+// methodPreparer is implemented by the methods setting up stores or discovery before serving
+type methodPreparer interface {
+	prepare() error
+}
+
+func NewAuthChainMiddleware() (*AuthChainMiddleware, error) {
+	m := &AuthChainMiddleware{}
+	var err error
+	if m.clientCert, err = NewClientCertMiddleware(); err != nil {
+		return nil, err
+	}
+	if m.form, err = NewFormLoginMiddleware(); err != nil {
+		return nil, err
+	}
+	if m.oidc, err = NewOdicMiddleware(); err != nil {
+		return nil, err
+	}
+	bearer, err := NewJwtMiddleware()
+	if err != nil {
+		return nil, err
+	}
+	if m.apiKey, err = NewApiKeyMiddleware(); err != nil {
+		return nil, err
+	}
+	basicAuth, err := NewBasicAuthMiddleware()
+	if err != nil {
+		return nil, err
+	}
+	methods, err := parseAuthMethods(authMethodKeys(), map[string][]authMethod{
+		"jwt":        {bearer},
+		"api_key":    {m.apiKey},
+		"basic_auth": {basicAuth},
+		"session":    {m.form, m.oidc},
+		"mtls":       {m.clientCert},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("AUTH_METHODS is invalid: %w", err)
+	}
+	m.methods = lo.Filter(methods, func(method authMethod, _ int) bool {
+		return method.Enabled()
+	})
+	for _, method := range m.methods {
+		if p, ok := method.(methodPreparer); ok {
+			if err := p.prepare(); err != nil {
+				m.Close()
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+func (m *AuthChainMiddleware) Name() string {
+	return "AuthChainMiddleware"
+}
+
+func (m *AuthChainMiddleware) Enabled() bool {
+	return len(m.methods) > 0
+}
+
+// Close releases the background work of methods, like the jwks rotation
+func (m *AuthChainMiddleware) Close() error {
+	for _, method := range m.methods {
+		if closer, ok := method.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return nil
+}
+
+func (m *AuthChainMiddleware) Handler(next http.Handler) http.Handler {
+	for _, method := range m.methods {
+		log.Printf("auth method %s is enabled", method.Name())
+	}
+	forward := func(w http.ResponseWriter, r *http.Request) {
+		// the api key must not leak to upstream when another method authenticated
+		if m.apiKey.Enabled() {
+			m.apiKey.extractKey(r)
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range m.methods {
+			if e, ok := method.(authEndpoints); ok && e.serveEndpoint(w, r) {
+				return
+			}
+		}
+
+		route := routeFromContext(r.Context())
+		methods := lo.Filter(m.methods, func(method authMethod, _ int) bool {
+			return route == nil || route.selects(method.Name())
+		})
+		if len(methods) == 0 || isPublicRequest(r) {
+			forward(w, r)
+			return
+		}
+		if lo.Contains(methods, authMethod(m.clientCert)) && m.clientCert.rejectMissing(r) {
+			flushHttpResponseError(w, "client certificate is required", "CLIENT_CERT_REQUIRED")
+			return
+		}
+
+		var rejected *authError
+		for _, method := range methods {
+			identity, err := method.authenticate(w, r)
+			if identity != nil {
+				forward(w, withIdentity(r, identity))
+				return
+			}
+			if err != nil && rejected == nil {
+				rejected = err
+			}
+		}
+		m.unauthorized(w, r, methods, rejected)
+	})
+}
+
+// unavailableHandler rejects all requests of a method used standalone which failed to prepare
+func unavailableHandler(m Middleware, err error) http.Handler {
+	log.Printf("%s is unavailable: %s", m.Name(), err)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flushJsonErrorResponse(w, "authentication is unavailable", "AUTH_UNAVAILABLE", http.StatusServiceUnavailable)
+	})
+}
+
+// acceptsHTML reports the request comes from a browser navigating to a page
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// unauthorized rejects the request no method authenticated, browsers without credential
+// are sent to login, others get 401 with the credential rejected or the challenges
+func (m *AuthChainMiddleware) unauthorized(w http.ResponseWriter, r *http.Request, methods []authMethod, rejected *authError) {
+	if rejected == nil && acceptsHTML(r) {
+		if lo.Contains(methods, authMethod(m.oidc)) {
+			m.oidc.login(w, r)
+			return
+		}
+		if lo.Contains(methods, authMethod(m.form)) {
+			m.form.redirectToLogin(w, r)
+			return
+		}
+	}
+	if rejected == nil {
+		rejected = &authError{"AUTH_REQUIRED", "authentication is required", http.StatusUnauthorized}
+	}
+	if rejected.status == http.StatusUnauthorized {
+		for _, method := range methods {
+			if c, ok := method.(authChallenger); ok {
+				w.Header().Add("WWW-Authenticate", c.challenge())
+			}
+		}
+	}
+	flushJsonErrorResponse(w, rejected.message, rejected.code, rejected.status)
+}
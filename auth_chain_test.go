@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestAuthChain serves the chain, the response has the identity authenticated
+func newTestAuthChain(t *testing.T) http.Handler {
+	m := must(NewAuthChainMiddleware())
+	assert.True(t, m.Enabled())
+	return m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := identityFromContext(r.Context())
+		w.Header().Set("X-Subject", identity.Subject)
+		w.Header().Set("X-Method", identity.AuthMethod)
+	}))
+}
+
+func TestAuthChainMiddleware(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	t.Setenv("API_KEYS_FILE", writeConfig(t, "keys.yaml", "keys:\n  - hash: "+hashApiKey("ci-key")+"\n    subject: ci\n"))
+	t.Setenv("BASIC_AUTH_FILE", writeConfig(t, "htpasswd", "alice:"+testPasswordHash(t, "secret")+"\n"))
+	handler := newTestAuthChain(t)
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user"}).SignedString([]byte("secret"))
+
+	cases := []struct {
+		name    string
+		header  map[string]string
+		status  int
+		method  string
+		code    string
+		subject string
+	}{
+		{"jwt", map[string]string{"Authorization": "Bearer " + token}, http.StatusOK, "jwt", "", "user"},
+		{"api key", map[string]string{"X-API-Key": "ci-key"}, http.StatusOK, "api_key", "", "ci"},
+		{"basic", map[string]string{"Authorization": "Basic YWxpY2U6c2VjcmV0"}, http.StatusOK, "basic", "", "alice"},
+		// the first succeeded method wins
+		{"invalid jwt with api key", map[string]string{"Authorization": "Bearer invalid", "X-API-Key": "ci-key"}, http.StatusOK, "api_key", "", "ci"},
+		{"invalid jwt", map[string]string{"Authorization": "Bearer invalid"}, http.StatusUnauthorized, "", "JWT_VALIDATE_FAILED", ""},
+		{"invalid api key", map[string]string{"X-API-Key": "unknown"}, http.StatusUnauthorized, "", "API_KEY_INVALID", ""},
+		{"none", map[string]string{}, http.StatusUnauthorized, "", "AUTH_REQUIRED", ""},
+		// no login page to redirect to
+		{"browser", map[string]string{"Accept": "text/html"}, http.StatusUnauthorized, "", "AUTH_REQUIRED", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range c.header {
+				req.Header.Set(k, v)
+			}
+			rr := serve(handler, req)
+			assert.Equal(t, c.status, rr.Code)
+			assert.Equal(t, c.method, rr.Header().Get("X-Method"))
+			assert.Equal(t, c.subject, rr.Header().Get("X-Subject"))
+			if len(c.code) > 0 {
+				assert.Contains(t, rr.Body.String(), c.code)
+				assert.Equal(t, []string{"Bearer", `Basic realm="secure-app-proxy", charset="UTF-8"`}, rr.Header().Values("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestAuthChainMiddleware_StripApiKey(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	t.Setenv("API_KEYS_FILE", writeConfig(t, "keys.yaml", "keys:\n  - hash: "+hashApiKey("ci-key")+"\n    subject: ci\n"))
+	t.Setenv("API_KEY_QUERY_PARAM", "api_key")
+	t.Setenv("AUTHZ_RULES_FILE", writeConfig(t, "rules.yaml", "rules:\n  - path: /public\n    access: public\n"))
+	authz := must(NewAuthzMiddleware())
+	handler := authz.RuleMatcher().Handler(must(NewAuthChainMiddleware()).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Forwarded-Key", r.Header.Get("X-API-Key"))
+		w.Header().Set("X-Forwarded-Query", r.URL.RawQuery)
+	})))
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user"}).SignedString([]byte("secret"))
+
+	for _, path := range []string{"/app?api_key=ci-key&page=2", "/public?api_key=ci-key&page=2"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		// authenticated by jwt, or public
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-API-Key", "ci-key")
+		rr := serve(handler, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Empty(t, rr.Header().Get("X-Forwarded-Key"))
+		assert.Equal(t, "page=2", rr.Header().Get("X-Forwarded-Query"))
+	}
+}
+
+func TestAuthChainMiddleware_Oidc(t *testing.T) {
+	p := newMockOidcProvider(t)
+	newMockOidcMiddleware(t, p)
+	t.Setenv("JWT_SECRET", "secret")
+	handler := newTestAuthChain(t)
+
+	// bearer token is accepted without redirect to provider
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "api"}).SignedString([]byte("secret"))
+	req := httptest.NewRequest(http.MethodGet, "/app", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := serve(handler, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "jwt", rr.Header().Get("X-Method"))
+
+	// api clients are not redirected
+	rr = serve(handler, httptest.NewRequest(http.MethodGet, "/app", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "AUTH_REQUIRED")
+
+	// browser logs in with provider, then the session authenticates
+	cookies := oidcLogin(t, p, handler)
+	rr = serve(handler, withCookies(httptest.NewRequest(http.MethodGet, "/app", nil), cookies))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "oidc", rr.Header().Get("X-Method"))
+}
+
+func TestAuthChainMiddleware_FormLogin(t *testing.T) {
+	t.Setenv("FORM_LOGIN", "true")
+	t.Setenv("FORM_LOGIN_STORAGE_PATH", writeConfig(t, "htpasswd", "alice:"+testPasswordHash(t, "secret")+"\n"))
+	t.Setenv("ODIC_SESSION_SECRET", "0123456789abcdef0123456789abcdef")
+	handler := newTestAuthChain(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/app", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rr := serve(handler, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "/_/login?rd=%2Fapp", rr.Header().Get("Location"))
+
+	// the login page is served by the chain
+	rr = serve(handler, httptest.NewRequest(http.MethodGet, "/_/login", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestAuthChainMiddleware_RouteSelection(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	t.Setenv("API_KEYS_FILE", writeConfig(t, "keys.yaml", "keys:\n  - hash: "+hashApiKey("ci-key")+"\n    subject: ci\n"))
+	handler := newTestAuthChain(t)
+	route := &Route{Upstream: "http://localhost", Middlewares: []string{"jwt"}}
+	assert.NoError(t, route.compile())
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Key", "ci-key")
+	rr := serve((&RouteMatcher{routes: []*Route{route}}).Handler(handler), req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestParseAuthMethods(t *testing.T) {
+	jwt := &JwtMiddleware{}
+	methods, err := parseAuthMethods("mtls, jwt", map[string][]authMethod{"jwt": {jwt}, "mtls": {&ClientCertMiddleware{}}})
+	if assert.NoError(t, err) {
+		assert.Len(t, methods, 2)
+		assert.Equal(t, jwt, methods[1])
+	}
+	_, err = parseAuthMethods("saml", map[string][]authMethod{"jwt": {jwt}})
+	assert.ErrorContains(t, err, "unknown auth method")
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	accessPublic        = "public"
+	accessAuthenticated = "authenticated"
+	accessDeny          = "deny"
+)
+
+// AuthzRule decides the access of requests it matches
+type AuthzRule struct {
+	// Host matches the request host, supports glob like *.example.com
+	Host string `yaml:"host" json:"host"`
+	Path string `yaml:"path" json:"path"`
+	// PathType is prefix (default), glob or regex
+	PathType string   `yaml:"path_type" json:"path_type"`
+	Methods  []string `yaml:"methods" json:"methods"`
+	// Access is public, authenticated (default) or deny
+	Access string `yaml:"access" json:"access"`
+	// Groups allows identity in any of the groups
+	Groups []string `yaml:"groups" json:"groups"`
+	// Claims are claim matchers must all be satisfied, e.g. scope contains admin
+	Claims []string `yaml:"claims" json:"claims"`
+
+	hostPattern *regexp.Regexp
+	pathPattern *regexp.Regexp
+	matchers    []*claimMatcher
+}
+
+// AuthzConfig is the rule table, the first matched rule wins
+type AuthzConfig struct {
+	Rules []*AuthzRule `yaml:"rules" json:"rules"`
+}
+
+type authzRuleContextKey struct{}
+
+// globToRegexp converts glob to regexp, ** matches across slashes
+func globToRegexp(glob string, separator string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^" + regexp.QuoteMeta(separator) + "]*")
+			}
+		case '?':
+			b.WriteString("[^" + regexp.QuoteMeta(separator) + "]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// compile validates the rule and prepares its patterns
+func (rule *AuthzRule) compile() error {
+	var err error
+	rule.matchers = nil
+	if len(rule.Host) > 0 {
+		if rule.hostPattern, err = globToRegexp(strings.ToLower(rule.Host), "."); err != nil {
+			return err
+		}
+	}
+	switch rule.PathType {
+	case "", "prefix":
+	case "glob":
+		if rule.pathPattern, err = globToRegexp(rule.Path, "/"); err != nil {
+			return err
+		}
+	case "regex":
+		if rule.pathPattern, err = regexp.Compile(rule.Path); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown path_type %q", rule.PathType)
+	}
+	switch rule.Access {
+	case "":
+		rule.Access = accessAuthenticated
+	case accessPublic, accessAuthenticated, accessDeny:
+	default:
+		return fmt.Errorf("unknown access %q", rule.Access)
+	}
+	if rule.Access == accessPublic && (len(rule.Groups) > 0 || len(rule.Claims) > 0) {
+		return fmt.Errorf("public rule %q can not require groups or claims", rule.Path)
+	}
+	for _, expr := range rule.Claims {
+		matcher, err := parseClaimMatcher(expr)
+		if err != nil {
+			return err
+		}
+		rule.matchers = append(rule.matchers, matcher)
+	}
+	rule.Methods = lo.Map(rule.Methods, func(m string, _ int) string { return strings.ToUpper(m) })
+	return nil
+}
+
+func (rule *AuthzRule) Match(r *http.Request) bool {
+	if rule.hostPattern != nil {
+		host := strings.ToLower(r.Host)
+		if h, _, found := strings.Cut(host, ":"); found {
+			host = h
+		}
+		if !rule.hostPattern.MatchString(host) {
+			return false
+		}
+	}
+	if len(rule.Methods) > 0 && !lo.Contains(rule.Methods, r.Method) {
+		return false
+	}
+	if rule.pathPattern != nil {
+		return rule.pathPattern.MatchString(r.URL.Path)
+	}
+	// segments are matched as a whole, like the path prefix of routes
+	prefix := strings.TrimSuffix(rule.Path, "/")
+	return r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/")
+}
+
+// allows checks the identity satisfies groups and claims of rule
+func (rule *AuthzRule) allows(identity *Identity) bool {
+	if len(rule.Groups) > 0 && len(lo.Intersect(rule.Groups, identity.Groups)) == 0 {
+		return false
+	}
+	for _, matcher := range rule.matchers {
+		if !matcher.Match(identity.Claims) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadAuthzConfig reads rule table from YAML or JSON file
+func loadAuthzConfig(file string) (*AuthzConfig, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &AuthzConfig{}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, err
+	}
+	for i, rule := range config.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d is invalid: %w", i, err)
+		}
+	}
+	return config, nil
+}
+
+// matchAuthzRule returns the first rule matching request, nil if none
+func (c *AuthzConfig) matchAuthzRule(r *http.Request) *AuthzRule {
+	for _, rule := range c.Rules {
+		if rule.Match(r) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// isPublicRequest reports the request matched a public rule,
+// authentication middlewares let it through without credentials
+func isPublicRequest(r *http.Request) bool {
+	rule, _ := r.Context().Value(authzRuleContextKey{}).(*AuthzRule)
+	return rule != nil && rule.Access == accessPublic
+}
+
+// AuthzRuleMatcher matches request against the rule table before authentication,
+// it must be the outermost middleware
+type AuthzRuleMatcher struct {
+	config *AuthzConfig
+}
+
+func (m *AuthzRuleMatcher) Name() string {
+	return "AuthzRuleMatcher"
+}
+
+func (m *AuthzRuleMatcher) Enabled() bool {
+	return m.config != nil
+}
+
+func (m *AuthzRuleMatcher) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a public rule must not match a path upstream resolves to another one
+		if !cleanRequestPath(r.URL) {
+			flushJsonErrorResponse(w, "request path is not canonical", "PATH_INVALID", http.StatusBadRequest)
+			return
+		}
+		if rule := m.config.matchAuthzRule(r); rule != nil {
+			r = r.WithContext(context.WithValue(r.Context(), authzRuleContextKey{}, rule))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AuthzMiddleware enforces the matched rule after authentication middlewares
+// populated the identity
+type AuthzMiddleware struct {
+	config *AuthzConfig
+}
+
+// loadAuthzSettings loads the rules from AUTHZ_RULES_FILE, or the rules inline
+// in config file, nil when there is no rule
+func loadAuthzSettings() (*AuthzConfig, error) {
+	if file := getenv("AUTHZ_RULES_FILE"); len(file) > 0 {
+		return loadAuthzConfig(file)
+	}
+	if config := loadedConfig(); config != nil && len(config.Authz.Rules) > 0 {
+		// the rules are compiled on copies, the loaded config is shared by every chain
+		// built from it and read concurrently by the chain serving requests
+		rules := make([]*AuthzRule, 0, len(config.Authz.Rules))
+		for i, rule := range config.Authz.Rules {
+			copied := *rule
+			if err := copied.compile(); err != nil {
+				return nil, fmt.Errorf("rule %d is invalid: %w", i, err)
+			}
+			rules = append(rules, &copied)
+		}
+		return &AuthzConfig{Rules: rules}, nil
+	}
+	return nil, nil
+}
+
+func NewAuthzMiddleware() (*AuthzMiddleware, error) {
+	config, err := loadAuthzSettings()
+	if err != nil {
+		return nil, fmt.Errorf("load authorization rules failed: %w", err)
+	}
+	return &AuthzMiddleware{config: config}, nil
+}
+
+// RuleMatcher is the middleware matching rules, must be applied before authentication
+func (m *AuthzMiddleware) RuleMatcher() *AuthzRuleMatcher {
+	return &AuthzRuleMatcher{config: m.config}
+}
+
+func (m *AuthzMiddleware) Name() string {
+	return "AuthzMiddleware"
+}
+
+func (m *AuthzMiddleware) Enabled() bool {
+	return m.config != nil
+}
+
+func (m *AuthzMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule, _ := r.Context().Value(authzRuleContextKey{}).(*AuthzRule)
+		if rule == nil || rule.Access == accessPublic {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if rule.Access == accessDeny {
+			flushJsonErrorResponse(w, "access to the resource is denied", "AUTHZ_FORBIDDEN", http.StatusForbidden)
+			return
+		}
+		identity := identityFromContext(r.Context())
+		if identity == nil {
+			flushHttpResponseError(w, "authentication is required", "AUTHZ_UNAUTHENTICATED")
+			return
+		}
+		if !rule.allows(identity) {
+			flushJsonErrorResponse(w, "identity is not allowed to access the resource", "AUTHZ_FORBIDDEN", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
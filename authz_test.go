@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAuthzRules = `
+rules:
+  - path: /healthz
+    access: public
+  - host: "*.internal.example.com"
+    path: /
+    access: deny
+  - path: /admin
+    groups: [admin]
+  - path: "/static/**.js"
+    path_type: glob
+    access: public
+  - path: "^/users/[0-9]+$"
+    path_type: regex
+    methods: [delete]
+    claims: ["scope contains users:delete"]
+`
+
+func writeAuthzRules(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+	return file
+}
+
+func TestAuthzMiddleware(t *testing.T) {
+	t.Setenv("AUTHZ_RULES_FILE", writeAuthzRules(t, testAuthzRules))
+	t.Setenv("JWT_SECRET", "secret")
+	authz := must(NewAuthzMiddleware())
+	assert.True(t, authz.Enabled())
+
+	handler := authz.RuleMatcher().Handler(
+		must(NewJwtMiddleware()).Handler(
+			authz.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})),
+		),
+	)
+
+	token := func(claims jwt.MapClaims) string {
+		signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		return signed
+	}
+	admin := token(jwt.MapClaims{"sub": "admin", "groups": []string{"admin"}, "scope": "users:delete"})
+	dev := token(jwt.MapClaims{"sub": "dev", "groups": []string{"dev"}})
+
+	cases := []struct {
+		method string
+		url    string
+		token  string
+		status int
+	}{
+		{http.MethodGet, "http://app.example.com/healthz", "", http.StatusOK},
+		{http.MethodGet, "http://app.example.com/healthz/live", "", http.StatusOK},
+		{http.MethodGet, "http://app.example.com//healthz", "", http.StatusOK},
+		// sibling prefix and traversal out of the public path
+		{http.MethodGet, "http://app.example.com/healthzX", "", http.StatusUnauthorized},
+		{http.MethodGet, "http://app.example.com/healthz/../admin/users", "", http.StatusBadRequest},
+		{http.MethodGet, "http://app.example.com/healthz/%2e%2e/admin/users", "", http.StatusBadRequest},
+		{http.MethodGet, "http://app.example.com/healthz/..%2Fadmin/users", "", http.StatusBadRequest},
+		{http.MethodGet, "http://app.example.com/static/js/app.js", "", http.StatusOK},
+		{http.MethodGet, "http://app.example.com/static/app.css", "", http.StatusUnauthorized},
+		{http.MethodGet, "http://app.example.com/other", "", http.StatusUnauthorized},
+		{http.MethodGet, "http://app.example.com/other", dev, http.StatusOK},
+		{http.MethodGet, "http://app.example.com/admin/users", dev, http.StatusForbidden},
+		{http.MethodGet, "http://app.example.com/admin/users", admin, http.StatusOK},
+		{http.MethodGet, "http://db.internal.example.com:8080/healthz", "", http.StatusOK},
+		{http.MethodGet, "http://db.internal.example.com:8080/data", admin, http.StatusForbidden},
+		{http.MethodDelete, "http://app.example.com/users/1", dev, http.StatusForbidden},
+		{http.MethodDelete, "http://app.example.com/users/1", admin, http.StatusOK},
+		{http.MethodGet, "http://app.example.com/users/1", dev, http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.method+" "+c.url, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, c.url, nil)
+			if len(c.token) > 0 {
+				req.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, c.status, rr.Code)
+		})
+	}
+}
+
+func TestLoadAuthzConfig_Invalid(t *testing.T) {
+	_, err := loadAuthzConfig(writeAuthzRules(t, `{"rules": [{"path": "/", "access": "maybe"}]}`))
+	assert.Error(t, err)
+	_, err = loadAuthzConfig(writeAuthzRules(t, `{"rules": [{"path": "(", "path_type": "regex"}]}`))
+	assert.Error(t, err)
+	_, err = loadAuthzConfig(writeAuthzRules(t, `{"rules": [{"path": "/", "access": "public", "groups": ["a"]}]}`))
+	assert.Error(t, err)
+	_, err = loadAuthzConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestLoadAuthzSettings_ConfigNotModified(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, "config.yaml", "authz:\n  rules:\n    - path: \"/static/**\"\n      path_type: glob\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	useConfig(t, config)
+
+	authz, err := loadAuthzSettings()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotNil(t, authz.Rules[0].pathPattern)
+	assert.Equal(t, accessAuthenticated, authz.Rules[0].Access)
+	assert.NotSame(t, config.Authz.Rules[0], authz.Rules[0])
+	assert.Nil(t, config.Authz.Rules[0].pathPattern)
+	assert.Empty(t, config.Authz.Rules[0].Access)
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	re, _ := globToRegexp("/static/*.js", "/")
+	assert.True(t, re.MatchString("/static/app.js"))
+	assert.False(t, re.MatchString("/static/js/app.js"))
+	re, _ = globToRegexp("/static/**", "/")
+	assert.True(t, re.MatchString("/static/js/app.js"))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	defaultBasicAuthRealm           = "secure-app-proxy"
+	defaultBasicAuthMaxFailures     = 10
+	defaultBasicAuthLockoutDuration = 5 * time.Minute
+	// basicAuthCacheTTL is how long a verified credential skips the password hash
+	basicAuthCacheTTL = time.Minute
+	// basicAuthCacheSize bounds the verified credentials kept in memory
+	basicAuthCacheSize = 1024
+)
+
+// sharedBasicAuthFailures counts the failures by client IP, survives the rebuild of
+// middlewares on config reload
+var sharedBasicAuthFailures = newLoginFailures()
+
+// BasicAuthMiddleware authenticates requests by HTTP Basic credentials against an
+// htpasswd file of bcrypt or argon2 hashes
+type BasicAuthMiddleware struct {
+	enabled bool
+	users   userStore
+	realm   string
+	// maxFailures locks out the client IP guessing passwords, the hash is not computed
+	// for a locked client
+	maxFailures int
+	lockout     time.Duration
+	failures    *loginFailures
+	proxies     trustedProxies
+	cache       *basicAuthCache
+}
+
+func NewBasicAuthMiddleware() (*BasicAuthMiddleware, error) {
+	file := getenv("BASIC_AUTH_FILE")
+	if len(file) == 0 {
+		return &BasicAuthMiddleware{}, nil
+	}
+	users, err := newFileUserStore(file, parseHtpasswd)
+	if err != nil {
+		return nil, fmt.Errorf("load BASIC_AUTH_FILE failed: %w", err)
+	}
+	realm := getenv("BASIC_AUTH_REALM")
+	if len(realm) == 0 {
+		realm = defaultBasicAuthRealm
+	}
+	maxFailures, err := parseCountOr("BASIC_AUTH_MAX_FAILURES", getenv("BASIC_AUTH_MAX_FAILURES"), defaultBasicAuthMaxFailures)
+	if err != nil {
+		return nil, err
+	}
+	lockout, err := parseDurationOr("BASIC_AUTH_LOCKOUT_DURATION", getenv("BASIC_AUTH_LOCKOUT_DURATION"), defaultBasicAuthLockoutDuration)
+	if err != nil {
+		return nil, err
+	}
+	proxies, err := parseTrustedProxies(getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES is invalid: %w", err)
+	}
+	return &BasicAuthMiddleware{
+		enabled:     true,
+		users:       users,
+		realm:       realm,
+		maxFailures: maxFailures,
+		lockout:     lockout,
+		failures:    sharedBasicAuthFailures,
+		proxies:     proxies,
+		cache:       newBasicAuthCache(),
+	}, nil
+}
+
+// basicAuthCache remembers the credentials verified recently, keyed by their HMAC, so
+// a client sending the same credentials on every request does not pay the password
+// hash each time
+type basicAuthCache struct {
+	key     []byte
+	mu      sync.Mutex
+	entries map[string]basicAuthCacheEntry
+}
+
+type basicAuthCacheEntry struct {
+	user     *formUser
+	expireAt time.Time
+}
+
+func newBasicAuthCache() *basicAuthCache {
+	return &basicAuthCache{key: securecookie.GenerateRandomKey(32), entries: map[string]basicAuthCacheEntry{}}
+}
+
+func (c *basicAuthCache) credentialKey(username string, password string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(strconv.Itoa(len(username)) + ":" + username + password))
+	return string(mac.Sum(nil))
+}
+
+// get returns the user verified with the credentials, nil when not cached
+func (c *basicAuthCache) get(username string, password string, now time.Time) *formUser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[c.credentialKey(username, password)]
+	if !ok || now.After(entry.expireAt) {
+		return nil
+	}
+	return entry.user
+}
+
+func (c *basicAuthCache) put(username string, password string, user *formUser, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= basicAuthCacheSize {
+		for key, entry := range c.entries {
+			if now.After(entry.expireAt) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= basicAuthCacheSize {
+			c.entries = map[string]basicAuthCacheEntry{}
+		}
+	}
+	c.entries[c.credentialKey(username, password)] = basicAuthCacheEntry{user: user, expireAt: now.Add(basicAuthCacheTTL)}
+}
+
+// verify checks the credentials against the cache, then the password hash
+func (m *BasicAuthMiddleware) verify(username string, password string, now time.Time) (*formUser, error) {
+	if cached := m.cache.get(username, password, now); cached != nil {
+		// a changed file reloads the users, the credentials cached before are verified again
+		if user, err := m.users.lookup(username); err == nil && user == cached {
+			return user, nil
+		}
+	}
+	user, err := authenticateUser(m.users, username, password)
+	if user != nil {
+		m.cache.put(username, password, user, now)
+	}
+	return user, err
+}
+
+func (m *BasicAuthMiddleware) Name() string {
+	return "BasicAuthMiddleware"
+}
+
+func (m *BasicAuthMiddleware) Enabled() bool {
+	return m.enabled
+}
+
+// challenge is the WWW-Authenticate challenge asking for basic credentials
+func (m *BasicAuthMiddleware) challenge() string {
+	return fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", m.realm)
+}
+
+// authenticate verifies the basic credentials, the request has no credential of the
+// method without Authorization: Basic
+func (m *BasicAuthMiddleware) authenticate(w http.ResponseWriter, r *http.Request) (*Identity, *authError) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	now := time.Now()
+	clientIP := m.proxies.clientIP(r)
+	if m.maxFailures > 0 && !m.failures.lockedUntil(clientIP, now).IsZero() {
+		return nil, &authError{"BASIC_AUTH_LOCKED", "too many failed attempts, please try again later", http.StatusTooManyRequests}
+	}
+	user, err := m.verify(username, password, now)
+	if err != nil {
+		log.Printf("lookup basic auth user failed %s", err)
+		return nil, &authError{"BASIC_AUTH_FAILED", "user store is unavailable", http.StatusInternalServerError}
+	}
+	if user == nil {
+		if m.maxFailures > 0 {
+			m.failures.fail(clientIP, now, m.maxFailures, m.lockout)
+		}
+		return nil, &authError{"BASIC_AUTH_INVALID", "invalid username or password", http.StatusUnauthorized}
+	}
+	// the password is for the proxy only
+	r.Header.Del("Authorization")
+	return newIdentity("basic", user.claims()), nil
+}
+
+func (m *BasicAuthMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublicRequest(r) || identityFromContext(r.Context()) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		identity, err := m.authenticate(w, r)
+		if err == nil && identity == nil {
+			err = &authError{"BASIC_AUTH_REQUIRED", "basic credentials are required", http.StatusUnauthorized}
+		}
+		if err != nil {
+			if err.status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", m.challenge())
+			}
+			flushJsonErrorResponse(w, err.message, err.code, err.status)
+			return
+		}
+		next.ServeHTTP(w, withIdentity(r, identity))
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBasicAuthMiddleware(t *testing.T) {
+	content := "alice:" + testPasswordHash(t, "secret") + "\nbob:" + testArgon2Hash("hunter2") + "\n"
+	t.Setenv("BASIC_AUTH_FILE", writeConfig(t, "htpasswd", content))
+	m := must(NewBasicAuthMiddleware())
+	assert.True(t, m.Enabled())
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := identityFromContext(r.Context())
+		w.Header().Set("X-Subject", identity.Subject)
+		w.Header().Set("X-Method", identity.AuthMethod)
+		w.Header().Set("X-Authorization", r.Header.Get("Authorization"))
+	}))
+	serve := func(username string, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if len(username) > 0 {
+			req.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("alice", "secret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice", w.Header().Get("X-Subject"))
+	assert.Equal(t, "basic", w.Header().Get("X-Method"))
+	assert.Empty(t, w.Header().Get("X-Authorization"))
+
+	w = serve("bob", "hunter2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "bob", w.Header().Get("X-Subject"))
+
+	w = serve("alice", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "BASIC_AUTH_INVALID")
+
+	w = serve("", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Basic realm="secure-app-proxy", charset="UTF-8"`, w.Header().Get("WWW-Authenticate"))
+}
+
+func TestBasicAuthMiddleware_Lockout(t *testing.T) {
+	t.Setenv("BASIC_AUTH_FILE", writeConfig(t, "htpasswd", "alice:"+testPasswordHash(t, "secret")+"\n"))
+	t.Setenv("BASIC_AUTH_MAX_FAILURES", "2")
+	m := must(NewBasicAuthMiddleware())
+	m.failures = newLoginFailures()
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(remoteAddr string, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.SetBasicAuth("alice", password)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve("192.0.2.1:1000", "wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("192.0.2.1:1000", "guess").Code)
+	// the locked client is rejected before the password is checked
+	w := serve("192.0.2.1:1000", "secret")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "BASIC_AUTH_LOCKED")
+	assert.Equal(t, http.StatusOK, serve("192.0.2.2:1000", "secret").Code)
+}
+
+func TestBasicAuthMiddleware_Cache(t *testing.T) {
+	file := writeConfig(t, "htpasswd", "alice:"+testPasswordHash(t, "secret")+"\n")
+	t.Setenv("BASIC_AUTH_FILE", file)
+	m := must(NewBasicAuthMiddleware())
+	now := time.Now()
+
+	user, err := m.verify("alice", "secret", now)
+	assert.NoError(t, err)
+	assert.Same(t, user, m.cache.get("alice", "secret", now))
+	assert.Nil(t, m.cache.get("alice", "other", now))
+	assert.Nil(t, m.cache.get("alice", "secret", now.Add(basicAuthCacheTTL+time.Second)))
+
+	// a failed verification is not cached
+	user, err = m.verify("alice", "wrong", now)
+	assert.NoError(t, err)
+	assert.Nil(t, user)
+	assert.Nil(t, m.cache.get("alice", "wrong", now))
+
+	// the password changed in file is effective at once
+	assert.NoError(t, os.WriteFile(file, []byte("alice:"+testPasswordHash(t, "changed")+"\n"), 0600))
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(file, future, future))
+	user, err = m.verify("alice", "secret", now)
+	assert.NoError(t, err)
+	assert.Nil(t, user)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker fast-fails the requests of an upstream after consecutive failures,
+// a trial request is let through when the open timeout passed (half-open), its
+// result closes or reopens the circuit
+type circuitBreaker struct {
+	name      string
+	threshold int
+	timeout   time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	// trial is set when the half-open trial request is in flight
+	trial bool
+}
+
+// newCircuitBreaker creates breaker, nil when threshold is 0 (disabled)
+func newCircuitBreaker(name string, threshold int, timeout time.Duration) *circuitBreaker {
+	if threshold == 0 {
+		return nil
+	}
+	return &circuitBreaker{name: name, threshold: threshold, timeout: timeout}
+}
+
+// allow reports the request can be sent to upstream, trial is set for the trial
+// request of half-open circuit and must be passed to record or release
+func (b *circuitBreaker) allow() (allowed bool, trial bool) {
+	if b == nil {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.timeout {
+			return false, false
+		}
+		b.state = circuitHalfOpen
+		b.trial = true
+		return true, true
+	case circuitHalfOpen:
+		if b.trial {
+			return false, false
+		}
+		b.trial = true
+		return true, true
+	}
+	return true, false
+}
+
+// record reports the result of a request allowed, only the trial decides the
+// half-open circuit
+func (b *circuitBreaker) record(failed bool, trial bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if trial {
+		b.trial = false
+		if failed {
+			b.open()
+		} else {
+			b.state = circuitClosed
+			b.failures = 0
+			log.Printf("circuit breaker of upstream %s is closed", b.name)
+		}
+		return
+	}
+	if b.state != circuitClosed {
+		// sent before the circuit opened
+		return
+	}
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.open()
+	}
+}
+
+// release frees the trial slot of a request ended without result, e.g. canceled
+// by client or panicked, so the next request becomes the trial
+func (b *circuitBreaker) release(trial bool) {
+	if b == nil || !trial {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+func (b *circuitBreaker) open() {
+	b.state = circuitOpen
+	b.openedAt = time.Now()
+	b.failures = 0
+	log.Printf("circuit breaker of upstream %s is open for %s", b.name, b.timeout)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// claimMatcher is a simple predicate on a claim, written as
+//
+//	scope contains api:read
+//	role in [admin,ops]
+//	tenant == acme
+type claimMatcher struct {
+	claim    string
+	operator string
+	values   []string
+}
+
+var claimMatcherPattern = regexp.MustCompile(`^\s*(\S+)\s+(contains|in|==)\s+(.+?)\s*$`)
+
+func parseClaimMatcher(expr string) (*claimMatcher, error) {
+	parts := claimMatcherPattern.FindStringSubmatch(expr)
+	if parts == nil {
+		return nil, fmt.Errorf("invalid claim matcher %q", expr)
+	}
+	m := &claimMatcher{claim: parts[1], operator: parts[2]}
+	value := parts[3]
+	if m.operator == "in" {
+		if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+			return nil, fmt.Errorf("invalid claim matcher %q, values of in must be like [a,b]", expr)
+		}
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); len(v) > 0 {
+				m.values = append(m.values, v)
+			}
+		}
+	} else {
+		m.values = []string{value}
+	}
+	return m, nil
+}
+
+// parseClaimMatchers parses matchers separated by semicolon
+func parseClaimMatchers(exprs string) ([]*claimMatcher, error) {
+	matchers := []*claimMatcher{}
+	for _, expr := range strings.Split(exprs, ";") {
+		if len(strings.TrimSpace(expr)) == 0 {
+			continue
+		}
+		m, err := parseClaimMatcher(expr)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// claimValues flattens claim to strings, space separated string (like scope) is split
+func claimValues(v interface{}, split bool) []string {
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case string:
+		if split {
+			return strings.Fields(value)
+		}
+		return []string{value}
+	case []string:
+		return value
+	case []interface{}:
+		values := []string{}
+		for _, item := range value {
+			values = append(values, formatClaim(item))
+		}
+		return values
+	}
+	return []string{formatClaim(v)}
+}
+
+func (m *claimMatcher) Match(claims map[string]interface{}) bool {
+	claim := lookupClaim(claims, m.claim)
+	switch m.operator {
+	case "contains":
+		return lo.Contains(claimValues(claim, true), m.values[0])
+	case "in":
+		for _, v := range claimValues(claim, false) {
+			if lo.Contains(m.values, v) {
+				return true
+			}
+		}
+		return false
+	case "==":
+		return claim != nil && formatClaim(claim) == m.values[0]
+	}
+	return false
+}
+
+func (m *claimMatcher) String() string {
+	if m.operator == "in" {
+		return fmt.Sprintf("%s in [%s]", m.claim, strings.Join(m.values, ","))
+	}
+	return fmt.Sprintf("%s %s %s", m.claim, m.operator, m.values[0])
+}
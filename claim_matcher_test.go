@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimMatcher(t *testing.T) {
+	claims := map[string]interface{}{
+		"scope":  "api:read api:write",
+		"role":   "ops",
+		"groups": []interface{}{"dev", "qa"},
+		"tenant": map[string]interface{}{"id": "acme"},
+	}
+	cases := []struct {
+		expr  string
+		match bool
+	}{
+		{"scope contains api:read", true},
+		{"scope contains api:admin", false},
+		{"groups contains qa", true},
+		{"role in [admin, ops]", true},
+		{"role in [admin]", false},
+		{"groups in [ops,dev]", true},
+		{"tenant.id == acme", true},
+		{"tenant.id == other", false},
+		{"missing == x", false},
+	}
+	for _, c := range cases {
+		m, err := parseClaimMatcher(c.expr)
+		assert.NoError(t, err, c.expr)
+		assert.Equal(t, c.match, m.Match(claims), c.expr)
+	}
+}
+
+func TestParseClaimMatchers(t *testing.T) {
+	matchers, err := parseClaimMatchers("scope contains api:read; role in [admin,ops];")
+	assert.NoError(t, err)
+	assert.Len(t, matchers, 2)
+	assert.Equal(t, "role in [admin,ops]", matchers[1].String())
+
+	_, err = parseClaimMatchers("role in admin")
+	assert.Error(t, err)
+	_, err = parseClaimMatchers("role like admin")
+	assert.Error(t, err)
+}
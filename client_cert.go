@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/samber/lo"
+)
+
+// clientCertSubjects are the certificate fields can be used as identity subject
+var clientCertSubjects = []string{"cn", "spiffe", "san_dns", "san_email", "san_uri"}
+
+// loadClientCAs reads CLIENT_CA_FILE, nil when client certificates are not used
+func loadClientCAs() (*x509.CertPool, error) {
+	file := getenv("CLIENT_CA_FILE")
+	if len(file) == 0 {
+		return nil, nil
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// clientCertificate returns the verified client certificate of request, nil if none
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// formatClientCertificate renders certificate for the upstream header, pem is the URL
+// escaped PEM (like nginx $ssl_client_escaped_cert), sha256 is the hex fingerprint
+func formatClientCertificate(cert *x509.Certificate, format string) string {
+	if format == "sha256" {
+		sum := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(sum[:])
+	}
+	return url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+}
+
+// clientCertClaims are the claims of identity authenticated by certificate, the
+// organizational units are the groups
+func clientCertClaims(cert *x509.Certificate) map[string]interface{} {
+	toList := func(values []string) []interface{} {
+		return lo.Map(values, func(v string, _ int) interface{} { return v })
+	}
+	uris := lo.Map(cert.URIs, func(u *url.URL, _ int) string { return u.String() })
+	claims := map[string]interface{}{
+		"cn":        cert.Subject.CommonName,
+		"san_dns":   toList(cert.DNSNames),
+		"san_email": toList(cert.EmailAddresses),
+		"san_uri":   toList(uris),
+		"groups":    toList(cert.Subject.OrganizationalUnit),
+		"issuer":    cert.Issuer.String(),
+		"serial":    cert.SerialNumber.String(),
+	}
+	if spiffe, ok := lo.Find(cert.URIs, func(u *url.URL) bool { return u.Scheme == "spiffe" }); ok {
+		claims["spiffe"] = spiffe.String()
+	}
+	if len(cert.EmailAddresses) > 0 {
+		claims["email"] = cert.EmailAddresses[0]
+	}
+	return claims
+}
+
+// ClientCertMiddleware authenticates the clients by certificates verified against
+// CLIENT_CA_FILE during TLS handshake
+type ClientCertMiddleware struct {
+	enabled  bool
+	required bool
+	subject  string
+}
+
+func NewClientCertMiddleware() (*ClientCertMiddleware, error) {
+	if len(getenv("CLIENT_CA_FILE")) == 0 {
+		return &ClientCertMiddleware{}, nil
+	}
+	m := &ClientCertMiddleware{enabled: true, required: true, subject: "cn"}
+	switch mode := getenv("CLIENT_CERT_MODE"); mode {
+	case "", "require":
+	case "optional":
+		m.required = false
+	default:
+		return nil, fmt.Errorf("%s is not a valid CLIENT_CERT_MODE, must be require or optional", mode)
+	}
+	if subject := getenv("CLIENT_CERT_SUBJECT"); len(subject) > 0 {
+		if !lo.Contains(clientCertSubjects, subject) {
+			return nil, fmt.Errorf("%s is not a valid CLIENT_CERT_SUBJECT, must be one of %v", subject, clientCertSubjects)
+		}
+		m.subject = subject
+	}
+	return m, nil
+}
+
+func (m *ClientCertMiddleware) Name() string {
+	return "ClientCertMiddleware"
+}
+
+func (m *ClientCertMiddleware) Enabled() bool {
+	return m.enabled
+}
+
+// authenticate takes the identity of verified client certificate, the request has no
+// credential of the method without a certificate
+func (m *ClientCertMiddleware) authenticate(w http.ResponseWriter, r *http.Request) (*Identity, *authError) {
+	cert := clientCertificate(r)
+	if cert == nil {
+		return nil, nil
+	}
+	claims := clientCertClaims(cert)
+	subject := ""
+	switch value := claims[m.subject].(type) {
+	case string:
+		subject = value
+	case []interface{}:
+		if len(value) > 0 {
+			subject = formatClaim(value[0])
+		}
+	}
+	if len(subject) == 0 {
+		return nil, &authError{"CLIENT_CERT_INVALID", fmt.Sprintf("client certificate has no %s", m.subject), http.StatusUnauthorized}
+	}
+	claims["sub"] = subject
+	return newIdentity("mtls", claims), nil
+}
+
+// rejectMissing reports the request must be rejected because the required certificate is missing
+func (m *ClientCertMiddleware) rejectMissing(r *http.Request) bool {
+	return m.required && clientCertificate(r) == nil && !isPublicRequest(r)
+}
+
+func (m *ClientCertMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.rejectMissing(r) {
+			flushHttpResponseError(w, "client certificate is required", "CLIENT_CERT_REQUIRED")
+			return
+		}
+		identity, err := m.authenticate(w, r)
+		if err != nil {
+			flushJsonErrorResponse(w, err.message, err.code, err.status)
+			return
+		}
+		if identity != nil {
+			r = withIdentity(r, identity)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClientCertificate(t *testing.T, ca *testCertificate) *testCertificate {
+	spiffe, _ := url.Parse("spiffe://example.com/ns/prod/sa/billing")
+	return issueTestCertificate(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "billing", OrganizationalUnit: []string{"payments"}},
+		URIs:        []*url.URL{spiffe},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// startClientCertServer serves ClientCertMiddleware over TLS, the response has the identity
+func startClientCertServer(t *testing.T, ca *testCertificate) string {
+	caFile, _ := ca.writeFiles(t)
+	certFile, keyFile := newTestServerCertificate(t, ca, "app.example.com").writeFiles(t)
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	t.Setenv("CLIENT_CA_FILE", caFile)
+	m := must(NewClientCertMiddleware())
+	assert.True(t, m.Enabled())
+	return startTLSServer(t, m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity := identityFromContext(r.Context()); identity != nil {
+			w.Header().Set("X-Subject", identity.Subject)
+			w.Header().Set("X-Groups", strings.Join(identity.Groups, ","))
+			w.Header().Set("X-Method", identity.AuthMethod)
+		}
+	})))
+}
+
+func getWithClientCert(t *testing.T, ca *testCertificate, addr string, cert *testCertificate) (*http.Response, error) {
+	client := tlsClient(ca, "app.example.com")
+	if cert != nil {
+		client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert.tlsCertificate()}
+	}
+	resp, err := client.Get("https://" + addr)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestClientCertMiddleware(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startClientCertServer(t, ca)
+
+	resp, err := getWithClientCert(t, ca, addr, newTestClientCertificate(t, ca))
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "billing", resp.Header.Get("X-Subject"))
+		assert.Equal(t, "payments", resp.Header.Get("X-Groups"))
+		assert.Equal(t, "mtls", resp.Header.Get("X-Method"))
+	}
+
+	// required by default
+	resp, err = getWithClientCert(t, ca, addr, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// certificate of other CA is rejected in handshake
+	_, err = getWithClientCert(t, ca, addr, newTestClientCertificate(t, newTestCA(t)))
+	assert.Error(t, err)
+}
+
+func TestClientCertMiddleware_OptionalSpiffe(t *testing.T) {
+	t.Setenv("CLIENT_CERT_MODE", "optional")
+	t.Setenv("CLIENT_CERT_SUBJECT", "spiffe")
+	ca := newTestCA(t)
+	addr := startClientCertServer(t, ca)
+
+	resp, err := getWithClientCert(t, ca, addr, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("X-Subject"))
+	}
+	resp, err = getWithClientCert(t, ca, addr, newTestClientCertificate(t, ca))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "spiffe://example.com/ns/prod/sa/billing", resp.Header.Get("X-Subject"))
+	}
+
+	// certificate without the subject field
+	t.Setenv("CLIENT_CERT_SUBJECT", "san_email")
+	req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+	req.TLS.VerifiedChains = [][]*x509.Certificate{{newTestClientCertificate(t, ca).cert}}
+	rr := serve(must(NewClientCertMiddleware()).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})), req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "CLIENT_CERT_INVALID")
+}
+
+func TestCreateRewriter_ClientCertHeader(t *testing.T) {
+	t.Setenv("UPSTREAM", "http://example.com")
+	t.Setenv("CLIENT_CERT_HEADER", "X-Client-Cert")
+	cert := newTestClientCertificate(t, newTestCA(t))
+
+	rewrite := func(withCert bool) http.Header {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+		req.Header.Set("X-Client-Cert", "spoofed")
+		if withCert {
+			req.TLS.VerifiedChains = [][]*x509.Certificate{{cert.cert}}
+		}
+		pr := &httputil.ProxyRequest{In: req, Out: req.Clone(req.Context())}
+		newTestRewriter(t)(pr)
+		return pr.Out.Header
+	}
+
+	assert.Empty(t, rewrite(false).Get("X-Client-Cert"))
+	escaped := rewrite(true).Get("X-Client-Cert")
+	pem, _ := url.QueryUnescape(escaped)
+	assert.True(t, strings.HasPrefix(pem, "-----BEGIN CERTIFICATE-----"))
+
+	t.Setenv("CLIENT_CERT_HEADER_FORMAT", "sha256")
+	sum := sha256.Sum256(cert.cert.Raw)
+	assert.Equal(t, hex.EncodeToString(sum[:]), rewrite(true).Get("X-Client-Cert"))
+}
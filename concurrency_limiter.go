@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+const (
+	defaultConcurrencyQueueTimeout = time.Second
+	// aimdBackoff shrinks the adaptive limit on an overloaded response
+	aimdBackoff = 0.9
+)
+
+var (
+	errConcurrencyQueueFull    = errors.New("too many requests in flight")
+	errConcurrencyQueueTimeout = errors.New("request waited too long in queue")
+)
+
+// concurrencyLimitKeys are the accepted values of concurrency limit key besides header:<name>
+var concurrencyLimitKeys = []string{"route", "subject", "api_key", "ip"}
+
+// ConcurrencyLimitConfig caps the requests in flight to the upstream of a route, empty
+// fields use the CONCURRENCY_* environment variables
+type ConcurrencyLimitConfig struct {
+	// Max is the requests in flight of each key, 0 disables the limit
+	Max string `yaml:"max" json:"max"`
+	// Key counts requests of the whole route (default), or by subject, api_key, ip
+	// or header:<name> within the route
+	Key string `yaml:"key" json:"key"`
+	// QueueSize is the requests waiting for a slot, the others are rejected at once
+	QueueSize string `yaml:"queue_size" json:"queue_size"`
+	// QueueTimeout is how long a request waits for a slot, default 1s
+	QueueTimeout string `yaml:"queue_timeout" json:"queue_timeout"`
+	// Priority are claim rules, the queued requests matching an earlier rule go first,
+	// FIFO within the same rule
+	Priority []string `yaml:"priority" json:"priority"`
+	// Adaptive adjusts the limit between MinLimit and Max by AIMD, shrinks it on 5xx
+	// or responses slower than LatencyTarget and grows it back on healthy ones
+	Adaptive      string `yaml:"adaptive" json:"adaptive"`
+	MinLimit      string `yaml:"min_limit" json:"min_limit"`
+	LatencyTarget string `yaml:"latency_target" json:"latency_target"`
+}
+
+type concurrencySettings struct {
+	// scope separates the limiters of routes
+	scope         string
+	max           int
+	key           string
+	queueSize     int
+	queueTimeout  time.Duration
+	priority      []*claimMatcher
+	adaptive      bool
+	minLimit      int
+	latencyTarget time.Duration
+}
+
+func concurrencyLimitConfigFromEnv() ConcurrencyLimitConfig {
+	return ConcurrencyLimitConfig{
+		Max:          getenv("CONCURRENCY_LIMIT"),
+		Key:          getenv("CONCURRENCY_LIMIT_KEY"),
+		QueueSize:    getenv("CONCURRENCY_QUEUE_SIZE"),
+		QueueTimeout: getenv("CONCURRENCY_QUEUE_TIMEOUT"),
+		Priority: lo.Compact(lo.Map(strings.Split(getenv("CONCURRENCY_PRIORITY"), ";"), func(v string, _ int) string {
+			return strings.TrimSpace(v)
+		})),
+		Adaptive:      getenv("CONCURRENCY_ADAPTIVE"),
+		MinLimit:      getenv("CONCURRENCY_MIN_LIMIT"),
+		LatencyTarget: getenv("CONCURRENCY_LATENCY_TARGET"),
+	}
+}
+
+// merge fills the empty fields from defaults
+func (c ConcurrencyLimitConfig) merge(defaults ConcurrencyLimitConfig) ConcurrencyLimitConfig {
+	pick := func(v string, d string) string {
+		if len(v) > 0 {
+			return v
+		}
+		return d
+	}
+	merged := ConcurrencyLimitConfig{
+		Max:           pick(c.Max, defaults.Max),
+		Key:           pick(c.Key, defaults.Key),
+		QueueSize:     pick(c.QueueSize, defaults.QueueSize),
+		QueueTimeout:  pick(c.QueueTimeout, defaults.QueueTimeout),
+		Priority:      defaults.Priority,
+		Adaptive:      pick(c.Adaptive, defaults.Adaptive),
+		MinLimit:      pick(c.MinLimit, defaults.MinLimit),
+		LatencyTarget: pick(c.LatencyTarget, defaults.LatencyTarget),
+	}
+	if c.Priority != nil {
+		merged.Priority = c.Priority
+	}
+	return merged
+}
+
+// parse validates the config, nil settings when no limit is set
+func (c ConcurrencyLimitConfig) parse(scope string) (*concurrencySettings, error) {
+	limit, err := parseCountOr("max", c.Max, 0)
+	if err != nil || limit == 0 {
+		return nil, err
+	}
+	s := &concurrencySettings{scope: scope, max: limit, key: c.Key, adaptive: c.Adaptive == "true"}
+	if len(s.key) == 0 {
+		s.key = "route"
+	}
+	if !lo.Contains(concurrencyLimitKeys, s.key) && !strings.HasPrefix(s.key, "header:") {
+		return nil, fmt.Errorf("unknown concurrency limit key %q", s.key)
+	}
+	if s.queueSize, err = parseCountOr("queue_size", c.QueueSize, 0); err != nil {
+		return nil, err
+	}
+	if s.queueTimeout, err = parseDurationOr("queue_timeout", c.QueueTimeout, defaultConcurrencyQueueTimeout); err != nil {
+		return nil, err
+	}
+	if s.minLimit, err = parseCountOr("min_limit", c.MinLimit, 1); err != nil {
+		return nil, err
+	}
+	if s.minLimit == 0 || s.minLimit > s.max {
+		return nil, fmt.Errorf("min_limit %d must be between 1 and max %d", s.minLimit, s.max)
+	}
+	if s.latencyTarget, err = parseDurationOr("latency_target", c.LatencyTarget, 0); err != nil {
+		return nil, err
+	}
+	for _, rule := range c.Priority {
+		matcher, err := parseClaimMatcher(rule)
+		if err != nil {
+			return nil, err
+		}
+		s.priority = append(s.priority, matcher)
+	}
+	return s, nil
+}
+
+// priorityOf is the index of the first priority rule the identity matches, lower
+// goes first, requests matching no rule are the last
+func (s *concurrencySettings) priorityOf(r *http.Request) int {
+	if identity := identityFromContext(r.Context()); identity != nil {
+		for i, matcher := range s.priority {
+			if matcher.Match(identity.Claims) {
+				return i
+			}
+		}
+	}
+	return len(s.priority)
+}
+
+// queuedRequest is a request waiting for a slot, ready is closed when granted
+type queuedRequest struct {
+	priority int
+	ready    chan struct{}
+	granted  bool
+}
+
+// concurrencyLimiter holds the slots of a key, refs are the requests holding or
+// waiting for a slot, the limiter is dropped when it has none
+type concurrencyLimiter struct {
+	settings *concurrencySettings
+	refs     int
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	queue    []*queuedRequest
+}
+
+func newConcurrencyLimiter(settings *concurrencySettings) *concurrencyLimiter {
+	return &concurrencyLimiter{settings: settings, limit: float64(settings.max)}
+}
+
+// acquire takes a slot, waits in queue when all slots are in use
+func (l *concurrencyLimiter) acquire(ctx context.Context, priority int) error {
+	l.mu.Lock()
+	if l.inFlight < int(l.limit) && len(l.queue) == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return nil
+	}
+	if len(l.queue) >= l.settings.queueSize {
+		l.mu.Unlock()
+		return errConcurrencyQueueFull
+	}
+	q := &queuedRequest{priority: priority, ready: make(chan struct{})}
+	i := len(l.queue)
+	for i > 0 && l.queue[i-1].priority > priority {
+		i--
+	}
+	l.queue = append(l.queue[:i], append([]*queuedRequest{q}, l.queue[i:]...)...)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.settings.queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-q.ready:
+		return nil
+	case <-timer.C:
+		err = errConcurrencyQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if q.granted {
+		// granted while giving up, the slot is taken anyway
+		return nil
+	}
+	l.queue = lo.Without(l.queue, q)
+	return err
+}
+
+// release frees the slot, and adapts the limit by the latency and result of request
+func (l *concurrencyLimiter) release(latency time.Duration, overloaded bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	if s := l.settings; s.adaptive {
+		if overloaded || (s.latencyTarget > 0 && latency > s.latencyTarget) {
+			l.limit = max(l.limit*aimdBackoff, float64(s.minLimit))
+		} else {
+			l.limit = min(l.limit+1/l.limit, float64(s.max))
+		}
+	}
+	for l.inFlight < int(l.limit) && len(l.queue) > 0 {
+		q := l.queue[0]
+		l.queue = l.queue[1:]
+		q.granted = true
+		l.inFlight++
+		close(q.ready)
+	}
+}
+
+type ConcurrencyLimiterMiddleware struct {
+	settings *concurrencySettings
+	proxies  trustedProxies
+	enabled  bool
+
+	mu       sync.Mutex
+	limiters map[string]*concurrencyLimiter
+}
+
+// NewConcurrencyLimiterMiddleware limits by CONCURRENCY_LIMIT, and the routes having their
+// own concurrency limit
+func NewConcurrencyLimiterMiddleware(routes ...*Route) (*ConcurrencyLimiterMiddleware, error) {
+	settings, err := concurrencyLimitConfigFromEnv().parse("global")
+	if err != nil {
+		return nil, fmt.Errorf("concurrency limit is invalid: %w", err)
+	}
+	enabled := settings != nil || lo.ContainsBy(routes, func(route *Route) bool {
+		return route.concurrency != nil
+	})
+	if !enabled {
+		return &ConcurrencyLimiterMiddleware{}, nil
+	}
+	proxies, err := parseTrustedProxies(getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES is invalid: %w", err)
+	}
+	return &ConcurrencyLimiterMiddleware{
+		settings: settings,
+		proxies:  proxies,
+		enabled:  enabled,
+		limiters: map[string]*concurrencyLimiter{},
+	}, nil
+}
+
+func (m *ConcurrencyLimiterMiddleware) Name() string {
+	return "ConcurrencyLimiterMiddleware"
+}
+
+func (m *ConcurrencyLimiterMiddleware) Enabled() bool {
+	return m.enabled
+}
+
+func (m *ConcurrencyLimiterMiddleware) limiter(key string, settings *concurrencySettings) *concurrencyLimiter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.limiters[key]
+	if !ok {
+		l = newConcurrencyLimiter(settings)
+		m.limiters[key] = l
+	}
+	l.refs++
+	return l
+}
+
+// unref drops the limiter of identity keys no request uses, the limiters of routes
+// are kept for their adapted limit
+func (m *ConcurrencyLimiterMiddleware) unref(key string, l *concurrencyLimiter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l.refs--
+	if l.refs == 0 && l.settings.key != "route" {
+		delete(m.limiters, key)
+	}
+}
+
+func (m *ConcurrencyLimiterMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings := m.settings
+		if route := routeFromContext(r.Context()); route != nil {
+			settings = route.concurrency
+		}
+		if settings == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := settings.scope
+		if settings.key != "route" {
+			key += ":" + requestKey(r, settings.key, m.proxies)
+		}
+		l := m.limiter(key, settings)
+		defer m.unref(key, l)
+		if err := l.acquire(r.Context(), settings.priorityOf(r)); err != nil {
+			reason := "canceled"
+			switch err {
+			case errConcurrencyQueueFull:
+				reason = "queue_full"
+			case errConcurrencyQueueTimeout:
+				reason = "queue_timeout"
+			}
+			concurrencyLimitRejectionsTotal.WithLabelValues(settings.scope, reason).Inc()
+			w.Header().Set("Retry-After", "1")
+			flushJsonErrorResponse(w, err.Error(), "CONCURRENCY_LIMIT_EXCEEDED", http.StatusServiceUnavailable)
+			return
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			l.release(time.Since(start), recorder.status >= http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
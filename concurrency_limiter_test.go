@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingHandler holds the requests until released
+type blockingHandler struct {
+	entered chan string
+	release chan struct{}
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{entered: make(chan string, 10), release: make(chan struct{})}
+}
+
+func (h *blockingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.entered <- r.URL.Path
+	<-h.release
+}
+
+func serveAsync(handler http.Handler, req *http.Request) <-chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		done <- rr
+	}()
+	return done
+}
+
+func TestConcurrencyLimiterMiddleware_Queue(t *testing.T) {
+	t.Setenv("CONCURRENCY_LIMIT", "1")
+	t.Setenv("CONCURRENCY_QUEUE_SIZE", "1")
+	upstream := newBlockingHandler()
+	handler := must(NewConcurrencyLimiterMiddleware()).Handler(upstream)
+
+	first := serveAsync(handler, httptest.NewRequest(http.MethodGet, "/first", nil))
+	assert.Equal(t, "/first", <-upstream.entered)
+	queued := serveAsync(handler, httptest.NewRequest(http.MethodGet, "/queued", nil))
+	time.Sleep(20 * time.Millisecond)
+
+	// the queue is full
+	rr := <-serveAsync(handler, httptest.NewRequest(http.MethodGet, "/shed", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	body := ErrorMessage{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, "CONCURRENCY_LIMIT_EXCEEDED", body.Code)
+
+	upstream.release <- struct{}{}
+	assert.Equal(t, http.StatusOK, (<-first).Code)
+	assert.Equal(t, "/queued", <-upstream.entered)
+	upstream.release <- struct{}{}
+	assert.Equal(t, http.StatusOK, (<-queued).Code)
+}
+
+func TestConcurrencyLimiterMiddleware_QueueTimeout(t *testing.T) {
+	t.Setenv("CONCURRENCY_LIMIT", "1")
+	t.Setenv("CONCURRENCY_QUEUE_SIZE", "5")
+	t.Setenv("CONCURRENCY_QUEUE_TIMEOUT", "20ms")
+	upstream := newBlockingHandler()
+	handler := must(NewConcurrencyLimiterMiddleware()).Handler(upstream)
+
+	first := serveAsync(handler, httptest.NewRequest(http.MethodGet, "/first", nil))
+	<-upstream.entered
+	rr := <-serveAsync(handler, httptest.NewRequest(http.MethodGet, "/late", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), "request waited too long in queue")
+
+	close(upstream.release)
+	<-first
+}
+
+func TestConcurrencyLimiterMiddleware_IdentityKey(t *testing.T) {
+	t.Setenv("CONCURRENCY_LIMIT", "1")
+	t.Setenv("CONCURRENCY_LIMIT_KEY", "subject")
+	upstream := newBlockingHandler()
+	m := must(NewConcurrencyLimiterMiddleware())
+	handler := m.Handler(upstream)
+	request := func(subject string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/"+subject, nil)
+		return withIdentity(req, newIdentity("jwt", map[string]interface{}{"sub": subject}))
+	}
+
+	alice := serveAsync(handler, request("alice"))
+	<-upstream.entered
+	bob := serveAsync(handler, request("bob"))
+	<-upstream.entered
+	assert.Equal(t, http.StatusServiceUnavailable, (<-serveAsync(handler, request("alice"))).Code)
+
+	close(upstream.release)
+	<-alice
+	<-bob
+	// limiters of identities are dropped once idle
+	m.mu.Lock()
+	assert.Empty(t, m.limiters)
+	m.mu.Unlock()
+}
+
+func TestConcurrencyLimiter_Priority(t *testing.T) {
+	l := newConcurrencyLimiter(&concurrencySettings{max: 1, queueSize: 10, queueTimeout: time.Second, minLimit: 1})
+	assert.NoError(t, l.acquire(context.Background(), 0))
+
+	order := make(chan int, 3)
+	wg := sync.WaitGroup{}
+	for _, priority := range []int{2, 1, 0} {
+		wg.Add(1)
+		go func(priority int) {
+			defer wg.Done()
+			assert.NoError(t, l.acquire(context.Background(), priority))
+			order <- priority
+			l.release(0, false)
+		}(priority)
+		time.Sleep(10 * time.Millisecond)
+	}
+	l.release(0, false)
+	wg.Wait()
+	close(order)
+	result := []int{}
+	for priority := range order {
+		result = append(result, priority)
+	}
+	assert.Equal(t, []int{0, 1, 2}, result)
+}
+
+func TestConcurrencyLimiter_Adaptive(t *testing.T) {
+	l := newConcurrencyLimiter(&concurrencySettings{
+		max: 10, minLimit: 2, adaptive: true, latencyTarget: 100 * time.Millisecond,
+	})
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, l.acquire(context.Background(), 0))
+		l.release(time.Second, false)
+	}
+	assert.InDelta(t, 10*0.9*0.9*0.9*0.9*0.9, l.limit, 0.001)
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, l.acquire(context.Background(), 0))
+		l.release(time.Millisecond, true)
+	}
+	assert.Equal(t, float64(2), l.limit)
+
+	// healthy responses grow the limit back
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, l.acquire(context.Background(), 0))
+		l.release(time.Millisecond, false)
+	}
+	assert.Equal(t, float64(10), l.limit)
+}
+
+func TestConcurrencyLimitConfig_Parse(t *testing.T) {
+	for _, c := range []ConcurrencyLimitConfig{
+		{Max: "-1"},
+		{Max: "10", Key: "cookie:session"},
+		{Max: "10", QueueTimeout: "soon"},
+		{Max: "10", MinLimit: "20"},
+		{Max: "10", Priority: []string{"groups"}},
+	} {
+		_, err := c.parse("global")
+		assert.Error(t, err, c)
+	}
+	settings, err := ConcurrencyLimitConfig{Max: "0"}.parse("global")
+	assert.NoError(t, err)
+	assert.Nil(t, settings)
+}
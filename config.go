@@ -0,0 +1,568 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+// HeaderRules modifies headers, names of set are kept as they are
+type HeaderRules struct {
+	Set    map[string]string `yaml:"set" json:"set"`
+	Delete []string          `yaml:"delete" json:"delete"`
+}
+
+type JwtConfig struct {
+	Secret              string   `yaml:"secret" json:"secret"`
+	PublicKeyFile       []string `yaml:"public_key_file" json:"public_key_file"`
+	JwksURL             string   `yaml:"jwks_url" json:"jwks_url"`
+	JwksRefreshInterval string   `yaml:"jwks_refresh_interval" json:"jwks_refresh_interval"`
+	Algorithms          []string `yaml:"algorithms" json:"algorithms"`
+	Issuer              []string `yaml:"issuer" json:"issuer"`
+	Audience            []string `yaml:"audience" json:"audience"`
+	Leeway              string   `yaml:"leeway" json:"leeway"`
+	RequiredClaims      []string `yaml:"required_claims" json:"required_claims"`
+	ClaimRules          []string `yaml:"claim_rules" json:"claim_rules"`
+}
+
+type OidcConfig struct {
+	Issuer                string `yaml:"issuer" json:"issuer"`
+	ClientID              string `yaml:"client_id" json:"client_id"`
+	ClientSecret          string `yaml:"client_secret" json:"client_secret"`
+	CallbackURL           string `yaml:"callback_url" json:"callback_url"`
+	SessionSecret         string `yaml:"session_secret" json:"session_secret"`
+	PostLogoutRedirectURL string `yaml:"post_logout_redirect_url" json:"post_logout_redirect_url"`
+	RefreshLeeway         string `yaml:"refresh_leeway" json:"refresh_leeway"`
+	SessionStore          string `yaml:"session_store" json:"session_store"`
+	SessionStorePath      string `yaml:"session_store_path" json:"session_store_path"`
+	SessionStoreRedisURL  string `yaml:"session_store_redis_url" json:"session_store_redis_url"`
+}
+
+// FormLoginConfig serves the built-in login page, the session is shared with oidc
+type FormLoginConfig struct {
+	Enabled         *bool  `yaml:"enabled" json:"enabled"`
+	Storage         string `yaml:"storage" json:"storage"`
+	StoragePath     string `yaml:"storage_path" json:"storage_path"`
+	Template        string `yaml:"template" json:"template"`
+	MaxAttempts     string `yaml:"max_attempts" json:"max_attempts"`
+	LockoutDuration string `yaml:"lockout_duration" json:"lockout_duration"`
+}
+
+// BasicAuthConfig authenticates by HTTP Basic credentials of an htpasswd file
+type BasicAuthConfig struct {
+	File            string `yaml:"file" json:"file"`
+	Realm           string `yaml:"realm" json:"realm"`
+	MaxFailures     string `yaml:"max_failures" json:"max_failures"`
+	LockoutDuration string `yaml:"lockout_duration" json:"lockout_duration"`
+}
+
+// ApiKeyFileConfig authenticates by static API keys, File lists the hashed keys
+type ApiKeyFileConfig struct {
+	File       string `yaml:"file" json:"file"`
+	Header     string `yaml:"header" json:"header"`
+	QueryParam string `yaml:"query_param" json:"query_param"`
+}
+
+// AccessLogConfig writes a line for each request, Format enables it
+type AccessLogConfig struct {
+	Format        string   `yaml:"format" json:"format"`
+	Output        string   `yaml:"output" json:"output"`
+	Headers       []string `yaml:"headers" json:"headers"`
+	RedactHeaders []string `yaml:"redact_headers" json:"redact_headers"`
+	RedactQuery   []string `yaml:"redact_query" json:"redact_query"`
+	MaxSize       string   `yaml:"max_size" json:"max_size"`
+	MaxBackups    string   `yaml:"max_backups" json:"max_backups"`
+}
+
+// TracingConfig exports spans of requests, Exporter enables it
+type TracingConfig struct {
+	Exporter     string `yaml:"exporter" json:"exporter"`
+	OtlpEndpoint string `yaml:"otlp_endpoint" json:"otlp_endpoint"`
+	SampleRatio  string `yaml:"sample_ratio" json:"sample_ratio"`
+	ServiceName  string `yaml:"service_name" json:"service_name"`
+}
+
+type AuthzFileConfig struct {
+	RulesFile string       `yaml:"rules_file" json:"rules_file"`
+	Rules     []*AuthzRule `yaml:"rules" json:"rules"`
+}
+
+// TLSConfig terminates TLS on the listener, listener settings take effect on restart
+// except the certificates reloaded on change
+type TLSConfig struct {
+	CertFile       []string         `yaml:"cert_file" json:"cert_file"`
+	KeyFile        []string         `yaml:"key_file" json:"key_file"`
+	MinVersion     string           `yaml:"min_version" json:"min_version"`
+	ReloadInterval string           `yaml:"reload_interval" json:"reload_interval"`
+	RedirectAddr   string           `yaml:"redirect_addr" json:"redirect_addr"`
+	Hsts           HstsConfig       `yaml:"hsts" json:"hsts"`
+	ClientCert     ClientCertConfig `yaml:"client_cert" json:"client_cert"`
+}
+
+// ClientCertConfig authenticates clients by certificates, requires TLS termination
+type ClientCertConfig struct {
+	CAFile       string `yaml:"ca_file" json:"ca_file"`
+	Mode         string `yaml:"mode" json:"mode"`
+	Subject      string `yaml:"subject" json:"subject"`
+	Header       string `yaml:"header" json:"header"`
+	HeaderFormat string `yaml:"header_format" json:"header_format"`
+}
+
+type HstsConfig struct {
+	MaxAge            string `yaml:"max_age" json:"max_age"`
+	IncludeSubdomains *bool  `yaml:"include_subdomains" json:"include_subdomains"`
+	Preload           *bool  `yaml:"preload" json:"preload"`
+}
+
+// Config is the content of CONFIG_FILE, every field has an environment variable
+// counterpart which overrides it
+type Config struct {
+	ListenAddr           string                 `yaml:"listen_addr" json:"listen_addr"`
+	AdminListenAddr      string                 `yaml:"admin_listen_addr" json:"admin_listen_addr"`
+	Metrics              *bool                  `yaml:"metrics" json:"metrics"`
+	RequestIDHeader      string                 `yaml:"request_id_header" json:"request_id_header"`
+	RequestIDVersion     string                 `yaml:"request_id_version" json:"request_id_version"`
+	AccessLog            AccessLogConfig        `yaml:"access_log" json:"access_log"`
+	Tracing              TracingConfig          `yaml:"tracing" json:"tracing"`
+	TLS                  TLSConfig              `yaml:"tls" json:"tls"`
+	Upstream             string                 `yaml:"upstream" json:"upstream"`
+	LoadBalancer         LoadBalancerConfig     `yaml:"load_balancer" json:"load_balancer"`
+	Transport            TransportConfig        `yaml:"transport" json:"transport"`
+	AppendForwardHeaders *bool                  `yaml:"append_forward_headers" json:"append_forward_headers"`
+	RequestHeaders       HeaderRules            `yaml:"request_headers" json:"request_headers"`
+	ResponseHeaders      HeaderRules            `yaml:"response_headers" json:"response_headers"`
+	ForwardClaims        map[string]string      `yaml:"forward_claims" json:"forward_claims"`
+	IdentityGroupsClaim  string                 `yaml:"identity_groups_claim" json:"identity_groups_claim"`
+	RateLimit            string                 `yaml:"rate_limit" json:"rate_limit"`
+	RateLimitKey         string                 `yaml:"rate_limit_key" json:"rate_limit_key"`
+	RateLimitTiers       []string               `yaml:"rate_limit_tiers" json:"rate_limit_tiers"`
+	RateLimitStore       string                 `yaml:"rate_limit_store" json:"rate_limit_store"`
+	RateLimitRedisURL    string                 `yaml:"rate_limit_store_redis_url" json:"rate_limit_store_redis_url"`
+	TrustedProxies       []string               `yaml:"trusted_proxies" json:"trusted_proxies"`
+	ConcurrencyLimit     ConcurrencyLimitConfig `yaml:"concurrency_limit" json:"concurrency_limit"`
+	Jwt                  JwtConfig              `yaml:"jwt" json:"jwt"`
+	Oidc                 OidcConfig             `yaml:"oidc" json:"oidc"`
+	AuthMethods          []string               `yaml:"auth_methods" json:"auth_methods"`
+	FormLogin            FormLoginConfig        `yaml:"form_login" json:"form_login"`
+	BasicAuth            BasicAuthConfig        `yaml:"basic_auth" json:"basic_auth"`
+	ApiKey               ApiKeyFileConfig       `yaml:"api_key" json:"api_key"`
+	Authz                AuthzFileConfig        `yaml:"authz" json:"authz"`
+	RoutesFile           string                 `yaml:"routes_file" json:"routes_file"`
+	Routes               []*Route               `yaml:"routes" json:"routes"`
+}
+
+// currentConfig is the config file loaded, nil when CONFIG_FILE is not used
+var currentConfig atomic.Pointer[Config]
+
+// currentConfigEnv is the current config flattened into environment variables
+var currentConfigEnv atomic.Pointer[map[string]string]
+
+// stagedConfig is the config being validated and built by a reload, it is not
+// effective for requests until it is published with setConfig
+var stagedConfig atomic.Pointer[Config]
+
+// stagedConfigEnv is the staged config flattened into environment variables
+var stagedConfigEnv atomic.Pointer[map[string]string]
+
+// loadConfig reads config from YAML or JSON file
+func loadConfig(file string) (*Config, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	decoder := yaml.NewDecoder(strings.NewReader(string(content)))
+	decoder.KnownFields(true)
+	// empty file is a valid config
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return config, nil
+}
+
+// setConfig makes the config effective, nil removes it
+func setConfig(config *Config) {
+	if config == nil {
+		currentConfig.Store(nil)
+		currentConfigEnv.Store(nil)
+		return
+	}
+	env := config.env()
+	currentConfigEnv.Store(&env)
+	currentConfig.Store(config)
+}
+
+// stageConfig makes the config visible to getenv and loadedConfig only, so it can be
+// validated and built while requests are still served with the current one, nil
+// removes it
+func stageConfig(config *Config) {
+	if config == nil {
+		stagedConfigEnv.Store(nil)
+		stagedConfig.Store(nil)
+		return
+	}
+	env := config.env()
+	stagedConfig.Store(config)
+	stagedConfigEnv.Store(&env)
+}
+
+// loadedConfig is the staged config during a reload, otherwise the current config
+func loadedConfig() *Config {
+	if config := stagedConfig.Load(); config != nil {
+		return config
+	}
+	return currentConfig.Load()
+}
+
+// loadedConfigEnv is the staged config env during a reload, otherwise the current one
+func loadedConfigEnv() *map[string]string {
+	if env := stagedConfigEnv.Load(); env != nil {
+		return env
+	}
+	return currentConfigEnv.Load()
+}
+
+func setEnv(env map[string]string, key string, value string) {
+	if len(value) > 0 {
+		env[key] = value
+	}
+}
+
+// env flattens the config into environment variables
+func (c *Config) env() map[string]string {
+	env := map[string]string{}
+	setEnv(env, "LISTEN_ADDR", c.ListenAddr)
+	setEnv(env, "ADMIN_LISTEN_ADDR", c.AdminListenAddr)
+	setEnv(env, "REQUEST_ID_HEADER", c.RequestIDHeader)
+	setEnv(env, "REQUEST_ID_VERSION", c.RequestIDVersion)
+	setEnv(env, "ACCESS_LOG", c.AccessLog.Format)
+	setEnv(env, "ACCESS_LOG_OUTPUT", c.AccessLog.Output)
+	setEnv(env, "ACCESS_LOG_HEADERS", strings.Join(c.AccessLog.Headers, ","))
+	setEnv(env, "ACCESS_LOG_REDACT_HEADERS", strings.Join(c.AccessLog.RedactHeaders, ","))
+	setEnv(env, "ACCESS_LOG_REDACT_QUERY", strings.Join(c.AccessLog.RedactQuery, ","))
+	setEnv(env, "ACCESS_LOG_MAX_SIZE", c.AccessLog.MaxSize)
+	setEnv(env, "ACCESS_LOG_MAX_BACKUPS", c.AccessLog.MaxBackups)
+	setEnv(env, "TRACING_EXPORTER", c.Tracing.Exporter)
+	setEnv(env, "TRACING_OTLP_ENDPOINT", c.Tracing.OtlpEndpoint)
+	setEnv(env, "TRACING_SAMPLE_RATIO", c.Tracing.SampleRatio)
+	setEnv(env, "TRACING_SERVICE_NAME", c.Tracing.ServiceName)
+	if c.Metrics != nil {
+		env["METRICS"] = strconv.FormatBool(*c.Metrics)
+	}
+	setEnv(env, "TLS_CERT_FILE", strings.Join(c.TLS.CertFile, ","))
+	setEnv(env, "TLS_KEY_FILE", strings.Join(c.TLS.KeyFile, ","))
+	setEnv(env, "TLS_MIN_VERSION", c.TLS.MinVersion)
+	setEnv(env, "TLS_RELOAD_INTERVAL", c.TLS.ReloadInterval)
+	setEnv(env, "TLS_REDIRECT_ADDR", c.TLS.RedirectAddr)
+	setEnv(env, "HSTS_MAX_AGE", c.TLS.Hsts.MaxAge)
+	if c.TLS.Hsts.IncludeSubdomains != nil {
+		env["HSTS_INCLUDE_SUBDOMAINS"] = strconv.FormatBool(*c.TLS.Hsts.IncludeSubdomains)
+	}
+	if c.TLS.Hsts.Preload != nil {
+		env["HSTS_PRELOAD"] = strconv.FormatBool(*c.TLS.Hsts.Preload)
+	}
+	setEnv(env, "CLIENT_CA_FILE", c.TLS.ClientCert.CAFile)
+	setEnv(env, "CLIENT_CERT_MODE", c.TLS.ClientCert.Mode)
+	setEnv(env, "CLIENT_CERT_SUBJECT", c.TLS.ClientCert.Subject)
+	setEnv(env, "CLIENT_CERT_HEADER", c.TLS.ClientCert.Header)
+	setEnv(env, "CLIENT_CERT_HEADER_FORMAT", c.TLS.ClientCert.HeaderFormat)
+	setEnv(env, "UPSTREAM", c.Upstream)
+	setEnv(env, "UPSTREAM_LB_STRATEGY", c.LoadBalancer.Strategy)
+	setEnv(env, "UPSTREAM_HASH_KEY", c.LoadBalancer.HashKey)
+	setEnv(env, "UPSTREAM_HEALTH_CHECK_PATH", c.LoadBalancer.HealthCheckPath)
+	setEnv(env, "UPSTREAM_HEALTH_CHECK_INTERVAL", c.LoadBalancer.HealthCheckInterval)
+	setEnv(env, "UPSTREAM_HEALTH_CHECK_TIMEOUT", c.LoadBalancer.HealthCheckTimeout)
+	setEnv(env, "UPSTREAM_MAX_FAILS", c.LoadBalancer.MaxFails)
+	setEnv(env, "UPSTREAM_FAIL_TIMEOUT", c.LoadBalancer.FailTimeout)
+	setEnv(env, "UPSTREAM_RETRIES", c.LoadBalancer.Retries)
+	setEnv(env, "UPSTREAM_RETRY_BACKOFF", c.LoadBalancer.RetryBackoff)
+	setEnv(env, "UPSTREAM_RETRY_MAX_BODY", c.LoadBalancer.RetryMaxBody)
+	setEnv(env, "UPSTREAM_CIRCUIT_BREAKER_THRESHOLD", c.LoadBalancer.CircuitBreakerThreshold)
+	setEnv(env, "UPSTREAM_CIRCUIT_BREAKER_TIMEOUT", c.LoadBalancer.CircuitBreakerTimeout)
+	setEnv(env, "UPSTREAM_TLS_CA_FILE", c.Transport.CAFile)
+	setEnv(env, "UPSTREAM_TLS_CERT_FILE", c.Transport.CertFile)
+	setEnv(env, "UPSTREAM_TLS_KEY_FILE", c.Transport.KeyFile)
+	setEnv(env, "UPSTREAM_TLS_SERVER_NAME", c.Transport.ServerName)
+	setEnv(env, "UPSTREAM_TLS_MIN_VERSION", c.Transport.MinTLSVersion)
+	setEnv(env, "UPSTREAM_TLS_INSECURE_SKIP_VERIFY", c.Transport.InsecureSkipVerify)
+	setEnv(env, "UPSTREAM_HTTP2", c.Transport.HTTP2)
+	setEnv(env, "UPSTREAM_DIAL_TIMEOUT", c.Transport.DialTimeout)
+	setEnv(env, "UPSTREAM_TLS_HANDSHAKE_TIMEOUT", c.Transport.TLSHandshakeTimeout)
+	setEnv(env, "UPSTREAM_RESPONSE_HEADER_TIMEOUT", c.Transport.ResponseHeaderTimeout)
+	setEnv(env, "UPSTREAM_IDLE_CONN_TIMEOUT", c.Transport.IdleConnTimeout)
+	setEnv(env, "UPSTREAM_MAX_IDLE_CONNS", c.Transport.MaxIdleConns)
+	setEnv(env, "UPSTREAM_MAX_IDLE_CONNS_PER_HOST", c.Transport.MaxIdleConnsPerHost)
+	setEnv(env, "UPSTREAM_MAX_CONNS_PER_HOST", c.Transport.MaxConnsPerHost)
+	if c.AppendForwardHeaders != nil {
+		env["APPEND_FORWARD_HEADERS"] = strconv.FormatBool(*c.AppendForwardHeaders)
+	}
+	for header, value := range c.RequestHeaders.Set {
+		env["APPEND_REQ_HEADERS_"+header] = value
+	}
+	for _, header := range c.RequestHeaders.Delete {
+		env["DELETE_REQ_HEADERS_"+header] = "true"
+	}
+	for header, value := range c.ResponseHeaders.Set {
+		env["APPEND_RES_HEADERS_"+header] = value
+	}
+	for _, header := range c.ResponseHeaders.Delete {
+		env["DELETE_RES_HEADERS_"+header] = "true"
+	}
+	for claim, header := range c.ForwardClaims {
+		env["FORWARD_CLAIM_"+claim] = header
+	}
+	setEnv(env, "IDENTITY_GROUPS_CLAIM", c.IdentityGroupsClaim)
+	setEnv(env, "RATE_LIMIT", c.RateLimit)
+	setEnv(env, "RATE_LIMIT_KEY", c.RateLimitKey)
+	setEnv(env, "RATE_LIMIT_TIERS", strings.Join(c.RateLimitTiers, ";"))
+	setEnv(env, "RATE_LIMIT_STORE", c.RateLimitStore)
+	setEnv(env, "RATE_LIMIT_STORE_REDIS_URL", c.RateLimitRedisURL)
+	setEnv(env, "TRUSTED_PROXIES", strings.Join(c.TrustedProxies, ","))
+	setEnv(env, "CONCURRENCY_LIMIT", c.ConcurrencyLimit.Max)
+	setEnv(env, "CONCURRENCY_LIMIT_KEY", c.ConcurrencyLimit.Key)
+	setEnv(env, "CONCURRENCY_QUEUE_SIZE", c.ConcurrencyLimit.QueueSize)
+	setEnv(env, "CONCURRENCY_QUEUE_TIMEOUT", c.ConcurrencyLimit.QueueTimeout)
+	setEnv(env, "CONCURRENCY_PRIORITY", strings.Join(c.ConcurrencyLimit.Priority, ";"))
+	setEnv(env, "CONCURRENCY_ADAPTIVE", c.ConcurrencyLimit.Adaptive)
+	setEnv(env, "CONCURRENCY_MIN_LIMIT", c.ConcurrencyLimit.MinLimit)
+	setEnv(env, "CONCURRENCY_LATENCY_TARGET", c.ConcurrencyLimit.LatencyTarget)
+
+	setEnv(env, "JWT_SECRET", c.Jwt.Secret)
+	setEnv(env, "JWT_PUBLIC_KEY_FILE", strings.Join(c.Jwt.PublicKeyFile, ","))
+	setEnv(env, "JWT_JWKS_URL", c.Jwt.JwksURL)
+	setEnv(env, "JWT_JWKS_REFRESH_INTERVAL", c.Jwt.JwksRefreshInterval)
+	setEnv(env, "JWT_ALGORITHMS", strings.Join(c.Jwt.Algorithms, ","))
+	setEnv(env, "JWT_ISSUER", strings.Join(c.Jwt.Issuer, ","))
+	setEnv(env, "JWT_AUDIENCE", strings.Join(c.Jwt.Audience, ","))
+	setEnv(env, "JWT_LEEWAY", c.Jwt.Leeway)
+	setEnv(env, "JWT_REQUIRED_CLAIMS", strings.Join(c.Jwt.RequiredClaims, ","))
+	setEnv(env, "JWT_CLAIM_RULES", strings.Join(c.Jwt.ClaimRules, ";"))
+
+	setEnv(env, "ODIC_ISSUER", c.Oidc.Issuer)
+	setEnv(env, "ODIC_CLIENT_ID", c.Oidc.ClientID)
+	setEnv(env, "ODIC_CLIENT_SECRET", c.Oidc.ClientSecret)
+	setEnv(env, "ODIC_CALLBACK_URL", c.Oidc.CallbackURL)
+	setEnv(env, "ODIC_SESSION_SECRET", c.Oidc.SessionSecret)
+	setEnv(env, "ODIC_POST_LOGOUT_REDIRECT_URL", c.Oidc.PostLogoutRedirectURL)
+	setEnv(env, "ODIC_REFRESH_LEEWAY", c.Oidc.RefreshLeeway)
+	setEnv(env, "ODIC_SESSION_STORE", c.Oidc.SessionStore)
+	setEnv(env, "ODIC_SESSION_STORE_PATH", c.Oidc.SessionStorePath)
+	setEnv(env, "ODIC_SESSION_STORE_REDIS_URL", c.Oidc.SessionStoreRedisURL)
+
+	setEnv(env, "AUTH_METHODS", strings.Join(c.AuthMethods, ","))
+	if c.FormLogin.Enabled != nil {
+		env["FORM_LOGIN"] = strconv.FormatBool(*c.FormLogin.Enabled)
+	}
+	setEnv(env, "FORM_LOGIN_STORAGE", c.FormLogin.Storage)
+	setEnv(env, "FORM_LOGIN_STORAGE_PATH", c.FormLogin.StoragePath)
+	setEnv(env, "FORM_LOGIN_TEMPLATE", c.FormLogin.Template)
+	setEnv(env, "FORM_LOGIN_MAX_ATTEMPTS", c.FormLogin.MaxAttempts)
+	setEnv(env, "FORM_LOGIN_LOCKOUT_DURATION", c.FormLogin.LockoutDuration)
+
+	setEnv(env, "BASIC_AUTH_FILE", c.BasicAuth.File)
+	setEnv(env, "BASIC_AUTH_REALM", c.BasicAuth.Realm)
+	setEnv(env, "BASIC_AUTH_MAX_FAILURES", c.BasicAuth.MaxFailures)
+	setEnv(env, "BASIC_AUTH_LOCKOUT_DURATION", c.BasicAuth.LockoutDuration)
+	setEnv(env, "API_KEYS_FILE", c.ApiKey.File)
+	setEnv(env, "API_KEY_HEADER", c.ApiKey.Header)
+	setEnv(env, "API_KEY_QUERY_PARAM", c.ApiKey.QueryParam)
+
+	setEnv(env, "AUTHZ_RULES_FILE", c.Authz.RulesFile)
+	setEnv(env, "ROUTES_FILE", c.RoutesFile)
+	return env
+}
+
+// getenv reads setting from environment variable, then the config file, it is used to
+// build the handler chain so it sees the staged config of a reload
+func getenv(key string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	if env := loadedConfigEnv(); env != nil {
+		return (*env)[key]
+	}
+	return ""
+}
+
+// servingGetenv reads setting from environment variable, then the current config file,
+// it is used while serving requests so a staged config is never seen
+func servingGetenv(key string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	if env := currentConfigEnv.Load(); env != nil {
+		return (*env)[key]
+	}
+	return ""
+}
+
+// environ lists settings of the config file and environment variables as key=value
+func environ() []string {
+	result := os.Environ()
+	env := loadedConfigEnv()
+	if env == nil {
+		return result
+	}
+	for key, value := range *env {
+		if _, ok := os.LookupEnv(key); !ok {
+			result = append(result, key+"="+value)
+		}
+	}
+	return result
+}
+
+// validateSettings checks the merged settings, so a broken config is reported at
+// startup and never replaces a working one on reload
+func validateSettings() error {
+	errs := []error{}
+
+	if _, err := loadRouteSettings(); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, key := range []string{"JWT_JWKS_REFRESH_INTERVAL", "JWT_LEEWAY", "ODIC_REFRESH_LEEWAY", "FORM_LOGIN_LOCKOUT_DURATION", "BASIC_AUTH_LOCKOUT_DURATION"} {
+		if v := getenv(key); len(v) > 0 {
+			if _, err := time.ParseDuration(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s is not a valid duration: %w", key, err))
+			}
+		}
+	}
+
+	if len(getenv("TLS_CERT_FILE")) > 0 {
+		if _, err := newServerTLSConfig(); err != nil {
+			errs = append(errs, fmt.Errorf("TLS settings are invalid: %w", err))
+		}
+	}
+	if len(getenv("CLIENT_CA_FILE")) > 0 {
+		if len(getenv("TLS_CERT_FILE")) == 0 {
+			errs = append(errs, errors.New("CLIENT_CA_FILE requires TLS_CERT_FILE"))
+		}
+		if !lo.Contains([]string{"", "require", "optional"}, getenv("CLIENT_CERT_MODE")) {
+			errs = append(errs, fmt.Errorf("CLIENT_CERT_MODE %q is unknown", getenv("CLIENT_CERT_MODE")))
+		}
+		if v := getenv("CLIENT_CERT_SUBJECT"); len(v) > 0 && !lo.Contains(clientCertSubjects, v) {
+			errs = append(errs, fmt.Errorf("CLIENT_CERT_SUBJECT %q is unknown", v))
+		}
+	}
+	if !lo.Contains([]string{"", "pem", "sha256"}, getenv("CLIENT_CERT_HEADER_FORMAT")) {
+		errs = append(errs, fmt.Errorf("CLIENT_CERT_HEADER_FORMAT %q is unknown", getenv("CLIENT_CERT_HEADER_FORMAT")))
+	}
+	if v := getenv("HSTS_MAX_AGE"); len(v) > 0 {
+		if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+			errs = append(errs, fmt.Errorf("HSTS_MAX_AGE is invalid: %w", err))
+		}
+	}
+
+	if _, err := rateLimitConfigFromEnv().parse("global"); err != nil {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT is invalid: %w", err))
+	}
+	switch kind := getenv("RATE_LIMIT_STORE"); kind {
+	case "", "memory":
+	case "redis":
+		if _, err := newRedisClient(getenv("RATE_LIMIT_STORE_REDIS_URL")); err != nil {
+			errs = append(errs, fmt.Errorf("RATE_LIMIT_STORE_REDIS_URL is invalid: %w", err))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_STORE %q is unknown", kind))
+	}
+	if _, err := concurrencyLimitConfigFromEnv().parse("global"); err != nil {
+		errs = append(errs, fmt.Errorf("CONCURRENCY_LIMIT is invalid: %w", err))
+	}
+	if v := getenv("REQUEST_ID_VERSION"); !lo.Contains([]string{"", "v4", "v7"}, v) {
+		errs = append(errs, fmt.Errorf("REQUEST_ID_VERSION %q is unknown", v))
+	}
+	if v := getenv("ACCESS_LOG"); len(v) > 0 && !lo.Contains(accessLogFormats, v) {
+		errs = append(errs, fmt.Errorf("ACCESS_LOG %q is unknown", v))
+	}
+	for _, key := range []string{"ACCESS_LOG_MAX_SIZE", "ACCESS_LOG_MAX_BACKUPS"} {
+		if _, err := parseCountOr(key, getenv(key), 0); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if output := getenv("ACCESS_LOG_OUTPUT"); isSyslogURL(output) {
+		if u, _ := url.Parse(output); len(u.Host) == 0 {
+			errs = append(errs, fmt.Errorf("ACCESS_LOG_OUTPUT %q has no host", output))
+		}
+	}
+	if _, err := tracingSettingsFromEnv(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseTrustedProxies(getenv("TRUSTED_PROXIES")); err != nil {
+		errs = append(errs, fmt.Errorf("TRUSTED_PROXIES is invalid: %w", err))
+	}
+
+	if v := getenv("JWT_ALGORITHMS"); len(v) > 0 {
+		if _, err := parseJwtAlgorithms(v); err != nil {
+			errs = append(errs, fmt.Errorf("JWT_ALGORITHMS is invalid: %w", err))
+		}
+	}
+	if _, err := parseClaimMatchers(getenv("JWT_CLAIM_RULES")); err != nil {
+		errs = append(errs, fmt.Errorf("JWT_CLAIM_RULES is invalid: %w", err))
+	}
+	for _, file := range splitList(getenv("JWT_PUBLIC_KEY_FILE")) {
+		if _, err := loadPEMPublicKeys(file); err != nil {
+			errs = append(errs, fmt.Errorf("JWT_PUBLIC_KEY_FILE %s is invalid: %w", file, err))
+		}
+	}
+
+	switch kind := getenv("ODIC_SESSION_STORE"); kind {
+	case "", "cookie", "memory", "filesystem":
+	case "redis":
+		if _, err := newRedisClient(getenv("ODIC_SESSION_STORE_REDIS_URL")); err != nil {
+			errs = append(errs, fmt.Errorf("ODIC_SESSION_STORE_REDIS_URL is invalid: %w", err))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("ODIC_SESSION_STORE %q is unknown", kind))
+	}
+
+	if v := getenv("AUTH_METHODS"); len(v) > 0 {
+		for _, key := range splitList(v) {
+			if !lo.Contains(splitList(defaultAuthMethods), key) {
+				errs = append(errs, fmt.Errorf("AUTH_METHODS %q is unknown", key))
+			}
+		}
+	}
+	if getenv("FORM_LOGIN") == "true" {
+		if len(getenv("ODIC_SESSION_SECRET")) == 0 {
+			errs = append(errs, errors.New("FORM_LOGIN requires ODIC_SESSION_SECRET"))
+		}
+		if _, err := newUserStore(); err != nil {
+			errs = append(errs, fmt.Errorf("form login user store is invalid: %w", err))
+		}
+		if _, err := loadLoginTemplate(); err != nil {
+			errs = append(errs, fmt.Errorf("FORM_LOGIN_TEMPLATE is invalid: %w", err))
+		}
+		if _, err := parseCountOr("FORM_LOGIN_MAX_ATTEMPTS", getenv("FORM_LOGIN_MAX_ATTEMPTS"), 0); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if file := getenv("BASIC_AUTH_FILE"); len(file) > 0 {
+		if _, err := newFileUserStore(file, parseHtpasswd); err != nil {
+			errs = append(errs, fmt.Errorf("BASIC_AUTH_FILE is invalid: %w", err))
+		}
+		if _, err := parseCountOr("BASIC_AUTH_MAX_FAILURES", getenv("BASIC_AUTH_MAX_FAILURES"), 0); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if file := getenv("API_KEYS_FILE"); len(file) > 0 {
+		if _, err := loadApiKeys(file); err != nil {
+			errs = append(errs, fmt.Errorf("API_KEYS_FILE is invalid: %w", err))
+		}
+	}
+
+	if _, err := loadAuthzSettings(); err != nil {
+		errs = append(errs, fmt.Errorf("authorization rules are invalid: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
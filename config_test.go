@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfigYaml = `
+upstream: http://localhost:3000
+append_forward_headers: false
+request_headers:
+  set:
+    X-A: cccc
+  delete: [Authorization]
+response_headers:
+  set:
+    X-Frame-Options: DENY
+forward_claims:
+  email: X-User-Email
+rate_limit: 10-M
+jwt:
+  secret: secret
+  issuer: [https://a, https://b]
+  claim_rules: ["scope contains api:read", "role in [admin]"]
+authz:
+  rules:
+    - path: /healthz
+      access: public
+`
+
+func writeConfig(t *testing.T, name string, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return file
+}
+
+// must fails the test by panic when the constructor returns an error
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func useConfig(t *testing.T, config *Config) {
+	t.Helper()
+	setConfig(config)
+	t.Cleanup(func() { setConfig(nil) })
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, "config.yaml", testConfigYaml))
+	assert.NoError(t, err)
+
+	env := config.env()
+	assert.Equal(t, "http://localhost:3000", env["UPSTREAM"])
+	assert.Equal(t, "false", env["APPEND_FORWARD_HEADERS"])
+	assert.Equal(t, "cccc", env["APPEND_REQ_HEADERS_X-A"])
+	assert.Equal(t, "true", env["DELETE_REQ_HEADERS_Authorization"])
+	assert.Equal(t, "DENY", env["APPEND_RES_HEADERS_X-Frame-Options"])
+	assert.Equal(t, "X-User-Email", env["FORWARD_CLAIM_email"])
+	assert.Equal(t, "https://a,https://b", env["JWT_ISSUER"])
+	assert.Equal(t, "scope contains api:read;role in [admin]", env["JWT_CLAIM_RULES"])
+	assert.Len(t, config.Authz.Rules, 1)
+
+	// json is accepted as well
+	config, err = loadConfig(writeConfig(t, "config.json", `{"upstream": "http://localhost:3000", "jwt": {"secret": "s"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "s", config.env()["JWT_SECRET"])
+
+	// empty file is valid
+	_, err = loadConfig(writeConfig(t, "empty.yaml", ""))
+	assert.NoError(t, err)
+
+	// typo is reported
+	_, err = loadConfig(writeConfig(t, "typo.yaml", "upstreams: http://localhost"))
+	assert.Error(t, err)
+}
+
+func TestGetenv_EnvironmentOverridesConfig(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, "config.yaml", testConfigYaml))
+	assert.NoError(t, err)
+	useConfig(t, config)
+
+	assert.Equal(t, "10-M", getenv("RATE_LIMIT"))
+	t.Setenv("RATE_LIMIT", "5-S")
+	assert.Equal(t, "5-S", getenv("RATE_LIMIT"))
+
+	assert.Contains(t, environ(), "APPEND_REQ_HEADERS_X-A=cccc")
+	assert.Contains(t, environ(), "RATE_LIMIT=5-S")
+	assert.NotContains(t, environ(), "RATE_LIMIT=10-M")
+
+	// settings of config file are applied to the modules
+	rewriter := newTestRewriter(t)
+	assert.NotNil(t, rewriter)
+	assert.True(t, must(NewJwtMiddleware()).Enabled())
+	assert.True(t, must(NewAuthzMiddleware()).Enabled())
+}
+
+func TestValidateSettings(t *testing.T) {
+	t.Setenv("UPSTREAM", "http://localhost:3000")
+	assert.NoError(t, validateSettings())
+
+	t.Setenv("RATE_LIMIT", "ten per minute")
+	t.Setenv("JWT_LEEWAY", "soon")
+	t.Setenv("JWT_ALGORITHMS", "none")
+	t.Setenv("ODIC_SESSION_STORE", "database")
+	err := validateSettings()
+	assert.Error(t, err)
+	for _, key := range []string{"RATE_LIMIT", "JWT_LEEWAY", "JWT_ALGORITHMS", "ODIC_SESSION_STORE"} {
+		assert.Contains(t, err.Error(), key)
+	}
+
+	t.Setenv("FORM_LOGIN", "true")
+	assert.ErrorContains(t, validateSettings(), "FORM_LOGIN requires ODIC_SESSION_SECRET")
+
+	t.Setenv("UPSTREAM", "")
+	assert.ErrorContains(t, validateSettings(), "UPSTREAM is required")
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"container/list"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	defaultLoginMaxAttempts     = 5
+	defaultLoginLockoutDuration = 15 * time.Minute
+)
+
+const defaultLoginTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in</title>
+<style>
+body { font-family: sans-serif; background: #f4f4f5; }
+form { max-width: 320px; margin: 10vh auto; padding: 24px; background: #fff; border-radius: 8px; }
+label, input, button { display: block; width: 100%; box-sizing: border-box; }
+input { margin: 4px 0 16px; padding: 8px; }
+button { padding: 8px; }
+.error { color: #b91c1c; }
+</style>
+</head>
+<body>
+<form method="post" action="{{.Action}}">
+<h1>Sign in</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" name="rd" value="{{.Redirect}}">
+<label for="username">Username</label>
+<input id="username" name="username" value="{{.Username}}" autocomplete="username" required autofocus>
+<label for="password">Password</label>
+<input id="password" name="password" type="password" autocomplete="current-password" required>
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`
+
+// logoutTemplate asks to confirm the logout, so a link or image on another site
+// can not log the user out
+var logoutTemplate = template.Must(template.New("logout").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign out</title>
+<style>
+body { font-family: sans-serif; background: #f4f4f5; }
+form { max-width: 320px; margin: 10vh auto; padding: 24px; background: #fff; border-radius: 8px; }
+button { display: block; width: 100%; padding: 8px; }
+</style>
+</head>
+<body>
+<form method="post" action="/_/logout">
+<h1>Sign out</h1>
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<button type="submit">Sign out</button>
+</form>
+</body>
+</html>
+`))
+
+// loginPage is the data of login template
+type loginPage struct {
+	Action    string
+	CSRFToken string
+	Redirect  string
+	Username  string
+	Error     string
+}
+
+// loginFailure is the failed attempts of a username
+type loginFailure struct {
+	key         string
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// maxLoginFailures bounds the tracked usernames or client IPs, the least recently
+// failed one is dropped beyond it
+const maxLoginFailures = 10000
+
+// loginFailures counts the failed logins to lock out the username being guessed,
+// the entries are kept in the order of their last failure so the stale ones are
+// pruned from the back without a scan
+type loginFailures struct {
+	mu     sync.Mutex
+	byKey  map[string]*list.Element
+	recent *list.List
+	max    int
+}
+
+// sharedLoginFailures survives the rebuild of middlewares on config reload
+var sharedLoginFailures = newLoginFailures()
+
+func newLoginFailures() *loginFailures {
+	return &loginFailures{byKey: map[string]*list.Element{}, recent: list.New(), max: maxLoginFailures}
+}
+
+// lockedUntil returns when the lockout of username ends, zero if not locked
+func (f *loginFailures) lockedUntil(username string, now time.Time) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if e, ok := f.byKey[username]; ok {
+		if failure := e.Value.(*loginFailure); now.Before(failure.lockedUntil) {
+			return failure.lockedUntil
+		}
+	}
+	return time.Time{}
+}
+
+// fail records a failed attempt, the username is locked after maxAttempts failures
+// within the lockout duration
+func (f *loginFailures) fail(username string, now time.Time, maxAttempts int, lockout time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// the lockout ends at most lockout after the last failure
+	for e := f.recent.Back(); e != nil && now.Sub(e.Value.(*loginFailure).last) > lockout; e = f.recent.Back() {
+		f.remove(e)
+	}
+	e, ok := f.byKey[username]
+	if ok {
+		f.recent.MoveToFront(e)
+	} else {
+		e = f.recent.PushFront(&loginFailure{key: username})
+		f.byKey[username] = e
+		if f.recent.Len() > f.max {
+			f.remove(f.recent.Back())
+		}
+	}
+	failure := e.Value.(*loginFailure)
+	failure.count++
+	failure.last = now
+	if failure.count >= maxAttempts {
+		failure.count = 0
+		failure.lockedUntil = now.Add(lockout)
+	}
+}
+
+func (f *loginFailures) reset(username string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if e, ok := f.byKey[username]; ok {
+		f.remove(e)
+	}
+}
+
+func (f *loginFailures) remove(e *list.Element) {
+	f.recent.Remove(e)
+	delete(f.byKey, e.Value.(*loginFailure).key)
+}
+
+// loadLoginTemplate parses FORM_LOGIN_TEMPLATE, the built-in page when not set
+func loadLoginTemplate() (*template.Template, error) {
+	if file := getenv("FORM_LOGIN_TEMPLATE"); len(file) > 0 {
+		return template.ParseFiles(file)
+	}
+	return template.New("login").Parse(defaultLoginTemplate)
+}
+
+// safeRedirect accepts only local paths as the target after login, so the login
+// page can not be used as an open redirect
+func safeRedirect(rd string) string {
+	if !strings.HasPrefix(rd, "/") || strings.HasPrefix(rd, "//") || strings.HasPrefix(rd, "/\\") {
+		return "/"
+	}
+	return rd
+}
+
+// FormLoginMiddleware authenticates users with the login page at /_/login against
+// the user store, and keeps them logged in with the session of oidc
+type FormLoginMiddleware struct {
+	enabled     bool
+	users       userStore
+	template    *template.Template
+	maxAttempts int
+	lockout     time.Duration
+	failures    *loginFailures
+	// oidc handles the users not logged in by form when it is enabled too
+	oidc  bool
+	store sessions.Store
+}
+
+func NewFormLoginMiddleware() (*FormLoginMiddleware, error) {
+	if getenv("FORM_LOGIN") != "true" {
+		return &FormLoginMiddleware{}, nil
+	}
+	users, err := newUserStore()
+	if err != nil {
+		return nil, fmt.Errorf("load form login users failed: %w", err)
+	}
+	tmpl, err := loadLoginTemplate()
+	if err != nil {
+		return nil, fmt.Errorf("load form login template failed: %w", err)
+	}
+	maxAttempts, err := parseCountOr("FORM_LOGIN_MAX_ATTEMPTS", getenv("FORM_LOGIN_MAX_ATTEMPTS"), defaultLoginMaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	lockout, err := parseDurationOr("FORM_LOGIN_LOCKOUT_DURATION", getenv("FORM_LOGIN_LOCKOUT_DURATION"), defaultLoginLockoutDuration)
+	if err != nil {
+		return nil, err
+	}
+	return &FormLoginMiddleware{
+		enabled:     true,
+		users:       users,
+		template:    tmpl,
+		maxAttempts: maxAttempts,
+		lockout:     lockout,
+		failures:    sharedLoginFailures,
+		oidc:        len(getenv("ODIC_CLIENT_ID")) > 0,
+	}, nil
+}
+
+func (m *FormLoginMiddleware) Name() string {
+	return "FormLoginMiddleware"
+}
+
+func (m *FormLoginMiddleware) Enabled() bool {
+	return m.enabled
+}
+
+func (m *FormLoginMiddleware) prepare() error {
+	store, err := newSessionStore([]byte(getenv("ODIC_SESSION_SECRET")))
+	if err != nil {
+		return fmt.Errorf("create form login session store failed: %w", err)
+	}
+	m.store = store
+	return nil
+}
+
+// serveEndpoint serves the login and logout pages, false for other paths
+func (m *FormLoginMiddleware) serveEndpoint(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Path != "/_/login" && r.URL.Path != "/_/logout" {
+		return false
+	}
+	s, err := m.store.Get(r, "user")
+	if err != nil {
+		flushJsonErrorResponse(w, "session handling failed", "ERR_SESSION", http.StatusBadRequest)
+		return true
+	}
+	switch {
+	case r.URL.Path == "/_/logout":
+		m.handleLogout(s, r, w)
+	case r.Method == http.MethodPost:
+		m.handleLogin(s, r, w)
+	default:
+		m.renderLogin(s, r, w, loginPage{Redirect: safeRedirect(r.URL.Query().Get("rd"))}, http.StatusOK)
+	}
+	return true
+}
+
+// authenticate restores the identity of session logged in by form
+func (m *FormLoginMiddleware) authenticate(w http.ResponseWriter, r *http.Request) (*Identity, *authError) {
+	s, err := m.store.Get(r, "user")
+	if err != nil {
+		return nil, &authError{"ERR_SESSION", "session handling failed", http.StatusBadRequest}
+	}
+	if s.Values["auth_method"] != "form" {
+		return nil, nil
+	}
+	return sessionIdentity(s), nil
+}
+
+// redirectToLogin sends the browser to login page, back to the current page after login
+func (m *FormLoginMiddleware) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/_/login?rd="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+}
+
+func (m *FormLoginMiddleware) Handler(next http.Handler) http.Handler {
+	if err := m.prepare(); err != nil {
+		return unavailableHandler(m, err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.serveEndpoint(w, r) {
+			return
+		}
+		identity, err := m.authenticate(w, r)
+		if err != nil {
+			flushJsonErrorResponse(w, err.message, err.code, err.status)
+			return
+		}
+		if identity != nil {
+			next.ServeHTTP(w, withIdentity(r, identity))
+			return
+		}
+		if isPublicRequest(r) || identityFromContext(r.Context()) != nil || m.oidc {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.redirectToLogin(w, r)
+	})
+}
+
+// issueCSRFToken binds a fresh CSRF token to the session for the next form post
+func issueCSRFToken(s *sessions.Session, r *http.Request, w http.ResponseWriter) (string, error) {
+	token := base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	s.Values["csrf_token"] = token
+	return token, s.Save(r, w)
+}
+
+// validCSRFToken checks the posted token is the one bound to the session
+func validCSRFToken(s *sessions.Session, r *http.Request) bool {
+	expected, _ := s.Values["csrf_token"].(string)
+	actual := r.PostFormValue("csrf_token")
+	return len(expected) > 0 && subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
+
+// renderPage writes the html page, it must not be cached or framed
+func renderPage(w http.ResponseWriter, tmpl *template.Template, data any, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("render %s page failed %s", tmpl.Name(), err)
+	}
+}
+
+// renderLogin shows the login page with a fresh CSRF token bound to the session
+func (m *FormLoginMiddleware) renderLogin(s *sessions.Session, r *http.Request, w http.ResponseWriter, page loginPage, status int) {
+	token, err := issueCSRFToken(s, r, w)
+	if err != nil {
+		flushHttpResponseError(w, err.Error(), "ERR_SAVE_SESSION_FAILED")
+		return
+	}
+	page.Action = "/_/login"
+	page.CSRFToken = token
+	renderPage(w, m.template, page, status)
+}
+
+func (m *FormLoginMiddleware) handleLogin(s *sessions.Session, r *http.Request, w http.ResponseWriter) {
+	if !validCSRFToken(s, r) {
+		flushJsonErrorResponse(w, "login form is expired or forged, please reload the page", "ERR_CSRF_TOKEN_INVALID", http.StatusForbidden)
+		return
+	}
+
+	username := r.PostFormValue("username")
+	page := loginPage{Redirect: safeRedirect(r.PostFormValue("rd")), Username: username}
+	now := time.Now()
+	if !m.failures.lockedUntil(username, now).IsZero() {
+		recordAuthFailure("ERR_FORM_LOGIN_LOCKED")
+		page.Error = "Too many failed attempts, please try again later."
+		m.renderLogin(s, r, w, page, http.StatusTooManyRequests)
+		return
+	}
+
+	user, err := authenticateUser(m.users, username, r.PostFormValue("password"))
+	if err != nil {
+		log.Printf("lookup form login user failed %s", err)
+		flushJsonErrorResponse(w, "user store is unavailable", "ERR_FORM_LOGIN_FAILED", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		recordAuthFailure("ERR_FORM_LOGIN_INVALID_CREDENTIALS")
+		if m.maxAttempts > 0 {
+			m.failures.fail(username, now, m.maxAttempts, m.lockout)
+		}
+		page.Error = "Invalid username or password."
+		m.renderLogin(s, r, w, page, http.StatusUnauthorized)
+		return
+	}
+	m.failures.reset(username)
+
+	claims, err := json.Marshal(user.claims())
+	if err != nil {
+		flushHttpResponseError(w, err.Error(), "ERR_FORM_LOGIN_FAILED")
+		return
+	}
+	renewSessionID(m.store, r, s)
+	clearSession(s)
+	s.Values["auth_method"] = "form"
+	s.Values["claims"] = string(claims)
+	s.Values["sub"] = user.Username
+	s.Values["profile_name"] = user.Name
+	s.Values["profile_email"] = user.Email
+	s.Values["login_at"] = now.UnixNano()
+	if err := s.Save(r, w); err != nil {
+		flushHttpResponseError(w, err.Error(), "ERR_SAVE_SESSION_FAILED")
+		return
+	}
+	http.Redirect(w, r, page.Redirect, http.StatusSeeOther)
+}
+
+// handleLogout asks to confirm on GET, the session is only cleared by the POST of
+// the confirmation form
+func (m *FormLoginMiddleware) handleLogout(s *sessions.Session, r *http.Request, w http.ResponseWriter) {
+	switch r.Method {
+	case http.MethodGet:
+		token, err := issueCSRFToken(s, r, w)
+		if err != nil {
+			flushHttpResponseError(w, err.Error(), "ERR_SAVE_SESSION_FAILED")
+			return
+		}
+		renderPage(w, logoutTemplate, loginPage{CSRFToken: token}, http.StatusOK)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		flushJsonErrorResponse(w, "logout only accepts the POST of confirmation page", "ERR_FORM_LOGOUT_METHOD", http.StatusMethodNotAllowed)
+		return
+	}
+	if !validCSRFToken(s, r) {
+		flushJsonErrorResponse(w, "logout form is expired or forged, please reload the page", "ERR_CSRF_TOKEN_INVALID", http.StatusForbidden)
+		return
+	}
+	clearSession(s)
+	if s.Options != nil {
+		// expire the cookie
+		s.Options.MaxAge = -1
+	}
+	if err := s.Save(r, w); err != nil {
+		flushHttpResponseError(w, err.Error(), "ERR_SAVE_SESSION_FAILED")
+		return
+	}
+	http.Redirect(w, r, "/_/login", http.StatusSeeOther)
+}
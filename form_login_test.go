@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var csrfTokenPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// formLoginClient keeps the session cookie between requests like a browser
+type formLoginClient struct {
+	handler http.Handler
+	cookies map[string]*http.Cookie
+}
+
+func (c *formLoginClient) do(req *http.Request) *httptest.ResponseRecorder {
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	c.handler.ServeHTTP(w, req)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(c.cookies, cookie.Name)
+			continue
+		}
+		c.cookies[cookie.Name] = cookie
+	}
+	return w
+}
+
+// csrfToken loads the login page and returns the token in the form
+func (c *formLoginClient) csrfToken(t *testing.T) string {
+	return c.pageToken(t, "/_/login")
+}
+
+func (c *formLoginClient) pageToken(t *testing.T, page string) string {
+	w := c.do(httptest.NewRequest(http.MethodGet, page, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	match := csrfTokenPattern.FindStringSubmatch(w.Body.String())
+	if !assert.Len(t, match, 2) {
+		t.FailNow()
+	}
+	return match[1]
+}
+
+func (c *formLoginClient) login(token string, username string, password string, rd string) *httptest.ResponseRecorder {
+	form := url.Values{"csrf_token": {token}, "username": {username}, "password": {password}, "rd": {rd}}
+	req := httptest.NewRequest(http.MethodPost, "/_/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req)
+}
+
+func (c *formLoginClient) logout(token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/_/logout", strings.NewReader(url.Values{"csrf_token": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req)
+}
+
+func newFormLoginClient(t *testing.T, store string) *formLoginClient {
+	file := writeConfig(t, "htpasswd", "alice:"+testPasswordHash(t, "secret")+"\n")
+	t.Setenv("FORM_LOGIN", "true")
+	t.Setenv("FORM_LOGIN_STORAGE_PATH", file)
+	t.Setenv("FORM_LOGIN_MAX_ATTEMPTS", "3")
+	t.Setenv("ODIC_SESSION_SECRET", "0123456789abcdef0123456789abcdef")
+	t.Setenv("ODIC_SESSION_STORE", store)
+	m := must(NewFormLoginMiddleware())
+	m.failures = newLoginFailures()
+	assert.True(t, m.Enabled())
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity := identityFromContext(r.Context()); identity != nil {
+			w.Header().Set("X-Subject", identity.Subject)
+			w.Header().Set("X-Method", identity.AuthMethod)
+		}
+	}))
+	return &formLoginClient{handler: handler, cookies: map[string]*http.Cookie{}}
+}
+
+func TestFormLoginMiddleware(t *testing.T) {
+	for _, store := range []string{"cookie", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			client := newFormLoginClient(t, store)
+
+			w := client.do(httptest.NewRequest(http.MethodGet, "/app?x=1", nil))
+			assert.Equal(t, http.StatusFound, w.Code)
+			assert.Equal(t, "/_/login?rd="+url.QueryEscape("/app?x=1"), w.Header().Get("Location"))
+
+			token := client.csrfToken(t)
+			w = client.login(token, "alice", "secret", "/app?x=1")
+			assert.Equal(t, http.StatusSeeOther, w.Code)
+			assert.Equal(t, "/app?x=1", w.Header().Get("Location"))
+
+			w = client.do(httptest.NewRequest(http.MethodGet, "/app", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "alice", w.Header().Get("X-Subject"))
+			assert.Equal(t, "form", w.Header().Get("X-Method"))
+
+			// logout needs the token of confirmation page
+			w = client.logout("forged")
+			assert.Equal(t, http.StatusForbidden, w.Code)
+			w = client.do(httptest.NewRequest(http.MethodDelete, "/_/logout", nil))
+			assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+			token = client.pageToken(t, "/_/logout")
+			w = client.do(httptest.NewRequest(http.MethodGet, "/app", nil))
+			assert.Equal(t, "alice", w.Header().Get("X-Subject"))
+
+			w = client.logout(token)
+			assert.Equal(t, http.StatusSeeOther, w.Code)
+			w = client.do(httptest.NewRequest(http.MethodGet, "/app", nil))
+			assert.Equal(t, http.StatusFound, w.Code)
+		})
+	}
+}
+
+func TestFormLoginMiddleware_CSRF(t *testing.T) {
+	client := newFormLoginClient(t, "cookie")
+
+	// without the page loaded
+	w := client.login("forged", "alice", "secret", "/")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	client.csrfToken(t)
+	w = client.login("forged", "alice", "secret", "/")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestFormLoginMiddleware_Lockout(t *testing.T) {
+	client := newFormLoginClient(t, "cookie")
+
+	for i := 0; i < 3; i++ {
+		w := client.login(client.csrfToken(t), "alice", "wrong", "/")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "Invalid username or password")
+	}
+
+	// locked even with the right password
+	w := client.login(client.csrfToken(t), "alice", "secret", "/")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestLoginFailures(t *testing.T) {
+	f := newLoginFailures()
+	f.max = 2
+	now := time.Now()
+	f.fail("alice", now, 2, time.Minute)
+	f.fail("alice", now, 2, time.Minute)
+	assert.Equal(t, now.Add(time.Minute), f.lockedUntil("alice", now))
+
+	// the least recently failed is dropped beyond the bound
+	f.fail("bob", now.Add(time.Second), 2, time.Minute)
+	f.fail("carol", now.Add(2*time.Second), 2, time.Minute)
+	assert.True(t, f.lockedUntil("alice", now).IsZero())
+	assert.Equal(t, 2, f.recent.Len())
+
+	// failures older than the lockout are pruned
+	f.fail("dave", now.Add(2*time.Minute), 2, time.Minute)
+	assert.Equal(t, 1, f.recent.Len())
+	assert.Len(t, f.byKey, 1)
+}
+
+func TestSafeRedirect(t *testing.T) {
+	assert.Equal(t, "/app?x=1", safeRedirect("/app?x=1"))
+	assert.Equal(t, "/", safeRedirect("https://evil.example.com"))
+	assert.Equal(t, "/", safeRedirect("//evil.example.com"))
+	assert.Equal(t, "/", safeRedirect("/\\evil.example.com"))
+	assert.Equal(t, "/", safeRedirect(""))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// HstsMiddleware sets Strict-Transport-Security on responses served over TLS
+type HstsMiddleware struct {
+	value string
+}
+
+func NewHstsMiddleware() (*HstsMiddleware, error) {
+	maxAge := getenv("HSTS_MAX_AGE")
+	if len(maxAge) == 0 {
+		return &HstsMiddleware{}, nil
+	}
+	if _, err := strconv.ParseUint(maxAge, 10, 64); err != nil {
+		return nil, fmt.Errorf("%s is not a valid number of seconds for HSTS_MAX_AGE", maxAge)
+	}
+	value := fmt.Sprintf("max-age=%s", maxAge)
+	if getenv("HSTS_INCLUDE_SUBDOMAINS") == "true" {
+		value += "; includeSubDomains"
+	}
+	if getenv("HSTS_PRELOAD") == "true" {
+		value += "; preload"
+	}
+	return &HstsMiddleware{value: value}, nil
+}
+
+func (m *HstsMiddleware) Name() string {
+	return "HstsMiddleware"
+}
+
+func (m *HstsMiddleware) Enabled() bool {
+	return len(m.value) > 0
+}
+
+func (m *HstsMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// browsers ignore the header over plain HTTP
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", m.value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
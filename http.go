@@ -6,14 +6,59 @@ import (
 )
 
 func flushJsonErrorResponse(w http.ResponseWriter, errMessage string, code string, status int) {
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		recordAuthFailure(code)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(&ErrorMessage{
+	body := newErrorMessage(w, errMessage, code)
+	json.NewEncoder(w).Encode(&body)
+}
+
+// newErrorMessage is the body of error responses, extended by the responses with
+// more details like RateLimitErrorMessage
+func newErrorMessage(w http.ResponseWriter, errMessage string, code string) ErrorMessage {
+	return ErrorMessage{
 		ErrorMessage: errMessage,
 		Code:         code,
-	})
+		// echoed by RequestIDMiddleware before any error is written
+		RequestID: w.Header().Get(servingRequestIDHeader()),
+	}
 }
 
 func flushHttpResponseError(w http.ResponseWriter, errMessage string, code string) {
 	flushJsonErrorResponse(w, errMessage, code, http.StatusUnauthorized)
 }
+
+// statusRecorder captures the status code and size of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// Flush keeps streamed responses flowing
+func (r *statusRecorder) Flush() {
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the hijacker of connection upgrades to http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
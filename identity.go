@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Identity is the authenticated user of request, populated by the auth middlewares
+type Identity struct {
+	Subject string
+	Name    string
+	Email   string
+	Groups  []string
+	// AuthMethod is the method authenticated the user, e.g. jwt, oidc
+	AuthMethod string
+	// Claims are all claims of the token or profile
+	Claims map[string]interface{}
+}
+
+type identityContextKey struct{}
+
+// newIdentity creates identity from token claims
+func newIdentity(authMethod string, claims map[string]interface{}) *Identity {
+	if claims == nil {
+		claims = map[string]interface{}{}
+	}
+	identity := &Identity{AuthMethod: authMethod, Claims: claims}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Name, _ = claims["name"].(string)
+	identity.Email, _ = claims["email"].(string)
+	groupsClaim := servingGetenv("IDENTITY_GROUPS_CLAIM")
+	if len(groupsClaim) == 0 {
+		groupsClaim = "groups"
+	}
+	switch groups := lookupClaim(claims, groupsClaim).(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, s)
+			}
+		}
+	case []string:
+		identity.Groups = groups
+	case string:
+		identity.Groups = strings.Fields(strings.ReplaceAll(groups, ",", " "))
+	}
+	return identity
+}
+
+// withIdentity stores the identity in request context, and reports it to access log
+func withIdentity(r *http.Request, identity *Identity) *http.Request {
+	if record := accessLogFromContext(r.Context()); record != nil {
+		record.identity = identity
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey{}, identity))
+}
+
+// identityFromContext returns the authenticated identity, nil for anonymous request
+func identityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityContextKey{}).(*Identity)
+	return identity
+}
+
+// lookupClaim finds claim by name, dots in name walk into nested objects
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+	if v, ok := claims[name]; ok {
+		return v
+	}
+	var current interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if current, ok = m[part]; !ok {
+			return nil
+		}
+	}
+	return current
+}
+
+// formatClaim renders claim value as header value, lists are joined with comma
+func formatClaim(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case []string:
+		return strings.Join(value, ",")
+	case []interface{}:
+		parts := make([]string, 0, len(value))
+		for _, item := range value {
+			parts = append(parts, formatClaim(item))
+		}
+		return strings.Join(parts, ",")
+	case map[string]interface{}:
+		b, _ := json.Marshal(value)
+		return string(b)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
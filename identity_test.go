@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewIdentity(t *testing.T) {
+	identity := newIdentity("jwt", map[string]interface{}{
+		"sub":    "user-1",
+		"name":   "Test User",
+		"email":  "user@example.com",
+		"groups": []interface{}{"dev", "ops"},
+	})
+	assert.Equal(t, "user-1", identity.Subject)
+	assert.Equal(t, "Test User", identity.Name)
+	assert.Equal(t, "user@example.com", identity.Email)
+	assert.Equal(t, []string{"dev", "ops"}, identity.Groups)
+	assert.Equal(t, "jwt", identity.AuthMethod)
+
+	t.Setenv("IDENTITY_GROUPS_CLAIM", "realm_access.roles")
+	identity = newIdentity("oidc", map[string]interface{}{
+		"realm_access": map[string]interface{}{"roles": []interface{}{"admin"}},
+	})
+	assert.Equal(t, []string{"admin"}, identity.Groups)
+}
+
+func TestIdentityFromContext(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.Nil(t, identityFromContext(req.Context()))
+	req = withIdentity(req, &Identity{Subject: "user-1"})
+	assert.Equal(t, "user-1", identityFromContext(req.Context()).Subject)
+}
+
+func TestFormatClaim(t *testing.T) {
+	assert.Equal(t, "", formatClaim(nil))
+	assert.Equal(t, "a", formatClaim("a"))
+	assert.Equal(t, "a,b", formatClaim([]interface{}{"a", "b"}))
+	assert.Equal(t, "1700000000", formatClaim(float64(1700000000)))
+	assert.Equal(t, "true", formatClaim(true))
+	assert.Equal(t, `{"id":"t1"}`, formatClaim(map[string]interface{}{"id": "t1"}))
+}
@@ -2,25 +2,83 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/samber/lo"
+	"go.opentelemetry.io/otel/codes"
 )
 
 type JwtMiddleware struct {
-	secret  string
-	enabled bool
+	secret string
+	// keys verify the asymmetric signed tokens, optional
+	keys            *jwtKeySet
+	refreshInterval time.Duration
+	// algorithms are the allowed signing algorithms
+	algorithms []string
+	policy     *jwtPolicy
+	enabled    bool
 }
 
-func NewJwtMiddleware() *JwtMiddleware {
-	jwtSecret := os.Getenv("JWT_SECRET")
-	return &JwtMiddleware{
-		secret:  jwtSecret,
-		enabled: len(jwtSecret) > 0,
+var (
+	hmacAlgorithms       = []string{"HS256", "HS384", "HS512"}
+	asymmetricAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+)
+
+func NewJwtMiddleware() (*JwtMiddleware, error) {
+	jwtSecret := getenv("JWT_SECRET")
+	jwksURL := getenv("JWT_JWKS_URL")
+	pemFiles := lo.Compact(strings.Split(getenv("JWT_PUBLIC_KEY_FILE"), ","))
+	m := &JwtMiddleware{
+		secret:          jwtSecret,
+		refreshInterval: defaultJwksRefreshInterval,
+		enabled:         len(jwtSecret) > 0 || len(jwksURL) > 0 || len(pemFiles) > 0,
 	}
+
+	if len(jwksURL) > 0 || len(pemFiles) > 0 {
+		keys, err := newJwtKeySet(pemFiles, jwksURL)
+		if err != nil {
+			return nil, err
+		}
+		m.keys = keys
+	}
+
+	if v := getenv("JWT_JWKS_REFRESH_INTERVAL"); len(v) > 0 {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration for JWT_JWKS_REFRESH_INTERVAL", v)
+		}
+		m.refreshInterval = d
+	}
+
+	if v := getenv("JWT_ALGORITHMS"); len(v) > 0 {
+		algorithms, err := parseJwtAlgorithms(v)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_ALGORITHMS is invalid: %w", err)
+		}
+		m.algorithms = algorithms
+	} else {
+		if len(jwtSecret) > 0 {
+			m.algorithms = append(m.algorithms, hmacAlgorithms...)
+		}
+		if m.keys != nil {
+			m.algorithms = append(m.algorithms, asymmetricAlgorithms...)
+		}
+	}
+
+	policy, err := newJwtPolicy()
+	if err != nil {
+		return nil, fmt.Errorf("jwt claim policy is invalid: %w", err)
+	}
+	m.policy = policy
+
+	return m, nil
 }
+
 func (m *JwtMiddleware) Name() string {
 	return "JwtMiddleware"
 }
@@ -29,30 +87,105 @@ func (m *JwtMiddleware) Enabled() bool {
 	return m.enabled
 }
 
-func (m *JwtMiddleware) parseToken(tokenText string) (*jwt.Token, error) {
-	return jwt.Parse(tokenText, func(t *jwt.Token) (interface{}, error) {
-		return []byte(m.secret), nil
-	})
+// keyFunc selects the verification key by the signing method and kid of token
+func (m *JwtMiddleware) keyFunc(ctx context.Context) jwt.Keyfunc {
+	return func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+			if len(m.secret) == 0 {
+				return nil, errors.New("hmac signed token is not accepted")
+			}
+			return []byte(m.secret), nil
+		}
+		if m.keys == nil {
+			return nil, errors.New("asymmetric signed token is not accepted")
+		}
+		kid, _ := t.Header["kid"].(string)
+		return m.keys.lookup(ctx, kid, t.Method)
+	}
 }
 
+func (m *JwtMiddleware) parseToken(ctx context.Context, tokenText string) (*jwt.Token, error) {
+	options := []jwt.ParserOption{jwt.WithValidMethods(m.algorithms)}
+	if m.policy != nil {
+		options = append(options, m.policy.parserOptions()...)
+	}
+	return jwt.Parse(tokenText, m.keyFunc(ctx), options...)
+}
+
+func (m *JwtMiddleware) prepare() error {
+	if m.keys != nil {
+		m.keys.startRotation(m.refreshInterval)
+	}
+	return nil
+}
+
+// Close stops the key rotation, called when a reload replaced the handler chain
+func (m *JwtMiddleware) Close() error {
+	if m.keys != nil {
+		return m.keys.Close()
+	}
+	return nil
+}
+
+// challenge is the WWW-Authenticate challenge of bearer tokens
+func (m *JwtMiddleware) challenge() string {
+	return "Bearer"
+}
+
+// verify validates the token and its claims
+func (m *JwtMiddleware) verify(ctx context.Context, tokenText string) (identity *Identity, authErr *authError) {
+	ctx, span := startSpan(ctx, "jwt.verify")
+	defer func() {
+		if authErr != nil {
+			span.SetStatus(codes.Error, authErr.code)
+		}
+		span.End()
+	}()
+	token, err := m.parseToken(ctx, tokenText)
+	if err != nil {
+		return nil, &authError{jwtErrorCode(err), err.Error(), http.StatusUnauthorized}
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if m.policy != nil {
+		if err := m.policy.validate(claims); err != nil {
+			return nil, err
+		}
+	}
+	return newIdentity("jwt", claims), nil
+}
+
+// authenticate verifies the bearer token, the request has no credential of the
+// method without Authorization: Bearer
+func (m *JwtMiddleware) authenticate(w http.ResponseWriter, r *http.Request) (*Identity, *authError) {
+	tokenText, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return nil, nil
+	}
+	return m.verify(r.Context(), tokenText)
+}
+
+// Handler authenticates by bearer token alone, the auth chain uses authenticate
+// when several methods are enabled
 func (m *JwtMiddleware) Handler(next http.Handler) http.Handler {
+	if err := m.prepare(); err != nil {
+		return unavailableHandler(m, err)
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenText := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-		token, err := m.parseToken(tokenText)
-		if err != nil {
-			flushHttpResponseError(
-				w,
-				err.Error(),
-				"JWT_VALIDATE_FAILED",
-			)
+		if isPublicRequest(r) || identityFromContext(r.Context()) != nil {
+			next.ServeHTTP(w, r)
 			return
 		}
-		sub, _ := token.Claims.GetSubject()
-		if len(sub) > 0 {
-			r = r.WithContext(
-				context.WithValue(r.Context(), "X-User-Subject", sub),
-			)
+		identity, err := m.authenticate(w, r)
+		if err == nil && identity == nil {
+			err = &authError{"JWT_REQUIRED", "bearer token is required", http.StatusUnauthorized}
+		}
+		if err != nil {
+			if err.status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", m.challenge())
+			}
+			flushJsonErrorResponse(w, err.message, err.code, err.status)
+			return
 		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withIdentity(r, identity))
 	})
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// defaultJwksRefreshInterval is the interval of background key rotation
+	defaultJwksRefreshInterval = 15 * time.Minute
+	// jwksMinRefreshInterval throttles on demand refresh caused by unknown kid
+	jwksMinRefreshInterval = 10 * time.Second
+)
+
+// jwtKeySet caches the public keys used to verify asymmetric signed tokens,
+// from static PEM files and/or a remote JWKS endpoint
+type jwtKeySet struct {
+	jwksURL string
+	client  *http.Client
+
+	mu sync.RWMutex
+	// static keys loaded from PEM files, without kid
+	static []interface{}
+	// remote keys by kid, keys without kid use empty string
+	remote      map[string][]interface{}
+	lastRefresh time.Time
+	rotation    sync.Once
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+func newJwtKeySet(pemFiles []string, jwksURL string) (*jwtKeySet, error) {
+	ks := &jwtKeySet{
+		jwksURL: jwksURL,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		remote:  map[string][]interface{}{},
+		stop:    make(chan struct{}),
+	}
+	for _, file := range pemFiles {
+		keys, err := loadPEMPublicKeys(file)
+		if err != nil {
+			return nil, fmt.Errorf("load public key %s failed: %w", file, err)
+		}
+		ks.static = append(ks.static, keys...)
+	}
+	return ks, nil
+}
+
+// loadPEMPublicKeys parses all public keys and certificates in PEM file
+func loadPEMPublicKeys(file string) ([]interface{}, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	keys := []interface{}{}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "RSA PUBLIC KEY":
+			key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, cert.PublicKey)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public key found")
+	}
+	return keys, nil
+}
+
+// refresh fetches the remote JWKS and replaces cached remote keys
+func (ks *jwtKeySet) refresh(ctx context.Context) error {
+	if len(ks.jwksURL) == 0 {
+		return nil
+	}
+	ks.mu.Lock()
+	ks.lastRefresh = time.Now()
+	ks.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.jwksURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := ks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch jwks failed with status %d", res.StatusCode)
+	}
+	jwks := jose.JSONWebKeySet{}
+	if err := json.NewDecoder(res.Body).Decode(&jwks); err != nil {
+		return err
+	}
+	remote := map[string][]interface{}{}
+	for _, key := range jwks.Keys {
+		if key.Use == "enc" || !key.IsPublic() {
+			continue
+		}
+		remote[key.KeyID] = append(remote[key.KeyID], key.Key)
+	}
+	ks.mu.Lock()
+	ks.remote = remote
+	ks.mu.Unlock()
+	return nil
+}
+
+// startRotation refreshes the remote keys periodically in background until closed
+func (ks *jwtKeySet) startRotation(interval time.Duration) {
+	if len(ks.jwksURL) == 0 {
+		return
+	}
+	ks.rotation.Do(func() {
+		if err := ks.refresh(context.Background()); err != nil {
+			log.Printf("fetch jwks %s failed %s", ks.jwksURL, err)
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ks.stop:
+					return
+				case <-ticker.C:
+				}
+				if err := ks.refresh(context.Background()); err != nil {
+					log.Printf("refresh jwks %s failed %s", ks.jwksURL, err)
+				}
+			}
+		}()
+	})
+}
+
+// Close stops the background rotation
+func (ks *jwtKeySet) Close() error {
+	ks.stopOnce.Do(func() { close(ks.stop) })
+	return nil
+}
+
+// candidates returns the keys could verify token signed with kid
+func (ks *jwtKeySet) candidates(kid string) []interface{} {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	keys := append([]interface{}{}, ks.static...)
+	if len(kid) > 0 {
+		return append(keys, ks.remote[kid]...)
+	}
+	for _, remote := range ks.remote {
+		keys = append(keys, remote...)
+	}
+	return keys
+}
+
+// lookup selects the keys for the kid and signing method, an unknown kid
+// triggers a throttled refresh of the remote keys
+func (ks *jwtKeySet) lookup(ctx context.Context, kid string, method jwt.SigningMethod) (jwt.VerificationKeySet, error) {
+	keys := filterKeysByMethod(ks.candidates(kid), method)
+	if len(keys) == 0 && len(ks.jwksURL) > 0 {
+		ks.mu.RLock()
+		throttled := time.Since(ks.lastRefresh) < jwksMinRefreshInterval
+		ks.mu.RUnlock()
+		if !throttled {
+			if err := ks.refresh(ctx); err != nil {
+				log.Printf("refresh jwks %s failed %s", ks.jwksURL, err)
+			}
+			keys = filterKeysByMethod(ks.candidates(kid), method)
+		}
+	}
+	if len(keys) == 0 {
+		return jwt.VerificationKeySet{}, fmt.Errorf("no key found for kid %q and alg %s", kid, method.Alg())
+	}
+	return jwt.VerificationKeySet{Keys: keys}, nil
+}
+
+// filterKeysByMethod keeps the keys matching the key type of signing method,
+// so a public key is never used as a HMAC secret
+func filterKeysByMethod(keys []interface{}, method jwt.SigningMethod) []jwt.VerificationKey {
+	result := []jwt.VerificationKey{}
+	for _, key := range keys {
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if _, ok := method.(*jwt.SigningMethodRSA); ok {
+				result = append(result, key)
+			}
+			if _, ok := method.(*jwt.SigningMethodRSAPSS); ok {
+				result = append(result, key)
+			}
+		case *ecdsa.PublicKey:
+			if _, ok := method.(*jwt.SigningMethodECDSA); ok {
+				result = append(result, key)
+			}
+		case ed25519.PublicKey:
+			if _, ok := method.(*jwt.SigningMethodEd25519); ok {
+				result = append(result, key)
+			}
+		}
+	}
+	return result
+}
+
+// parseJwtAlgorithms parses the comma separated allowed algorithms, none is never allowed
+func parseJwtAlgorithms(value string) ([]string, error) {
+	algorithms := []string{}
+	for _, alg := range strings.Split(value, ",") {
+		alg = strings.TrimSpace(alg)
+		if len(alg) == 0 {
+			continue
+		}
+		if strings.EqualFold(alg, "none") {
+			return nil, errors.New("algorithm none is not allowed")
+		}
+		if jwt.GetSigningMethod(alg) == nil {
+			return nil, fmt.Errorf("unknown algorithm %s", alg)
+		}
+		algorithms = append(algorithms, alg)
+	}
+	return algorithms, nil
+}
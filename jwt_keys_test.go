@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func serveJwtToken(m *JwtMiddleware, tokenText string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenText)
+	rr := httptest.NewRecorder()
+	m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+	return rr
+}
+
+func signJwt(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.MapClaims{"sub": "user-1"})
+	if len(kid) > 0 {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestJwtMiddleware_PublicKeyFile(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	file := filepath.Join(t.TempDir(), "public.pem")
+	assert.NoError(t, os.WriteFile(file, pemBytes, 0600))
+
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_PUBLIC_KEY_FILE", file)
+	m := must(NewJwtMiddleware())
+	assert.True(t, m.Enabled())
+
+	rr := serveJwtToken(m, signJwt(t, jwt.SigningMethodRS256, "", key))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// the public key must not be usable as HMAC secret
+	rr = serveJwtToken(m, signJwt(t, jwt.SigningMethodHS256, "", pemBytes))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// none algorithm is rejected
+	rr = serveJwtToken(m, signJwt(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// algorithm not in the allowed list is rejected
+	t.Setenv("JWT_ALGORITHMS", "ES256")
+	m = must(NewJwtMiddleware())
+	rr = serveJwtToken(m, signJwt(t, jwt.SigningMethodRS256, "", key))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestJwtMiddleware_Jwks(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPublic, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	keys := []jose.JSONWebKey{{Key: &ecKey.PublicKey, KeyID: "ec", Algorithm: "ES256", Use: "sig"}}
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: keys})
+	}))
+	defer server.Close()
+
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_JWKS_URL", server.URL)
+	m := must(NewJwtMiddleware())
+
+	rr := serveJwtToken(m, signJwt(t, jwt.SigningMethodES256, "ec", ecKey))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, int32(1), fetches.Load())
+
+	// rotated key with unknown kid triggers a refresh
+	keys = append(keys, jose.JSONWebKey{Key: edPublic, KeyID: "ed", Algorithm: "EdDSA", Use: "sig"})
+	m.keys.lastRefresh = m.keys.lastRefresh.Add(-jwksMinRefreshInterval)
+	rr = serveJwtToken(m, signJwt(t, jwt.SigningMethodEdDSA, "ed", edKey))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, int32(2), fetches.Load())
+
+	// refresh is throttled for unknown kid
+	rr = serveJwtToken(m, signJwt(t, jwt.SigningMethodEdDSA, "unknown", edKey))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, int32(2), fetches.Load())
+
+	// kid of an EC key can not verify EdDSA token
+	rr = serveJwtToken(m, signJwt(t, jwt.SigningMethodEdDSA, "ec", edKey))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestJwtMiddleware_JwksRotationStops(t *testing.T) {
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{})
+	}))
+	defer server.Close()
+
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_JWKS_URL", server.URL)
+	t.Setenv("JWT_JWKS_REFRESH_INTERVAL", "5ms")
+	m := must(NewJwtMiddleware())
+	m.prepare()
+	assert.Eventually(t, func() bool { return fetches.Load() >= 3 }, time.Second, time.Millisecond)
+
+	assert.NoError(t, m.Close())
+	time.Sleep(10 * time.Millisecond)
+	stopped := fetches.Load()
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, stopped, fetches.Load())
+}
+
+func TestParseJwtAlgorithms(t *testing.T) {
+	algorithms, err := parseJwtAlgorithms("RS256, ES256")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"RS256", "ES256"}, algorithms)
+
+	_, err = parseJwtAlgorithms("RS256,none")
+	assert.Error(t, err)
+
+	_, err = parseJwtAlgorithms("XX999")
+	assert.Error(t, err)
+}
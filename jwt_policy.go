@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/samber/lo"
+)
+
+// jwtPolicy is the claim validation applied to validly signed tokens
+type jwtPolicy struct {
+	issuers        []string
+	audiences      []string
+	leeway         time.Duration
+	requiredClaims []string
+	matchers       []*claimMatcher
+}
+
+func splitList(value string) []string {
+	return lo.Compact(lo.Map(strings.Split(value, ","), func(v string, _ int) string {
+		return strings.TrimSpace(v)
+	}))
+}
+
+func newJwtPolicy() (*jwtPolicy, error) {
+	p := &jwtPolicy{
+		issuers:        splitList(getenv("JWT_ISSUER")),
+		audiences:      splitList(getenv("JWT_AUDIENCE")),
+		requiredClaims: splitList(getenv("JWT_REQUIRED_CLAIMS")),
+	}
+	if v := getenv("JWT_LEEWAY"); len(v) > 0 {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration for JWT_LEEWAY", v)
+		}
+		p.leeway = d
+	}
+	matchers, err := parseClaimMatchers(getenv("JWT_CLAIM_RULES"))
+	if err != nil {
+		return nil, err
+	}
+	p.matchers = matchers
+	return p, nil
+}
+
+// parserOptions are the time based validations done by jwt parser
+func (p *jwtPolicy) parserOptions() []jwt.ParserOption {
+	return []jwt.ParserOption{jwt.WithLeeway(p.leeway)}
+}
+
+// validate checks the claims of a verified token against the policy
+func (p *jwtPolicy) validate(claims jwt.MapClaims) *authError {
+	if len(p.issuers) > 0 {
+		iss, _ := claims.GetIssuer()
+		if !lo.Contains(p.issuers, iss) {
+			return &authError{"JWT_ISSUER_INVALID", fmt.Sprintf("issuer %q is not accepted", iss), http.StatusUnauthorized}
+		}
+	}
+	if len(p.audiences) > 0 {
+		aud, _ := claims.GetAudience()
+		if len(lo.Intersect(p.audiences, []string(aud))) == 0 {
+			return &authError{"JWT_AUDIENCE_INVALID", fmt.Sprintf("audience %v is not accepted", []string(aud)), http.StatusUnauthorized}
+		}
+	}
+	for _, claim := range p.requiredClaims {
+		if lookupClaim(claims, claim) == nil {
+			return &authError{"JWT_CLAIM_MISSING", fmt.Sprintf("required claim %s is missing", claim), http.StatusUnauthorized}
+		}
+	}
+	for _, matcher := range p.matchers {
+		if !matcher.Match(claims) {
+			return &authError{"JWT_CLAIM_MISMATCH", fmt.Sprintf("claim rule %s is not satisfied", matcher), http.StatusForbidden}
+		}
+	}
+	return nil
+}
+
+// jwtErrorCode maps the parser errors to distinct error codes
+func jwtErrorCode(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "JWT_EXPIRED"
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return "JWT_NOT_YET_VALID"
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return "JWT_SIGNATURE_INVALID"
+	}
+	return "JWT_VALIDATE_FAILED"
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJwtMiddleware_Policy(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	t.Setenv("JWT_ISSUER", "https://issuer-a, https://issuer-b")
+	t.Setenv("JWT_AUDIENCE", "api")
+	t.Setenv("JWT_LEEWAY", "30s")
+	t.Setenv("JWT_REQUIRED_CLAIMS", "exp")
+	t.Setenv("JWT_CLAIM_RULES", "scope contains api:read; role in [admin,ops]")
+	m := must(NewJwtMiddleware())
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub":   "user-1",
+			"iss":   "https://issuer-b",
+			"aud":   []string{"other", "api"},
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"scope": "api:read api:write",
+			"role":  "ops",
+		}
+	}
+	sign := func(claims jwt.MapClaims) string {
+		signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		return signed
+	}
+
+	cases := []struct {
+		name   string
+		modify func(c jwt.MapClaims)
+		status int
+		code   string
+	}{
+		{"valid", func(c jwt.MapClaims) {}, http.StatusOK, ""},
+		{"expired within leeway", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-10 * time.Second).Unix() }, http.StatusOK, ""},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, http.StatusUnauthorized, "JWT_EXPIRED"},
+		{"not yet valid", func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(time.Minute).Unix() }, http.StatusUnauthorized, "JWT_NOT_YET_VALID"},
+		{"issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil" }, http.StatusUnauthorized, "JWT_ISSUER_INVALID"},
+		{"audience", func(c jwt.MapClaims) { c["aud"] = "other" }, http.StatusUnauthorized, "JWT_AUDIENCE_INVALID"},
+		{"required claim", func(c jwt.MapClaims) { delete(c, "exp") }, http.StatusUnauthorized, "JWT_CLAIM_MISSING"},
+		{"scope", func(c jwt.MapClaims) { c["scope"] = "api:write" }, http.StatusForbidden, "JWT_CLAIM_MISMATCH"},
+		{"role", func(c jwt.MapClaims) { c["role"] = "guest" }, http.StatusForbidden, "JWT_CLAIM_MISMATCH"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			claims := valid()
+			c.modify(claims)
+			rr := serveJwtToken(m, sign(claims))
+			assert.Equal(t, c.status, rr.Code)
+			if len(c.code) > 0 {
+				errMsg := ErrorMessage{}
+				assert.NoError(t, json.NewDecoder(rr.Body).Decode(&errMsg))
+				assert.Equal(t, c.code, errMsg.Code)
+			}
+		})
+	}
+
+	// signature of other secret
+	signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, valid()).SignedString([]byte("other"))
+	rr := serveJwtToken(m, signed)
+	assert.Contains(t, rr.Body.String(), "JWT_SIGNATURE_INVALID")
+}
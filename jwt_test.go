@@ -26,7 +26,7 @@ func TestNewJwtMiddleware_ValidToken(t *testing.T) {
 	t.Setenv("JWT_SECRET", secret)
 
 	// Create a new JwtMiddleware
-	middleware := NewJwtMiddleware()
+	middleware := must(NewJwtMiddleware())
 
 	// Create a test request with the valid JWT token in the Authorization header
 	req := httptest.NewRequest("GET", "/", nil)
@@ -37,8 +37,8 @@ func TestNewJwtMiddleware_ValidToken(t *testing.T) {
 
 	// Call the Handler method of the middleware with the test request and response recorder
 	middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if the X-User-Subject header is set to the subject of the JWT token
-		subject := r.Context().Value("X-User-Subject").(string)
+		// Check if the identity subject is set to the subject of the JWT token
+		subject := identityFromContext(r.Context()).Subject
 		if subject != claims.Subject {
 			t.Errorf("X-User-Subject header is incorrect: got %v, want %v", subject, claims.Subject)
 		}
@@ -63,7 +63,7 @@ func TestJwtMiddleware_Handler_InvalidToken(t *testing.T) {
 	})
 
 	// Create an instance of the JwtMiddleware struct
-	jwtMiddleware := NewJwtMiddleware()
+	jwtMiddleware := must(NewJwtMiddleware())
 
 	// Call the Handler method with the mock handler
 	handler := jwtMiddleware.Handler(mockHandler)
@@ -87,3 +87,28 @@ func TestJwtMiddleware_Handler_InvalidToken(t *testing.T) {
 		t.Errorf("expected body %q but got %q", expectedBody, rr.Body.String())
 	}
 }
+
+func TestJwtMiddleware_Handler_BearerRequired(t *testing.T) {
+	secret := uuid.New().String()
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "123"}).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("Failed to generate JWT token: %v", err)
+	}
+	t.Setenv("JWT_SECRET", secret)
+	handler := must(NewJwtMiddleware()).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// the token is only accepted with the Bearer scheme
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", tokenString)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d but got %d", http.StatusUnauthorized, rr.Code)
+	}
+	if challenge := rr.Header().Get("WWW-Authenticate"); challenge != "Bearer" {
+		t.Errorf("expected challenge Bearer but got %q", challenge)
+	}
+	if !strings.Contains(rr.Body.String(), `"Code":"JWT_REQUIRED"`) {
+		t.Errorf("expected JWT_REQUIRED but got %q", rr.Body.String())
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -8,32 +11,144 @@ import (
 	"github.com/samber/lo"
 )
 
-func main() {
+// createHandler builds the middleware chain in front of the proxy from current settings,
+// the middlewares already created are closed when one of them fails
+func createHandler() (http.Handler, error) {
 
-	middlewares := []Middleware{
-		NewOdicMiddleware(),
-		NewJwtMiddleware(),
-		NewRateLimiterMiddleware(),
+	routes, err := loadRouteSettings()
+	if err != nil {
+		return nil, fmt.Errorf("load routes failed: %w", err)
 	}
 
-	addr := os.Getenv("LISTEN_ADDR")
+	authz, err := NewAuthzMiddleware()
+	if err != nil {
+		return nil, err
+	}
 
-	if len(addr) == 0 {
-		addr = ":8080"
+	middlewares := []Middleware{}
+	closers := []io.Closer{}
+	errs := []error{}
+	use := func(middleware Middleware, err error) {
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		middlewares = append(middlewares, middleware)
+		if closer, ok := middleware.(io.Closer); ok {
+			closers = append(closers, closer)
+		}
+	}
+	use(NewTracingMiddleware())
+	use(NewRequestIDMiddleware())
+	use(NewAccessLogMiddleware())
+	use(NewMetricsMiddleware(), nil)
+	use(NewHstsMiddleware())
+	use(authz.RuleMatcher(), nil)
+	use(NewAuthChainMiddleware())
+	use(NewRateLimiterMiddleware(routes...))
+	use(authz, nil)
+	use(NewConcurrencyLimiterMiddleware(routes...))
+	if err := errors.Join(errs...); err != nil {
+		(&handlerChain{closers: closers}).Close()
+		return nil, err
 	}
 
 	// major handler
-	handler := createProxyHandler()
+	proxy := createProxyHandler(routes)
+	handler := http.Handler(proxy)
+	if metricsEnabled() && len(getenv("ADMIN_LISTEN_ADDR")) == 0 {
+		handler = serveMetrics(handler)
+	}
+	closers = append(closers, proxy)
 
 	// apply middlewares
 	for _, middleware := range lo.Reverse(middlewares) {
 		if middleware.Enabled() {
 			log.Printf("middleware %s is enabled", middleware.Name())
-			handler = middleware.Handler(handler)
+			handler = routeScoped(middleware, handler)
+		}
+	}
+
+	// route is matched before all middlewares
+	handler = (&RouteMatcher{routes: routes}).Handler(handler)
+
+	return &handlerChain{Handler: handler, closers: closers}, nil
+}
+
+// handlerChain is the built chain, closed when a reload replaced it
+type handlerChain struct {
+	http.Handler
+	closers []io.Closer
+}
+
+func (c *handlerChain) Close() error {
+	for _, closer := range c.closers {
+		closer.Close()
+	}
+	return nil
+}
+
+func main() {
+
+	configFile := os.Getenv("CONFIG_FILE")
+
+	if len(configFile) > 0 {
+		config, err := loadConfig(configFile)
+		if err != nil {
+			log.Fatalf("load config file %s failed: %s", configFile, err)
 		}
+		setConfig(config)
+	}
+
+	if err := validateSettings(); err != nil {
+		log.Fatalf("invalid configuration: %s", err)
+	}
+
+	addr := getenv("LISTEN_ADDR")
+
+	if len(addr) == 0 {
+		addr = ":8080"
+	}
+
+	handler, err := newReloadableHandler(createHandler)
+	if err != nil {
+		log.Fatalf("create handler failed: %s", err)
+	}
+
+	if len(configFile) > 0 {
+		handler.watch(configFile, configWatchInterval())
+	}
+
+	server := &http.Server{Addr: addr, Handler: handler}
+
+	if adminAddr := getenv("ADMIN_LISTEN_ADDR"); len(adminAddr) > 0 {
+		go func() {
+			log.Println("Admin listening on", adminAddr)
+			log.Println(http.ListenAndServe(adminAddr, createAdminHandler()))
+		}()
+	}
+
+	if len(getenv("TLS_CERT_FILE")) > 0 {
+		tlsConfig, err := newServerTLSConfig()
+		if err != nil {
+			log.Fatalf("load TLS certificates failed: %s", err)
+		}
+		server.TLSConfig = tlsConfig
+
+		if redirectAddr := getenv("TLS_REDIRECT_ADDR"); len(redirectAddr) > 0 {
+			go func() {
+				log.Println("Redirecting HTTP to HTTPS on", redirectAddr)
+				log.Println(http.ListenAndServe(redirectAddr, createHttpsRedirectHandler(addr)))
+			}()
+		}
+
+		log.Println("Listening TLS on", addr)
+
+		server.ListenAndServeTLS("", "")
+		return
 	}
 
 	log.Println("Listening on", addr)
 
-	http.ListenAndServe(addr, handler)
+	server.ListenAndServe()
 }
@@ -9,6 +9,7 @@ import (
 )
 
 func TestMain(t *testing.T) {
+	isolateRateLimitStore(t)
 	t.Setenv("RATE_LIMIT", "60-S")
 	t.Setenv("LISTEN_ADDR", "127.0.0.1:43533")
 	t.Setenv("UPSTREAM", "https://httpbin.org/")
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/samber/lo"
+)
+
+const metricsNamespace = "secure_app_proxy"
+
+// metricsPath is where the metrics are exposed, on the admin listener when ADMIN_LISTEN_ADDR is set
+const metricsPath = "/_/metrics"
+
+// metricMethods are the methods kept as label, others are OTHER so clients can not
+// blow up the series
+var metricMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace,
+}
+
+// metricsRegistry survives the rebuild of middlewares on config reload, so counters
+// are never reset by a reload
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Requests handled, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of requests until the response is written, by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+	upstreamRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_requests_total",
+		Help:      "Attempts proxied to upstream instances, by route, upstream and status code, error on connection failure, canceled when the client went away.",
+	}, []string{"route", "upstream", "code"})
+	upstreamRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of attempts proxied to upstream instances, by route and upstream.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "upstream"})
+	upstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_errors_total",
+		Help:      "Upstream failures, by route, upstream and reason (connection, status_5xx, circuit_open, no_upstream).",
+	}, []string{"route", "upstream", "reason"})
+	authFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_failures_total",
+		Help:      "Requests rejected by authentication or authorization, by error code.",
+	}, []string{"code"})
+	rateLimitRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Requests rejected by rate limit, by scope (global or route).",
+	}, []string{"scope"})
+	concurrencyLimitRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "concurrency_limit_rejections_total",
+		Help:      "Requests shed by concurrency limit, by scope and reason (queue_full, queue_timeout, canceled).",
+	}, []string{"scope", "reason"})
+)
+
+// activeSessionStore is the server side session store counted by the active sessions
+// gauge, nil with cookie store
+var activeSessionStore atomic.Pointer[serverSessionStore]
+
+var activeSessionsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "active_sessions"),
+	"Logged in sessions of memory, filesystem or redis session store.",
+	nil, nil,
+)
+
+// activeSessionsCacheTTL is how long the count of active sessions is reused, counting
+// loads and decodes every session of the store
+const activeSessionsCacheTTL = 30 * time.Second
+
+// activeSessionsCollector counts the logged in sessions of server side store on scrape
+type activeSessionsCollector struct {
+	desc *prometheus.Desc
+
+	mu        sync.Mutex
+	store     *serverSessionStore
+	count     int
+	countedAt time.Time
+}
+
+func (c *activeSessionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *activeSessionsCollector) Collect(ch chan<- prometheus.Metric) {
+	store := activeSessionStore.Load()
+	if store == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if store != c.store || time.Since(c.countedAt) > activeSessionsCacheTTL {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		sessions, err := store.Sessions(ctx)
+		if err != nil {
+			log.Printf("count active sessions failed %s", err)
+			return
+		}
+		c.store = store
+		c.count = lo.CountBy(sessions, func(s activeSession) bool {
+			_, ok := s.Values["sub"]
+			return ok
+		})
+		c.countedAt = time.Now()
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(c.count))
+}
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		upstreamRequestsTotal,
+		upstreamRequestDuration,
+		upstreamErrorsTotal,
+		authFailuresTotal,
+		rateLimitRejectionsTotal,
+		concurrencyLimitRejectionsTotal,
+		&activeSessionsCollector{desc: activeSessionsDesc},
+	)
+}
+
+// routeLabel is the route of request as metric label
+func routeLabel(route *Route) string {
+	if route == nil {
+		return "none"
+	}
+	return route.Host + route.PathPrefix
+}
+
+func methodLabel(method string) string {
+	if lo.Contains(metricMethods, method) {
+		return method
+	}
+	return "OTHER"
+}
+
+// recordAuthFailure counts a request rejected by authentication or authorization
+func recordAuthFailure(code string) {
+	authFailuresTotal.WithLabelValues(code).Inc()
+}
+
+// upstreamLabel is the upstream as metric label, only scheme and host so the
+// credentials and path of upstream URL are not exposed
+func upstreamLabel(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// recordUpstreamAttempt counts an attempt proxied to upstream target
+func recordUpstreamAttempt(route *Route, attempt *proxyAttempt, elapsed time.Duration) {
+	upstream := upstreamLabel(attempt.target.url)
+	code := "error"
+	switch {
+	case attempt.status > 0:
+		code = strconv.Itoa(attempt.status)
+	case attempt.canceled:
+		code = "canceled"
+	}
+	upstreamRequestsTotal.WithLabelValues(routeLabel(route), upstream, code).Inc()
+	upstreamRequestDuration.WithLabelValues(routeLabel(route), upstream).Observe(elapsed.Seconds())
+	switch {
+	case attempt.canceled:
+	case attempt.status == 0:
+		upstreamErrorsTotal.WithLabelValues(routeLabel(route), upstream, "connection").Inc()
+	case attempt.status >= http.StatusInternalServerError:
+		upstreamErrorsTotal.WithLabelValues(routeLabel(route), upstream, "status_5xx").Inc()
+	}
+}
+
+func metricsEnabled() bool {
+	return getenv("METRICS") == "true"
+}
+
+// metricsHandler exposes the metrics in Prometheus text format
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// MetricsMiddleware records the requests by route, method and status code
+type MetricsMiddleware struct {
+	enabled bool
+}
+
+func NewMetricsMiddleware() *MetricsMiddleware {
+	return &MetricsMiddleware{enabled: metricsEnabled()}
+}
+
+func (m *MetricsMiddleware) Name() string {
+	return "MetricsMiddleware"
+}
+
+func (m *MetricsMiddleware) Enabled() bool {
+	return m.enabled
+}
+
+func (m *MetricsMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			code := recorder.status
+			if code == 0 {
+				code = http.StatusOK
+			}
+			labels := []string{routeLabel(routeFromContext(r.Context())), methodLabel(r.Method), strconv.Itoa(code)}
+			requestsTotal.WithLabelValues(labels...).Inc()
+			requestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// serveMetrics serves the metrics endpoint in front of the proxy, behind authentication
+// and authorization like other paths, used when there is no admin listener
+func serveMetrics(next http.Handler) http.Handler {
+	metrics := metricsHandler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == metricsPath {
+			metrics.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// createAdminHandler serves the endpoints of ADMIN_LISTEN_ADDR, which is not exposed
+// to clients and needs no authentication
+func createAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	if metricsEnabled() {
+		mux.Handle(metricsPath, metricsHandler())
+	}
+	mux.HandleFunc("GET "+sessionsPath, serveSessions)
+	mux.HandleFunc("DELETE "+sessionsPath+"/{id}", serveRevokeSession)
+	mux.HandleFunc("GET "+usersPath, serveUsers)
+	mux.HandleFunc("PUT "+usersPath+"/{username}", servePutUser)
+	mux.HandleFunc("DELETE "+usersPath+"/{username}", serveDeleteUser)
+	return mux
+}
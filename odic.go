@@ -2,13 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
-	"os"
+	"sync"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 )
 
@@ -16,12 +20,33 @@ type OidcMiddleware struct {
 	provider *oidc.Provider
 	conf     *oauth2.Config
 	enabled  bool
+	// endpoints discovered from the provider metadata, optional
+	endSessionEndpoint string
+	revocationEndpoint string
+	// postLogoutRedirectURL is where the provider sends the user back after logout
+	postLogoutRedirectURL string
+	revocations           *oidcRevocations
+	// refreshLeeway is how long before expiry the access token will be refreshed
+	refreshLeeway time.Duration
+	store         sessions.Store
 }
 
-func NewOdicMiddleware() *OidcMiddleware {
-	return &OidcMiddleware{
-		enabled: len(os.Getenv("ODIC_CLIENT_ID")) > 0 && len(os.Getenv("ODIC_CLIENT_SECRET")) > 0,
+func NewOdicMiddleware() (*OidcMiddleware, error) {
+	refreshLeeway := defaultRefreshLeeway
+	if v := getenv("ODIC_REFRESH_LEEWAY"); len(v) > 0 {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration for ODIC_REFRESH_LEEWAY", v)
+		}
+		refreshLeeway = d
 	}
+	return &OidcMiddleware{
+		// ODIC_CLIENT_SECRET is optional, without it the proxy acts as a public client with PKCE
+		enabled:               len(getenv("ODIC_CLIENT_ID")) > 0,
+		postLogoutRedirectURL: getenv("ODIC_POST_LOGOUT_REDIRECT_URL"),
+		revocations:           sharedOidcRevocations,
+		refreshLeeway:         refreshLeeway,
+	}, nil
 }
 
 // VerifyIDToken verifies that an *oauth2.Token is a valid *oidc.IDToken.
@@ -46,51 +71,169 @@ func (m *OidcMiddleware) Enabled() bool {
 	return m.enabled
 }
 
-func (m *OidcMiddleware) Handler(next http.Handler) http.Handler {
-	m.provider, _ = oidc.NewProvider(
-		context.Background(),
-		os.Getenv("ODIC_ISSUER"),
-	)
+// sharedOidcProviders keeps the discovered provider of issuer across the rebuild of
+// middlewares on config reload, a failed discovery is retried by the next reload
+var (
+	sharedOidcProviders   = map[string]*oidc.Provider{}
+	sharedOidcProvidersMu sync.Mutex
+)
+
+// oidcProvider returns the provider of issuer, discovered on first use
+func oidcProvider(issuer string) (*oidc.Provider, error) {
+	sharedOidcProvidersMu.Lock()
+	defer sharedOidcProvidersMu.Unlock()
+	if provider, ok := sharedOidcProviders[issuer]; ok {
+		return provider, nil
+	}
+	provider, err := oidc.NewProvider(context.Background(), issuer)
+	if err != nil {
+		return nil, err
+	}
+	sharedOidcProviders[issuer] = provider
+	return provider, nil
+}
+
+func (m *OidcMiddleware) prepare() error {
+	provider, err := oidcProvider(getenv("ODIC_ISSUER"))
+	if err != nil {
+		return fmt.Errorf("discover oidc provider failed: %w", err)
+	}
+	m.provider = provider
 	m.conf = &oauth2.Config{
-		ClientID:     os.Getenv("ODIC_CLIENT_ID"),
-		ClientSecret: os.Getenv("ODIC_CLIENT_SECRET"),
-		RedirectURL:  os.Getenv("ODIC_CALLBACK_URL"),
+		ClientID:     getenv("ODIC_CLIENT_ID"),
+		ClientSecret: getenv("ODIC_CLIENT_SECRET"),
+		RedirectURL:  getenv("ODIC_CALLBACK_URL"),
 		Endpoint:     m.provider.Endpoint(),
 		Scopes:       []string{oidc.ScopeOpenID, "profile"},
 	}
-	store := sessions.NewCookieStore([]byte(os.Getenv("ODIC_SESSION_SECRET")))
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		s, err := store.Get(r, "user")
+	if len(m.conf.ClientSecret) == 0 {
+		// public client sends client_id in the form instead of basic auth
+		m.conf.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
+	m.discoverEndpoints()
+	if m.revocations == nil {
+		m.revocations = sharedOidcRevocations
+	}
+	store, err := newSessionStore([]byte(getenv("ODIC_SESSION_SECRET")))
+	if err != nil {
+		return fmt.Errorf("create oidc session store failed: %w", err)
+	}
+	m.store = store
+	return nil
+}
 
-		if err != nil {
-			flushJsonErrorResponse(w, "session handling failed", "ERR_SESSION", http.StatusBadRequest)
+// serveEndpoint serves the callback and logout endpoints, false for other paths
+func (m *OidcMiddleware) serveEndpoint(w http.ResponseWriter, r *http.Request) bool {
+	switch r.URL.Path {
+	case "/_/oidc/backchannel-logout":
+		m.handleBackChannelLogout(r, w)
+		return true
+	case "/_/oidc/callback", "/_/oidc/logout":
+	default:
+		return false
+	}
+	s, err := m.store.Get(r, "user")
+	if err != nil {
+		flushJsonErrorResponse(w, "session handling failed", "ERR_SESSION", http.StatusBadRequest)
+		return true
+	}
+	if r.URL.Path == "/_/oidc/callback" {
+		m.handleCallback(s, r, w)
+	} else {
+		m.handleLogout(s, r, w)
+	}
+	return true
+}
+
+// authenticate restores the identity of session logged in by oidc, the token is
+// refreshed when it is about to expire, a revoked or expired session is cleared
+func (m *OidcMiddleware) authenticate(w http.ResponseWriter, r *http.Request) (*Identity, *authError) {
+	s, err := m.store.Get(r, "user")
+	if err != nil {
+		return nil, &authError{"ERR_SESSION", "session handling failed", http.StatusBadRequest}
+	}
+	if s.IsNew || s.Values["token"] == nil {
+		return nil, nil
+	}
+	if m.revocations.isRevoked(s) || !m.refreshTokenIfNeeded(s, r, w) {
+		clearSession(s)
+		return nil, nil
+	}
+	return sessionIdentity(s), nil
+}
+
+// login starts the authorization code flow, back to the current page after login
+func (m *OidcMiddleware) login(w http.ResponseWriter, r *http.Request) {
+	s, err := m.store.Get(r, "user")
+	if err != nil {
+		flushJsonErrorResponse(w, "session handling failed", "ERR_SESSION", http.StatusBadRequest)
+		return
+	}
+	m.handleUnauthorized(s, r, w)
+}
+
+func (m *OidcMiddleware) Handler(next http.Handler) http.Handler {
+	if err := m.prepare(); err != nil {
+		return unavailableHandler(m, err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.serveEndpoint(w, r) {
 			return
 		}
 
-		if r.URL.Path == "/_/oidc/callback" {
-			m.handleCallback(s, r, w)
+		// already authenticated by form login or a client certificate
+		if isPublicRequest(r) || identityFromContext(r.Context()) != nil {
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		if s.IsNew || s.Values["token"] == nil {
-			m.handleUnauthorized(s, r, w)
+		identity, err := m.authenticate(w, r)
+		if err != nil {
+			flushJsonErrorResponse(w, err.message, err.code, err.status)
 			return
 		}
-		r = r.WithContext(
-			context.WithValue(r.Context(), "X-User-Subject", s.Values["profile_name"]),
-		)
-		next.ServeHTTP(w, r)
+		if identity == nil {
+			m.login(w, r)
+			return
+		}
+		next.ServeHTTP(w, withIdentity(r, identity))
 	})
 }
 
+// sessionIdentity restores the identity of the logged in user from session
+func sessionIdentity(s *sessions.Session) *Identity {
+	claims := map[string]interface{}{}
+	if raw, ok := s.Values["claims"].(string); ok {
+		json.Unmarshal([]byte(raw), &claims)
+	}
+	if sub, ok := s.Values["sub"].(string); ok {
+		claims["sub"] = sub
+	}
+	authMethod, _ := s.Values["auth_method"].(string)
+	if len(authMethod) == 0 {
+		authMethod = "oidc"
+	}
+	return newIdentity(authMethod, claims)
+}
+
 func (m *OidcMiddleware) handleUnauthorized(s *sessions.Session, r *http.Request, w http.ResponseWriter) {
 	newUUID, _ := uuid.NewRandom()
 	stateId := newUUID.String()
+	nonceUUID, _ := uuid.NewRandom()
+	nonce := nonceUUID.String()
+	verifier := oauth2.GenerateVerifier()
 	s.Values["odic_restore_url"] = r.URL.Path
 	s.Values["oidc_state"] = stateId
+	s.Values["oidc_nonce"] = nonce
+	s.Values["oidc_code_verifier"] = verifier
 	s.Save(r, w)
 	s.Flashes()
-	http.Redirect(w, r, m.conf.AuthCodeURL(stateId), http.StatusTemporaryRedirect)
+	http.Redirect(
+		w,
+		r,
+		m.conf.AuthCodeURL(stateId, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce)),
+		http.StatusTemporaryRedirect,
+	)
 }
 
 func (m *OidcMiddleware) handleCallback(s *sessions.Session, r *http.Request, w http.ResponseWriter) {
@@ -102,7 +245,13 @@ func (m *OidcMiddleware) handleCallback(s *sessions.Session, r *http.Request, w
 		)
 		return
 	}
-	token, err := m.conf.Exchange(r.Context(), r.URL.Query().Get("code"))
+	exchangeOptions := []oauth2.AuthCodeOption{}
+	if verifier, ok := s.Values["oidc_code_verifier"].(string); ok {
+		exchangeOptions = append(exchangeOptions, oauth2.VerifierOption(verifier))
+	}
+	ctx, span := startSpan(r.Context(), "oidc.exchange", trace.WithSpanKind(trace.SpanKindClient))
+	token, err := m.conf.Exchange(ctx, r.URL.Query().Get("code"), exchangeOptions...)
+	endSpan(span, err)
 	if err != nil {
 		flushJsonErrorResponse(
 			w,
@@ -123,6 +272,19 @@ func (m *OidcMiddleware) handleCallback(s *sessions.Session, r *http.Request, w
 		return
 	}
 
+	if nonce, _ := s.Values["oidc_nonce"].(string); len(nonce) == 0 || idToken.Nonce != nonce {
+		flushJsonErrorResponse(
+			w,
+			"OIDC nonce mismatch, avoid replay attack we rejected your request",
+			"ERR_OIDC_NONCE_MISMATCH",
+			http.StatusUnauthorized,
+		)
+		return
+	}
+	delete(s.Values, "oidc_state")
+	delete(s.Values, "oidc_nonce")
+	delete(s.Values, "oidc_code_verifier")
+
 	profile := map[string]interface{}{}
 
 	if err := idToken.Claims(&profile); err != nil {
@@ -134,9 +296,24 @@ func (m *OidcMiddleware) handleCallback(s *sessions.Session, r *http.Request, w
 		)
 		return
 	}
+	claims, err := json.Marshal(profile)
+	if err != nil {
+		flushJsonErrorResponse(
+			w,
+			err.Error(),
+			"ERR_OIDC_AUTH_RETRIEVE_PROFILE_FAILED",
+			http.StatusUnauthorized,
+		)
+		return
+	}
+	renewSessionID(m.store, r, s)
 	s.Values["profile_name"] = profile["name"]
 	s.Values["profile_email"] = profile["email"]
-	s.Values["token"] = token.AccessToken
+	s.Values["claims"] = string(claims)
+	saveSessionToken(s, token)
+	s.Values["sub"] = idToken.Subject
+	s.Values["sid"], _ = profile["sid"].(string)
+	s.Values["login_at"] = time.Now().UnixNano()
 	if err := s.Save(r, w); err != nil {
 		flushHttpResponseError(w, err.Error(), "ERR_SAVE_SESSION_FAILED")
 		return
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/sessions"
+)
+
+const backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// logoutTokenLeeway tolerates the clock skew between the provider and proxy
+const logoutTokenLeeway = time.Minute
+
+// revocationsPruneInterval is the minimum interval between prunes of expired records
+const revocationsPruneInterval = time.Minute
+
+// oidcRevocations records sessions killed by the provider through back-channel logout,
+// the cookie store can not delete a session remotely, so sessions established before
+// the revocation are rejected when they come back
+type oidcRevocations struct {
+	mu    sync.RWMutex
+	bySid map[string]time.Time
+	bySub map[string]time.Time
+	// jtis are the ids of the logout tokens seen, kept until the token expires
+	jtis map[string]time.Time
+	// maxAge is how long a revocation is kept, older sessions are expired anyway
+	maxAge    time.Duration
+	lastPrune time.Time
+}
+
+// sharedOidcRevocations survives the rebuild of middlewares on config reload
+var sharedOidcRevocations = newOidcRevocations()
+
+func newOidcRevocations() *oidcRevocations {
+	return &oidcRevocations{
+		bySid:  map[string]time.Time{},
+		bySub:  map[string]time.Time{},
+		jtis:   map[string]time.Time{},
+		maxAge: defaultSessionMaxAge * time.Second,
+	}
+}
+
+func (r *oidcRevocations) revoke(sid string, sub string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(sid) > 0 {
+		r.bySid[sid] = at
+	}
+	if len(sub) > 0 {
+		r.bySub[sub] = at
+	}
+	r.prune(time.Now())
+}
+
+// remember records the id of logout token until it expires, false when the token
+// was seen before
+func (r *oidcRevocations) remember(jti string, expireAt time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if at, ok := r.jtis[jti]; ok && now.Before(at) {
+		return false
+	}
+	r.jtis[jti] = expireAt
+	r.prune(now)
+	return true
+}
+
+// prune forgets the expired records, at most once per revocationsPruneInterval
+func (r *oidcRevocations) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < revocationsPruneInterval {
+		return
+	}
+	r.lastPrune = now
+	for _, records := range []map[string]time.Time{r.bySid, r.bySub} {
+		for key, at := range records {
+			if now.Sub(at) > r.maxAge {
+				delete(records, key)
+			}
+		}
+	}
+	for jti, expireAt := range r.jtis {
+		if now.After(expireAt) {
+			delete(r.jtis, jti)
+		}
+	}
+}
+
+func (r *oidcRevocations) isRevoked(s *sessions.Session) bool {
+	loginAt, _ := s.Values["login_at"].(int64)
+	sid, _ := s.Values["sid"].(string)
+	sub, _ := s.Values["sub"].(string)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if at, ok := r.bySid[sid]; ok && len(sid) > 0 && loginAt <= at.UnixNano() {
+		return true
+	}
+	if at, ok := r.bySub[sub]; ok && len(sub) > 0 && loginAt <= at.UnixNano() {
+		return true
+	}
+	return false
+}
+
+// clearSession forgets all values of the session
+func clearSession(s *sessions.Session) {
+	for k := range s.Values {
+		delete(s.Values, k)
+	}
+}
+
+// discoverEndpoints reads the optional logout related endpoints from provider metadata
+func (m *OidcMiddleware) discoverEndpoints() {
+	if m.provider == nil {
+		return
+	}
+	metadata := struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+		RevocationEndpoint string `json:"revocation_endpoint"`
+	}{}
+	if err := m.provider.Claims(&metadata); err != nil {
+		log.Printf("read oidc provider metadata failed %s", err)
+		return
+	}
+	m.endSessionEndpoint = metadata.EndSessionEndpoint
+	m.revocationEndpoint = metadata.RevocationEndpoint
+}
+
+// revokeToken asks the provider to revoke the token (RFC 7009), best effort
+func (m *OidcMiddleware) revokeToken(r *http.Request, token string) {
+	if len(m.revocationEndpoint) == 0 || len(token) == 0 {
+		return
+	}
+	form := url.Values{
+		"token":           {token},
+		"token_type_hint": {"access_token"},
+	}
+	// public client identifies itself in the form
+	if len(m.conf.ClientSecret) == 0 {
+		form.Set("client_id", m.conf.ClientID)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, m.revocationEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		log.Printf("create token revocation request failed %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(m.conf.ClientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(m.conf.ClientID), url.QueryEscape(m.conf.ClientSecret))
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("revoke token failed %s", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		log.Printf("revoke token failed with status %d", res.StatusCode)
+	}
+}
+
+func (m *OidcMiddleware) handleLogout(s *sessions.Session, r *http.Request, w http.ResponseWriter) {
+	// a link or image of another site must not log the user out
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		flushJsonErrorResponse(w, "logout only accepts POST", "ERR_OIDC_LOGOUT_METHOD", http.StatusMethodNotAllowed)
+		return
+	}
+	idToken, _ := s.Values["id_token"].(string)
+	token, _ := s.Values["token"].(string)
+
+	m.revokeToken(r, token)
+
+	clearSession(s)
+	if s.Options != nil {
+		// expire the cookie
+		s.Options.MaxAge = -1
+	}
+	if err := s.Save(r, w); err != nil {
+		flushHttpResponseError(w, err.Error(), "ERR_SAVE_SESSION_FAILED")
+		return
+	}
+
+	redirectURL := m.postLogoutRedirectURL
+	if len(redirectURL) == 0 {
+		redirectURL = "/"
+	}
+
+	if len(m.endSessionEndpoint) > 0 {
+		u, err := url.Parse(m.endSessionEndpoint)
+		if err != nil {
+			flushJsonErrorResponse(w, err.Error(), "ERR_OIDC_LOGOUT_FAILED", http.StatusInternalServerError)
+			return
+		}
+		q := u.Query()
+		q.Set("client_id", m.conf.ClientID)
+		if len(idToken) > 0 {
+			q.Set("id_token_hint", idToken)
+		}
+		if len(m.postLogoutRedirectURL) > 0 {
+			q.Set("post_logout_redirect_uri", m.postLogoutRedirectURL)
+		}
+		u.RawQuery = q.Encode()
+		redirectURL = u.String()
+	}
+
+	// the browser follows with GET, the logout POST is not repeated
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+// verifyLogoutToken validates a back-channel logout token, see
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#Validation,
+// a token is accepted once, its iat is the time sessions are revoked at
+func (m *OidcMiddleware) verifyLogoutToken(r *http.Request, rawToken string) (sid string, sub string, iat time.Time, err error) {
+	token, err := m.provider.Verifier(&oidc.Config{
+		ClientID:        m.conf.ClientID,
+		SkipExpiryCheck: true,
+	}).Verify(r.Context(), rawToken)
+	if err != nil {
+		return "", "", iat, err
+	}
+	claims := struct {
+		Sid    string                 `json:"sid"`
+		Jti    string                 `json:"jti"`
+		Nonce  *string                `json:"nonce"`
+		Events map[string]interface{} `json:"events"`
+	}{}
+	if err := token.Claims(&claims); err != nil {
+		return "", "", iat, err
+	}
+	if _, ok := claims.Events[backChannelLogoutEvent]; !ok {
+		return "", "", iat, errors.New("logout token does not contain the back-channel logout event")
+	}
+	if claims.Nonce != nil {
+		return "", "", iat, errors.New("logout token must not contain a nonce")
+	}
+	if len(claims.Sid) == 0 && len(token.Subject) == 0 {
+		return "", "", iat, errors.New("logout token must contain a sid or sub claim")
+	}
+	now := time.Now()
+	if token.IssuedAt.IsZero() || token.IssuedAt.After(now.Add(logoutTokenLeeway)) {
+		return "", "", iat, errors.New("logout token must contain an iat claim not in the future")
+	}
+	if token.Expiry.IsZero() || now.After(token.Expiry.Add(logoutTokenLeeway)) {
+		return "", "", iat, errors.New("logout token is expired")
+	}
+	if len(claims.Jti) == 0 {
+		return "", "", iat, errors.New("logout token must contain a jti claim")
+	}
+	if !m.revocations.remember(claims.Jti, token.Expiry.Add(logoutTokenLeeway)) {
+		return "", "", iat, errors.New("logout token is already used")
+	}
+	return claims.Sid, token.Subject, token.IssuedAt, nil
+}
+
+func (m *OidcMiddleware) handleBackChannelLogout(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != http.MethodPost {
+		flushJsonErrorResponse(w, "back-channel logout only accepts POST", "ERR_OIDC_LOGOUT_TOKEN_INVALID", http.StatusMethodNotAllowed)
+		return
+	}
+	sid, sub, iat, err := m.verifyLogoutToken(r, r.PostFormValue("logout_token"))
+	if err != nil {
+		flushJsonErrorResponse(w, err.Error(), "ERR_OIDC_LOGOUT_TOKEN_INVALID", http.StatusBadRequest)
+		return
+	}
+	// a token carrying sid only ends that session, otherwise all sessions of the subject
+	if len(sid) > 0 {
+		sub = ""
+	}
+	// iat has seconds precision, sessions established within that second are revoked too
+	m.revocations.revoke(sid, sub, iat.Add(time.Second))
+	if store, ok := m.store.(*serverSessionStore); ok {
+		// server side sessions can be deleted right away
+		field, value := "sub", sub
+		if len(sid) > 0 {
+			field, value = "sid", sid
+		}
+		_, err := store.RevokeMatching(r.Context(), field, value, nil)
+		if err != nil {
+			flushJsonErrorResponse(w, err.Error(), "ERR_OIDC_LOGOUT_FAILED", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOidcMiddleware_Logout(t *testing.T) {
+	p := newMockOidcProvider(t)
+	t.Setenv("ODIC_POST_LOGOUT_REDIRECT_URL", "http://localhost:8080/bye")
+	m := newMockOidcMiddleware(t, p)
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cookies := oidcLogin(t, p, handler)
+
+	// a GET from a link of another site does not log out
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, withCookies(httptest.NewRequest(http.MethodGet, "/_/oidc/logout", nil), cookies))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, http.MethodPost, rr.Header().Get("Allow"))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, withCookies(httptest.NewRequest(http.MethodPost, "/_/oidc/logout", nil), cookies))
+
+	assert.Equal(t, http.StatusSeeOther, rr.Code)
+	location, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, p.server.URL+"/logout", location.Scheme+"://"+location.Host+location.Path)
+	assert.NotEmpty(t, location.Query().Get("id_token_hint"))
+	assert.Equal(t, "http://localhost:8080/bye", location.Query().Get("post_logout_redirect_uri"))
+	assert.Equal(t, "access-token-authorization_code", p.lastRevokeForm.Get("token"))
+
+	// the session cookie is expired
+	logoutCookies := rr.Result().Cookies()
+	for _, c := range logoutCookies {
+		if c.Name == "user" {
+			assert.True(t, c.MaxAge < 0)
+		}
+	}
+
+	// the cleared session is not authenticated anymore
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, withCookies(httptest.NewRequest(http.MethodGet, "/app", nil), logoutCookies))
+	assert.Equal(t, http.StatusTemporaryRedirect, rr.Code)
+}
+
+func TestOidcMiddleware_BackChannelLogout(t *testing.T) {
+	p := newMockOidcProvider(t)
+	m := newMockOidcMiddleware(t, p)
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cookies := oidcLogin(t, p, handler)
+
+	postLogoutToken := func(claims jwt.MapClaims) *httptest.ResponseRecorder {
+		form := url.Values{"logout_token": {p.signToken(t, claims)}}
+		req := httptest.NewRequest(http.MethodPost, "/_/oidc/backchannel-logout", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	events := map[string]interface{}{backChannelLogoutEvent: map[string]interface{}{}}
+
+	// missing event is rejected
+	rr := postLogoutToken(jwt.MapClaims{"sid": "sid-1", "jti": "jti-1"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "ERR_OIDC_LOGOUT_TOKEN_INVALID")
+
+	// nonce is rejected
+	rr = postLogoutToken(jwt.MapClaims{"sid": "sid-1", "jti": "jti-2", "events": events, "nonce": "n"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// jti is required
+	rr = postLogoutToken(jwt.MapClaims{"sid": "sid-1", "events": events})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "jti")
+
+	// expired token and token issued in the future are rejected
+	now := time.Now()
+	rr = postLogoutToken(jwt.MapClaims{"sid": "sid-1", "jti": "jti-3", "events": events,
+		"iat": now.Add(-time.Hour).Unix(), "exp": now.Add(-10 * time.Minute).Unix()})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "expired")
+	rr = postLogoutToken(jwt.MapClaims{"sid": "sid-1", "jti": "jti-4", "events": events, "iat": now.Add(time.Hour).Unix()})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "iat")
+
+	// a token issued before the login does not end it
+	rr = postLogoutToken(jwt.MapClaims{"sid": "sid-1", "jti": "jti-5", "events": events, "iat": now.Add(-10 * time.Second).Unix()})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, withCookies(httptest.NewRequest(http.MethodGet, "/app", nil), cookies))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// other session is not affected
+	rr = postLogoutToken(jwt.MapClaims{"sid": "sid-2", "jti": "jti-6", "events": events})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, withCookies(httptest.NewRequest(http.MethodGet, "/app", nil), cookies))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// a token is accepted once
+	rr = postLogoutToken(jwt.MapClaims{"sid": "sid-1", "jti": "jti-6", "events": events})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "already used")
+
+	rr = postLogoutToken(jwt.MapClaims{"sid": "sid-1", "jti": "jti-7", "events": events})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, withCookies(httptest.NewRequest(http.MethodGet, "/app", nil), cookies))
+	assert.Equal(t, http.StatusTemporaryRedirect, rr.Code)
+}
+
+func TestOidcRevocations(t *testing.T) {
+	r := newOidcRevocations()
+	now := time.Now()
+	r.revoke("", "user-1", now)
+
+	s := sessions.NewSession(nil, "user")
+	s.Values["sub"] = "user-1"
+	s.Values["login_at"] = now.Add(-time.Minute).UnixNano()
+	assert.True(t, r.isRevoked(s))
+
+	// logged in again after the revocation
+	s.Values["login_at"] = now.Add(time.Minute).UnixNano()
+	assert.False(t, r.isRevoked(s))
+
+	// revocations older than the session max age and expired token ids are pruned
+	assert.True(t, r.remember("jti-1", now.Add(time.Minute)))
+	assert.False(t, r.remember("jti-1", now.Add(time.Minute)))
+	r.revoke("sid-1", "", now.Add(-r.maxAge-time.Hour))
+	r.lastPrune = time.Time{}
+	r.prune(now.Add(2 * time.Minute))
+	assert.Contains(t, r.bySub, "user-1")
+	assert.NotContains(t, r.bySid, "sid-1")
+	assert.Empty(t, r.jtis)
+}
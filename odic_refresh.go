@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+)
+
+// defaultRefreshLeeway is how long before expiry the access token will be refreshed
+const defaultRefreshLeeway = time.Minute
+
+// sessionToken restores the oauth2 token persisted in session
+func sessionToken(s *sessions.Session) *oauth2.Token {
+	token := &oauth2.Token{}
+	token.AccessToken, _ = s.Values["token"].(string)
+	token.RefreshToken, _ = s.Values["refresh_token"].(string)
+	if expiry, ok := s.Values["token_expiry"].(int64); ok && expiry > 0 {
+		token.Expiry = time.Unix(expiry, 0)
+	}
+	return token
+}
+
+// saveSessionToken persists the oauth2 token into session
+func saveSessionToken(s *sessions.Session, token *oauth2.Token) {
+	s.Values["token"] = token.AccessToken
+	if len(token.RefreshToken) > 0 {
+		s.Values["refresh_token"] = token.RefreshToken
+	}
+	if token.Expiry.IsZero() {
+		delete(s.Values, "token_expiry")
+	} else {
+		s.Values["token_expiry"] = token.Expiry.Unix()
+	}
+	if idToken, ok := token.Extra("id_token").(string); ok && len(idToken) > 0 {
+		s.Values["id_token"] = idToken
+	}
+}
+
+// refreshTokenIfNeeded refreshes the session token with the refresh_token grant when
+// it is about to expire, returns false when the token is expired and can not be refreshed
+func (m *OidcMiddleware) refreshTokenIfNeeded(s *sessions.Session, r *http.Request, w http.ResponseWriter) bool {
+	token := sessionToken(s)
+	if token.Expiry.IsZero() || time.Until(token.Expiry) > m.refreshLeeway {
+		return true
+	}
+	if len(token.RefreshToken) == 0 {
+		return false
+	}
+
+	// let the token source consider the token expired already
+	token.Expiry = time.Now().Add(-time.Second)
+	ctx, span := startSpan(r.Context(), "oidc.refresh", trace.WithSpanKind(trace.SpanKindClient))
+	refreshed, err := m.conf.TokenSource(ctx, token).Token()
+	endSpan(span, err)
+	if err != nil {
+		log.Printf("refresh oidc token failed %s", err)
+		return false
+	}
+
+	if rawIDToken, ok := refreshed.Extra("id_token").(string); ok && len(rawIDToken) > 0 {
+		if _, err := m.VerifyIDToken(r.Context(), refreshed); err != nil {
+			log.Printf("verify refreshed id token failed %s", err)
+			return false
+		}
+	}
+
+	saveSessionToken(s, refreshed)
+	if err := s.Save(r, w); err != nil {
+		log.Printf("save refreshed session failed %s", err)
+		return false
+	}
+	return true
+}
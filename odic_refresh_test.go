@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOidcMiddleware_RefreshToken(t *testing.T) {
+	p := newMockOidcProvider(t)
+	// token expires within the refresh leeway
+	p.expiresIn = 30
+	m := newMockOidcMiddleware(t, p)
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cookies := oidcLogin(t, p, handler)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, withCookies(httptest.NewRequest(http.MethodGet, "/app", nil), cookies))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 1, p.refreshCount)
+	assert.Equal(t, "refresh-token", p.lastTokenForm.Get("refresh_token"))
+	// refreshed session is written back
+	assert.NotEmpty(t, rr.Result().Cookies())
+}
+
+func TestOidcMiddleware_RefreshTokenNotNeeded(t *testing.T) {
+	p := newMockOidcProvider(t)
+	m := newMockOidcMiddleware(t, p)
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cookies := oidcLogin(t, p, handler)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, withCookies(httptest.NewRequest(http.MethodGet, "/app", nil), cookies))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 0, p.refreshCount)
+}
+
+func TestOidcMiddleware_RefreshTokenFailed(t *testing.T) {
+	p := newMockOidcProvider(t)
+	p.expiresIn = 30
+	p.failRefresh = true
+	m := newMockOidcMiddleware(t, p)
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cookies := oidcLogin(t, p, handler)
+
+	// failed refresh forces a new login
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, withCookies(httptest.NewRequest(http.MethodGet, "/app", nil), cookies))
+	assert.Equal(t, http.StatusTemporaryRedirect, rr.Code)
+	assert.Equal(t, 1, p.refreshCount)
+}
@@ -2,12 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
 )
@@ -16,7 +24,7 @@ func TestNewOdicMiddleware(t *testing.T) {
 	// Test when ODIC_CLIENT_ID and ODIC_CLIENT_SECRET are not set
 	t.Setenv("ODIC_CLIENT_ID", "")
 	t.Setenv("ODIC_CLIENT_SECRET", "")
-	m := NewOdicMiddleware()
+	m := must(NewOdicMiddleware())
 	if m.enabled {
 		t.Errorf("Expected enabled to be false, but got true")
 	}
@@ -24,7 +32,7 @@ func TestNewOdicMiddleware(t *testing.T) {
 	// Test when ODIC_CLIENT_ID and ODIC_CLIENT_SECRET are set
 	t.Setenv("ODIC_CLIENT_ID", "client_id")
 	t.Setenv("ODIC_CLIENT_SECRET", "client_secret")
-	m = NewOdicMiddleware()
+	m = must(NewOdicMiddleware())
 	if !m.enabled {
 		t.Errorf("Expected enabled to be true, but got false")
 	}
@@ -97,7 +105,7 @@ func TestEnabled(t *testing.T) {
 	// Test when ODIC_CLIENT_ID and ODIC_CLIENT_SECRET are set
 	t.Setenv("ODIC_CLIENT_ID", "client_id")
 	t.Setenv("ODIC_CLIENT_SECRET", "client_secret")
-	m = NewOdicMiddleware()
+	m = must(NewOdicMiddleware())
 	if !m.Enabled() {
 		t.Errorf("Expected Enabled to be true, but got false")
 	}
@@ -165,7 +173,7 @@ func TestHandler(t *testing.T) {
 
 func TestOidcMiddleware_handleCallback(t *testing.T) {
 	// create a new OidcMiddleware instance
-	m := NewOdicMiddleware()
+	m := must(NewOdicMiddleware())
 
 	// create a new session
 	s := sessions.NewSession(nil, "user")
@@ -190,7 +198,7 @@ func TestOidcMiddleware_handleCallback(t *testing.T) {
 
 func TestOidcMiddleware_HandleCallback_AuthFailed(t *testing.T) {
 	// Create a new OidcMiddleware instance
-	m := NewOdicMiddleware()
+	m := must(NewOdicMiddleware())
 
 	// Create a new HTTP request with a query parameter that will cause the auth to fail
 	req, err := http.NewRequest("GET", "/_/oidc/callback?code=invalid_code&state=111", nil)
@@ -217,3 +225,262 @@ func TestOidcMiddleware_HandleCallback_AuthFailed(t *testing.T) {
 
 	// Check that the response body contains the expected error message and code
 }
+
+// mockOidcProvider is a local OpenID provider used to exercise the middleware
+// without reaching a real identity provider
+type mockOidcProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// lastTokenForm is the form posted to the token endpoint by the last exchange
+	lastTokenForm url.Values
+	// lastRevokeForm is the form posted to the revocation endpoint
+	lastRevokeForm url.Values
+	// idTokenClaims are merged into every id_token issued by the token endpoint
+	idTokenClaims jwt.MapClaims
+	// expiresIn is the lifetime in seconds of issued access tokens
+	expiresIn int
+	// failRefresh rejects the refresh_token grant
+	failRefresh bool
+	// refreshCount counts the refresh_token grants
+	refreshCount int
+	// codeChallenge is the PKCE challenge of the pending authorization
+	codeChallenge string
+}
+
+func newMockOidcProvider(t *testing.T) *mockOidcProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate rsa key: %v", err)
+	}
+	p := &mockOidcProvider{key: key, idTokenClaims: jwt.MapClaims{}, expiresIn: 3600}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := p.server.URL
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer,
+			"authorization_endpoint":                issuer + "/authorize",
+			"token_endpoint":                        issuer + "/token",
+			"jwks_uri":                              issuer + "/jwks",
+			"end_session_endpoint":                  issuer + "/logout",
+			"revocation_endpoint":                   issuer + "/revoke",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.lastTokenForm = r.PostForm
+		if r.PostForm.Get("grant_type") == "authorization_code" &&
+			oauth2.S256ChallengeFromVerifier(r.PostForm.Get("code_verifier")) != p.codeChallenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		if r.PostForm.Get("grant_type") == "refresh_token" {
+			p.refreshCount++
+			if p.failRefresh {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+		}
+		claims := jwt.MapClaims{"sub": "user-1", "name": "Test User", "email": "user@example.com", "sid": "sid-1"}
+		for k, v := range p.idTokenClaims {
+			claims[k] = v
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "access-token-" + r.PostForm.Get("grant_type"),
+			"token_type":    "Bearer",
+			"expires_in":    p.expiresIn,
+			"refresh_token": "refresh-token",
+			"id_token":      p.signToken(t, claims),
+		})
+	})
+	mux.HandleFunc("/revoke", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.lastRevokeForm = r.PostForm
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// signToken signs claims with the provider key, filling the standard issuer,
+// audience and lifetime claims when they are absent
+func (p *mockOidcProvider) signToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	now := time.Now()
+	defaults := jwt.MapClaims{
+		"iss": p.server.URL,
+		"aud": "client_id",
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for k, v := range defaults {
+		if _, ok := claims[k]; !ok {
+			claims[k] = v
+		}
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+// newMockOidcMiddleware creates a middleware bound to the mock provider
+func newMockOidcMiddleware(t *testing.T, p *mockOidcProvider) *OidcMiddleware {
+	t.Helper()
+	t.Setenv("ODIC_ISSUER", p.server.URL)
+	t.Setenv("ODIC_CLIENT_ID", "client_id")
+	t.Setenv("ODIC_CLIENT_SECRET", "client_secret")
+	t.Setenv("ODIC_CALLBACK_URL", "http://localhost:8080/_/oidc/callback")
+	t.Setenv("ODIC_SESSION_SECRET", "session_secret")
+	m := must(NewOdicMiddleware())
+	m.revocations = newOidcRevocations()
+	return m
+}
+
+// oidcLogin drives a full login through the handler and returns the session cookies
+func oidcLogin(t *testing.T, p *mockOidcProvider, handler http.Handler) []*http.Cookie {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/app", nil)
+	req.Header.Set("Accept", "text/html")
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("Expected redirect to provider, but got %d", rr.Code)
+	}
+	authURL, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Failed to parse authorize url: %v", err)
+	}
+	cookies := rr.Result().Cookies()
+	p.codeChallenge = authURL.Query().Get("code_challenge")
+	if _, ok := p.idTokenClaims["nonce"]; !ok {
+		p.idTokenClaims["nonce"] = authURL.Query().Get("nonce")
+	}
+
+	req = httptest.NewRequest(
+		http.MethodGet,
+		"/_/oidc/callback?code=code&state="+authURL.Query().Get("state"),
+		nil,
+	)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("Expected redirect after callback, but got %d: %s", rr.Code, rr.Body.String())
+	}
+	return rr.Result().Cookies()
+}
+
+func withCookies(req *http.Request, cookies []*http.Cookie) *http.Request {
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestOidcMiddleware_Login(t *testing.T) {
+	p := newMockOidcProvider(t)
+	m := newMockOidcMiddleware(t, p)
+	var identity *Identity
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = identityFromContext(r.Context())
+	}))
+
+	cookies := oidcLogin(t, p, handler)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, withCookies(httptest.NewRequest(http.MethodGet, "/app", nil), cookies))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
+	}
+	if identity.Subject != "user-1" || identity.Name != "Test User" || identity.AuthMethod != "oidc" {
+		t.Errorf("Expected identity of user-1 authenticated by oidc, but got %+v", identity)
+	}
+}
+
+func TestOidcMiddleware_PKCEAndNonce(t *testing.T) {
+	p := newMockOidcProvider(t)
+	m := newMockOidcMiddleware(t, p)
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/app", nil))
+	authURL, _ := url.Parse(rr.Header().Get("Location"))
+	if authURL.Query().Get("code_challenge_method") != "S256" {
+		t.Errorf("Expected S256 code challenge, but got %q", authURL.Query().Get("code_challenge_method"))
+	}
+	if authURL.Query().Get("code_challenge") == "" || authURL.Query().Get("nonce") == "" {
+		t.Errorf("Expected code_challenge and nonce in authorize url, but got %s", authURL)
+	}
+
+	oidcLogin(t, p, handler)
+	if p.lastTokenForm.Get("code_verifier") == "" {
+		t.Errorf("Expected code_verifier sent to token endpoint")
+	}
+}
+
+func TestOidcMiddleware_NonceMismatch(t *testing.T) {
+	p := newMockOidcProvider(t)
+	p.idTokenClaims["nonce"] = "replayed"
+	m := newMockOidcMiddleware(t, p)
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/app", nil))
+	authURL, _ := url.Parse(rr.Header().Get("Location"))
+	p.codeChallenge = authURL.Query().Get("code_challenge")
+
+	req := withCookies(
+		httptest.NewRequest(http.MethodGet, "/_/oidc/callback?code=code&state="+authURL.Query().Get("state"), nil),
+		rr.Result().Cookies(),
+	)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d, but got %d", http.StatusUnauthorized, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "ERR_OIDC_NONCE_MISMATCH") {
+		t.Errorf("Expected ERR_OIDC_NONCE_MISMATCH, but got %s", rr.Body.String())
+	}
+}
+
+func TestOidcMiddleware_PublicClient(t *testing.T) {
+	p := newMockOidcProvider(t)
+	newMockOidcMiddleware(t, p)
+	t.Setenv("ODIC_CLIENT_SECRET", "")
+	m := must(NewOdicMiddleware())
+	if !m.Enabled() {
+		t.Fatalf("Expected public client to be enabled")
+	}
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	oidcLogin(t, p, handler)
+	if p.lastTokenForm.Get("client_id") != "client_id" {
+		t.Errorf("Expected client_id sent in token request, but got %q", p.lastTokenForm.Get("client_id"))
+	}
+}
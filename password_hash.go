@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2Hash is a hash in PHC string format, like
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+type argon2Hash struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || (parts[1] != "argon2id" && parts[1] != "argon2i") {
+		return nil, errors.New("invalid argon2 hash")
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, fmt.Errorf("argon2 %s is not supported", parts[2])
+	}
+	h := &argon2Hash{variant: parts[1]}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2 parameters %q", parts[3])
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.New("invalid argon2 salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, errors.New("invalid argon2 key")
+	}
+	return h, nil
+}
+
+func (h *argon2Hash) matches(password string) bool {
+	var key []byte
+	if h.variant == "argon2id" {
+		key = argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		key = argon2.Key([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// validatePasswordHash accepts bcrypt ($2a$, $2b$, $2y$) and argon2 (argon2id, argon2i) hashes
+func validatePasswordHash(username string, hash string) error {
+	if strings.HasPrefix(hash, "$argon2") {
+		if _, err := parseArgon2Hash(hash); err != nil {
+			return fmt.Errorf("password of %s: %w", username, err)
+		}
+		return nil
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("password of %s is not a bcrypt or argon2 hash", username)
+	}
+	return nil
+}
+
+// verifyPasswordHash reports the password matches the hash
+func verifyPasswordHash(hash string, password string) bool {
+	if strings.HasPrefix(hash, "$argon2") {
+		h, err := parseArgon2Hash(hash)
+		return err == nil && h.matches(password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
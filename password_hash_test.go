@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+)
+
+func testArgon2Hash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 64, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestVerifyPasswordHash(t *testing.T) {
+	for name, hash := range map[string]string{
+		"bcrypt": testPasswordHash(t, "secret"),
+		"argon2": testArgon2Hash("secret"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, validatePasswordHash("alice", hash))
+			assert.True(t, verifyPasswordHash(hash, "secret"))
+			assert.False(t, verifyPasswordHash(hash, "wrong"))
+		})
+	}
+
+	assert.Error(t, validatePasswordHash("alice", "secret"))
+	assert.Error(t, validatePasswordHash("alice", "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5"))
+	assert.Error(t, validatePasswordHash("alice", "$argon2id$v=19$m=64$c2FsdA$a2V5"))
+}
@@ -1,38 +1,86 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
-	"os"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func createRewriter() func(pr *httputil.ProxyRequest) {
-	upstream := os.Getenv("UPSTREAM")
-	if len(upstream) == 0 {
-		log.Fatal("must provide upstream!")
-	}
-	u, err := url.Parse(upstream)
-	if err != nil {
-		log.Fatalf("parse upstream url failed %s", err)
-	}
-	log.Printf("upstream endpoint %s", upstream)
+// createRouteRewriter creates the rewriter forwarding requests to upstream of route
+func createRouteRewriter(route *Route) func(pr *httputil.ProxyRequest) {
+	log.Printf("upstream endpoint %s%s -> %s", route.Host, route.PathPrefix, route.upstreamURLs)
 
 	rewriteSteps := []func(pr *httputil.ProxyRequest){}
 
 	rewriteSteps = append(rewriteSteps, func(pr *httputil.ProxyRequest) {
+		u := route.upstreamURLs[0]
+		if target := upstreamTargetFromContext(pr.In.Context()); target != nil {
+			u = target.url
+		}
+		route.rewritePath(pr.Out.URL)
 		pr.SetURL(u)
 	})
-	// TODO: only jwt/auth enabled ?
+
+	// >> prepare identity forwarding, claim name -> header name
+	forwardClaims := map[string]string{}
+	for _, v := range environ() {
+		parts := strings.SplitN(v, "=", 2)
+		if strings.HasPrefix(parts[0], "FORWARD_CLAIM_") && len(parts[1]) > 0 {
+			forwardClaims[strings.TrimPrefix(parts[0], "FORWARD_CLAIM_")] = parts[1]
+		}
+	}
+
 	rewriteSteps = append(rewriteSteps, func(pr *httputil.ProxyRequest) {
-		userSubject := pr.In.Context().Value("X-User-Subject")
-		if userSubject != nil {
-			pr.Out.Header.Set("X-User-Subject", userSubject.(string))
+		// never trust identity headers sent by client
+		pr.Out.Header.Del("X-User-Subject")
+		for _, header := range forwardClaims {
+			pr.Out.Header.Del(header)
 		}
+		identity := identityFromContext(pr.In.Context())
+		if identity == nil {
+			return
+		}
+		if len(identity.Subject) > 0 {
+			pr.Out.Header.Set("X-User-Subject", identity.Subject)
+		}
+		for claim, header := range forwardClaims {
+			value := formatClaim(lookupClaim(identity.Claims, claim))
+			if claim == "groups" && len(identity.Groups) > 0 {
+				value = strings.Join(identity.Groups, ",")
+			}
+			if len(value) > 0 {
+				pr.Out.Header.Set(header, value)
+			}
+		}
+	})
+	requestIDHeader := requestIDHeader()
+	rewriteSteps = append(rewriteSteps, func(pr *httputil.ProxyRequest) {
+		if id := requestIDFromContext(pr.In.Context()); len(id) > 0 {
+			pr.Out.Header.Set(requestIDHeader, id)
+		}
+		// the upstream span is the parent of spans of upstream
+		injectTraceContext(pr.In.Context(), pr.Out.Header)
 	})
-	if os.Getenv("APPEND_FORWARD_HEADERS") != "false" {
+	if clientCertHeader := getenv("CLIENT_CERT_HEADER"); len(clientCertHeader) > 0 {
+		format := getenv("CLIENT_CERT_HEADER_FORMAT")
+		rewriteSteps = append(rewriteSteps, func(pr *httputil.ProxyRequest) {
+			// never trust certificate header sent by client
+			pr.Out.Header.Del(clientCertHeader)
+			if cert := clientCertificate(pr.In); cert != nil {
+				pr.Out.Header.Set(clientCertHeader, formatClientCertificate(cert, format))
+			}
+		})
+	}
+	if getenv("APPEND_FORWARD_HEADERS") != "false" {
 		rewriteSteps = append(rewriteSteps, func(pr *httputil.ProxyRequest) {
 			pr.SetXForwarded()
 		})
@@ -42,7 +90,7 @@ func createRewriter() func(pr *httputil.ProxyRequest) {
 	delReqHeaders := []string{}
 	setReqHeaders := map[string]string{}
 
-	for _, v := range os.Environ() {
+	for _, v := range environ() {
 		parts := strings.SplitN(v, "=", 2)
 		key := parts[0]
 		value := parts[1]
@@ -83,7 +131,14 @@ func createModifier() func(r *http.Response) error {
 	delResHeaders := []string{}
 	setResHeaders := map[string]string{}
 
-	for _, v := range os.Environ() {
+	// the id is echoed by RequestIDMiddleware, a copy from upstream would duplicate it
+	requestIDHeader := requestIDHeader()
+	modifierSteps = append(modifierSteps, func(r *http.Response) error {
+		r.Header.Del(requestIDHeader)
+		return nil
+	})
+
+	for _, v := range environ() {
 		parts := strings.SplitN(v, "=", 2)
 		key := parts[0]
 		value := parts[1]
@@ -123,10 +178,144 @@ func createModifier() func(r *http.Response) error {
 	}
 }
 
-func createProxyHandler() http.Handler {
-	rp := &httputil.ReverseProxy{
-		Rewrite:        createRewriter(),
-		ModifyResponse: createModifier(),
+// proxyHandler forwards requests to an upstream instance of the route matched
+type proxyHandler struct {
+	proxies  map[*Route]http.Handler
+	pools    map[*Route]*upstreamPool
+	breakers map[*Route]*circuitBreaker
+}
+
+func createProxyHandler(routes []*Route) *proxyHandler {
+	modifier := createModifier()
+	h := &proxyHandler{
+		proxies:  map[*Route]http.Handler{},
+		pools:    map[*Route]*upstreamPool{},
+		breakers: map[*Route]*circuitBreaker{},
+	}
+	for _, route := range routes {
+		pool := newUpstreamPool(route.upstreamURLs, route.balancer)
+		pool.startHealthChecks(route.transport)
+		h.pools[route] = pool
+		h.breakers[route] = newCircuitBreaker(route.Host+route.PathPrefix, route.balancer.breakerThreshold, route.balancer.breakerTimeout)
+		h.proxies[route] = &httputil.ReverseProxy{
+			Rewrite:   createRouteRewriter(route),
+			Transport: route.transport,
+			ModifyResponse: func(r *http.Response) error {
+				attempt := proxyAttemptFromContext(r.Request.Context())
+				attempt.status = r.StatusCode
+				// 500 is an error of the application, the target itself works
+				attempt.failed = retryableStatus(r.StatusCode)
+				pool.report(attempt.target, attempt.failed)
+				if attempt.retryable && retryableStatus(r.StatusCode) {
+					attempt.retry = true
+					return errRetryableResponse
+				}
+				return modifier(r)
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				attempt := proxyAttemptFromContext(r.Context())
+				if attempt.retry {
+					return
+				}
+				if r.Context().Err() != nil {
+					// the client went away or timed out, not a failure of upstream
+					attempt.canceled = true
+					flushUpstreamError(w, r.Context().Err())
+					return
+				}
+				attempt.failed = true
+				pool.report(attempt.target, true)
+				if attempt.retryable {
+					attempt.retry = true
+					return
+				}
+				log.Printf("proxy to upstream %s failed: %s", attempt.target.url.Redacted(), err)
+				flushUpstreamError(w, err)
+			},
+		}
+	}
+	return h
+}
+
+func (h *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := routeFromContext(r.Context())
+	if route == nil {
+		flushJsonErrorResponse(w, "no route matches the request", "ROUTE_NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	breaker := h.breakers[route]
+	allowed, trial := breaker.allow()
+	if !allowed {
+		upstreamErrorsTotal.WithLabelValues(routeLabel(route), "", "circuit_open").Inc()
+		flushJsonErrorResponse(w, "circuit breaker of upstream is open", "UPSTREAM_UNAVAILABLE", http.StatusServiceUnavailable)
+		return
+	}
+	recorded := false
+	record := func(failed bool) {
+		recorded = true
+		breaker.record(failed, trial)
+	}
+	// a trial canceled or panicked must not keep the circuit half-open forever
+	defer func() {
+		if !recorded {
+			breaker.release(trial)
+		}
+	}()
+	attempts, body := retryAttempts(r, route.balancer)
+	for i := 1; i <= attempts; i++ {
+		if i > 1 && !retryBackoff(r.Context(), route.balancer.retryBackoff, i-1) {
+			flushUpstreamError(w, r.Context().Err())
+			return
+		}
+		target := h.pools[route].pick(r)
+		if target == nil {
+			record(true)
+			upstreamErrorsTotal.WithLabelValues(routeLabel(route), "", "no_upstream").Inc()
+			flushJsonErrorResponse(w, "no upstream is available", "UPSTREAM_UNAVAILABLE", http.StatusServiceUnavailable)
+			return
+		}
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		attempt := &proxyAttempt{target: target, retryable: i < attempts}
+		if record := accessLogFromContext(r.Context()); record != nil {
+			record.upstream = target.url.Redacted()
+		}
+		ctx, span := startSpan(r.Context(), "upstream "+methodLabel(r.Method),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.HTTPRoute(routeLabel(route)),
+				semconv.ServerAddress(target.url.Host),
+				semconv.HTTPRequestResendCount(i-1),
+			),
+		)
+		target.inflight.Add(1)
+		start := time.Now()
+		h.proxies[route].ServeHTTP(w, r.WithContext(context.WithValue(ctx, proxyAttemptContextKey{}, attempt)))
+		recordUpstreamAttempt(route, attempt, time.Since(start))
+		target.inflight.Add(-1)
+		if attempt.status > 0 {
+			span.SetAttributes(semconv.HTTPResponseStatusCode(attempt.status))
+		}
+		if attempt.failed {
+			span.SetStatus(codes.Error, "upstream failed")
+		}
+		span.End()
+		if attempt.canceled {
+			return
+		}
+		if !attempt.retry {
+			record(attempt.failed)
+			return
+		}
+	}
+}
+
+// Close stops the health checks of upstream pools and closes idle connections
+func (h *proxyHandler) Close() error {
+	for route, pool := range h.pools {
+		pool.Close()
+		route.transport.CloseIdleConnections()
 	}
-	return http.HandlerFunc(rp.ServeHTTP)
+	return nil
 }
@@ -1,13 +1,25 @@
 package main
 
 import (
-	"context"
 	"net/http"
+	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
+// newTestRewriter creates the rewriter of the single route of UPSTREAM
+func newTestRewriter(t *testing.T) func(pr *httputil.ProxyRequest) {
+	t.Helper()
+	routes, err := loadRouteSettings()
+	if !assert.NoError(t, err) || !assert.Len(t, routes, 1) {
+		t.FailNow()
+	}
+	return createRouteRewriter(routes[0])
+}
+
 func TestCreateRewriter(t *testing.T) {
 	// Set up environment variables
 	t.Setenv("UPSTREAM", "http://example.com")
@@ -15,8 +27,8 @@ func TestCreateRewriter(t *testing.T) {
 	t.Setenv("DELETE_REQ_HEADERS_FOO", "true")
 	t.Setenv("APPEND_REQ_HEADERS_BAR", "baz")
 
-	// Call createRewriter function
-	rewriter := createRewriter()
+	// Call createRouteRewriter function
+	rewriter := newTestRewriter(t)
 
 	// Create a mock ProxyRequest
 	req, err := http.NewRequest("GET", "http://example.com", nil)
@@ -24,8 +36,7 @@ func TestCreateRewriter(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.RemoteAddr = "localhost:8080"
-	ctx := context.WithValue(req.Context(), "X-User-Subject", "user123")
-	req = req.WithContext(ctx)
+	req = withIdentity(req, newIdentity("jwt", map[string]interface{}{"sub": "user123"}))
 
 	pr := &httputil.ProxyRequest{
 		In:  req,
@@ -104,3 +115,41 @@ func TestCreateModifier(t *testing.T) {
 		t.Errorf("Expected header Bar to be set to baz, but got %s", resp.Header.Get("Bar"))
 	}
 }
+
+func TestCreateRewriter_ForwardClaims(t *testing.T) {
+	t.Setenv("UPSTREAM", "http://example.com")
+	t.Setenv("FORWARD_CLAIM_email", "X-User-Email")
+	t.Setenv("FORWARD_CLAIM_groups", "X-User-Groups")
+	t.Setenv("FORWARD_CLAIM_tenant.id", "X-User-Tenant")
+
+	rewriter := newTestRewriter(t)
+
+	newProxyRequest := func(req *http.Request) *httputil.ProxyRequest {
+		out := req.Clone(req.Context())
+		return &httputil.ProxyRequest{In: req, Out: out}
+	}
+
+	// spoofed headers of anonymous request are stripped
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("X-User-Subject", "admin")
+	req.Header.Set("X-User-Email", "admin@example.com")
+	pr := newProxyRequest(req)
+	rewriter(pr)
+	assert.Empty(t, pr.Out.Header.Get("X-User-Subject"))
+	assert.Empty(t, pr.Out.Header.Get("X-User-Email"))
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("X-User-Email", "admin@example.com")
+	req = withIdentity(req, newIdentity("oidc", map[string]interface{}{
+		"sub":    "user-1",
+		"email":  "user@example.com",
+		"groups": []interface{}{"dev", "ops"},
+		"tenant": map[string]interface{}{"id": "t1"},
+	}))
+	pr = newProxyRequest(req)
+	rewriter(pr)
+	assert.Equal(t, "user-1", pr.Out.Header.Get("X-User-Subject"))
+	assert.Equal(t, "user@example.com", pr.Out.Header.Get("X-User-Email"))
+	assert.Equal(t, "dev,ops", pr.Out.Header.Get("X-User-Groups"))
+	assert.Equal(t, "t1", pr.Out.Header.Get("X-User-Tenant"))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ulule/limiter/v3"
+	"github.com/ulule/limiter/v3/drivers/store/common"
+	memory "github.com/ulule/limiter/v3/drivers/store/memory"
+)
+
+// sharedMemoryRateLimitStore keeps the in-memory counters across the rebuild of
+// middlewares on config reload, a reload does not reset the budget of clients
+var sharedMemoryRateLimitStore limiter.Store = memory.NewStore()
+
+// newRateLimitStore creates the store selected by RATE_LIMIT_STORE, memory (default)
+// or redis shared by the replicas
+func newRateLimitStore() (limiter.Store, error) {
+	switch kind := getenv("RATE_LIMIT_STORE"); kind {
+	case "", "memory":
+		return sharedMemoryRateLimitStore, nil
+	case "redis":
+		client, err := sharedRedisClient(getenv("RATE_LIMIT_STORE_REDIS_URL"))
+		if err != nil {
+			return nil, err
+		}
+		return &redisRateLimitStore{client: client, prefix: "secure-app-proxy:ratelimit:"}, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", kind)
+	}
+}
+
+// redisRateLimitStore counts requests in fixed windows, a counter expires with its window
+type redisRateLimitStore struct {
+	client *redisClient
+	prefix string
+}
+
+func (st *redisRateLimitStore) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return st.Increment(ctx, key, 1, rate)
+}
+
+func (st *redisRateLimitStore) Increment(ctx context.Context, key string, count int64, rate limiter.Rate) (limiter.Context, error) {
+	now := time.Now()
+	key = st.prefix + key
+	value, err := st.client.Int(ctx, "INCRBY", key, strconv.FormatInt(count, 10))
+	if err != nil {
+		return limiter.Context{}, err
+	}
+	ttl, err := st.client.Int(ctx, "PTTL", key)
+	if err != nil {
+		return limiter.Context{}, err
+	}
+	// the first request of window starts it, a counter left without expiry is fixed too
+	if ttl < 0 {
+		ttl = rate.Period.Milliseconds()
+		if _, err := st.client.Int(ctx, "PEXPIRE", key, strconv.FormatInt(ttl, 10)); err != nil {
+			return limiter.Context{}, err
+		}
+	}
+	return common.GetContextFromState(now, rate, now.Add(time.Duration(ttl)*time.Millisecond), value), nil
+}
+
+func (st *redisRateLimitStore) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	now := time.Now()
+	key = st.prefix + key
+	value, err := st.client.Int(ctx, "GET", key)
+	if errors.Is(err, errRedisNil) {
+		return common.GetContextFromState(now, rate, now.Add(rate.Period), 0), nil
+	}
+	if err != nil {
+		return limiter.Context{}, err
+	}
+	ttl, err := st.client.Int(ctx, "PTTL", key)
+	if err != nil {
+		return limiter.Context{}, err
+	}
+	if ttl < 0 {
+		ttl = rate.Period.Milliseconds()
+	}
+	return common.GetContextFromState(now, rate, now.Add(time.Duration(ttl)*time.Millisecond), value), nil
+}
+
+func (st *redisRateLimitStore) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	now := time.Now()
+	if _, err := st.client.Int(ctx, "DEL", st.prefix+key); err != nil {
+		return limiter.Context{}, err
+	}
+	return common.GetContextFromState(now, rate, now.Add(rate.Period), 0), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulule/limiter/v3"
+	memory "github.com/ulule/limiter/v3/drivers/store/memory"
+)
+
+func TestRedisRateLimitStore(t *testing.T) {
+	redis := newFakeRedisServer(t, "")
+	t.Setenv("RATE_LIMIT_STORE", "redis")
+	t.Setenv("RATE_LIMIT_STORE_REDIS_URL", redis.URL())
+	store, err := newRateLimitStore()
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	rate := limiter.Rate{Period: time.Minute, Limit: 2}
+
+	for i, remaining := range []int64{1, 0} {
+		result, err := store.Get(ctx, "ip:1.2.3.4", rate)
+		if assert.NoError(t, err) {
+			assert.Equal(t, remaining, result.Remaining, i)
+			assert.False(t, result.Reached)
+			assert.InDelta(t, time.Now().Add(time.Minute).Unix(), result.Reset, 2)
+		}
+	}
+	result, _ := store.Get(ctx, "ip:1.2.3.4", rate)
+	assert.True(t, result.Reached)
+
+	// replicas share the counters
+	other, _ := newRateLimitStore()
+	result, _ = other.Peek(ctx, "ip:1.2.3.4", rate)
+	assert.Equal(t, int64(0), result.Remaining)
+	result, _ = other.Peek(ctx, "ip:5.6.7.8", rate)
+	assert.Equal(t, int64(2), result.Remaining)
+
+	result, err = store.Reset(ctx, "ip:1.2.3.4", rate)
+	assert.NoError(t, err)
+	result, _ = store.Get(ctx, "ip:1.2.3.4", rate)
+	assert.Equal(t, int64(1), result.Remaining)
+}
+
+func TestRedisRateLimitStore_Expiry(t *testing.T) {
+	redis := newFakeRedisServer(t, "")
+	t.Setenv("RATE_LIMIT_STORE", "redis")
+	t.Setenv("RATE_LIMIT_STORE_REDIS_URL", redis.URL())
+	store, _ := newRateLimitStore()
+	rate := limiter.Rate{Period: 50 * time.Millisecond, Limit: 1}
+
+	store.Get(context.Background(), "k", rate)
+	result, _ := store.Get(context.Background(), "k", rate)
+	assert.True(t, result.Reached)
+	time.Sleep(60 * time.Millisecond)
+	result, _ = store.Get(context.Background(), "k", rate)
+	assert.False(t, result.Reached)
+}
+
+// isolateRateLimitStore gives the test its own in-memory counters
+func isolateRateLimitStore(t *testing.T) {
+	previous := sharedMemoryRateLimitStore
+	sharedMemoryRateLimitStore = memory.NewStore()
+	t.Cleanup(func() { sharedMemoryRateLimitStore = previous })
+}
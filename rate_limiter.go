@@ -1,39 +1,177 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/samber/lo"
 	"github.com/ulule/limiter/v3"
-	limiterMiddlewareHandler "github.com/ulule/limiter/v3/drivers/middleware/stdlib"
-	memory "github.com/ulule/limiter/v3/drivers/store/memory"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type RateLimiterMiddleware struct {
-	store   limiter.Store
+// rateLimitKeys are the accepted values of rate limit key besides header:<name>
+var rateLimitKeys = []string{"subject", "api_key", "ip"}
+
+// RateLimitConfig is the rate limit of a route, empty fields use the RATE_LIMIT_*
+// environment variables
+type RateLimitConfig struct {
+	// Rate is like 100-M, see https://github.com/ulule/limiter
+	Rate string `yaml:"rate" json:"rate"`
+	// Key counts requests by subject (default), api_key, ip or header:<name>, the
+	// client IP when the request has no such value
+	Key string `yaml:"key" json:"key"`
+	// Tiers are the rates of identities matching a claim rule, like
+	// "groups contains premium => 1000-M", the first matched tier wins
+	Tiers []string `yaml:"tiers" json:"tiers"`
+}
+
+// rateLimitTier is a rate applied to identities matching the claim rule
+type rateLimitTier struct {
+	matcher *claimMatcher
 	rate    limiter.Rate
-	enabled bool
 }
 
-func NewRateLimiterMiddleware() *RateLimiterMiddleware {
-	rateLimit := os.Getenv("RATE_LIMIT")
-	enabled := len(rateLimit) > 0
+type rateLimitSettings struct {
+	// scope separates the counters of routes having their own rate limit
+	scope string
+	rate  limiter.Rate
+	key   string
+	tiers []*rateLimitTier
+}
+
+func rateLimitConfigFromEnv() RateLimitConfig {
+	return RateLimitConfig{
+		Rate: getenv("RATE_LIMIT"),
+		Key:  getenv("RATE_LIMIT_KEY"),
+		Tiers: lo.Compact(lo.Map(strings.Split(getenv("RATE_LIMIT_TIERS"), ";"), func(v string, _ int) string {
+			return strings.TrimSpace(v)
+		})),
+	}
+}
+
+// merge fills the empty fields from defaults
+func (c RateLimitConfig) merge(defaults RateLimitConfig) RateLimitConfig {
+	merged := defaults
+	if len(c.Rate) > 0 {
+		merged.Rate = c.Rate
+	}
+	if len(c.Key) > 0 {
+		merged.Key = c.Key
+	}
+	if c.Tiers != nil {
+		merged.Tiers = c.Tiers
+	}
+	return merged
+}
+
+// parse validates the config, nil settings when no rate is set
+func (c RateLimitConfig) parse(scope string) (*rateLimitSettings, error) {
+	if len(c.Rate) == 0 {
+		return nil, nil
+	}
+	rate, err := limiter.NewRateFromFormatted(c.Rate)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid rate limit expression", c.Rate)
+	}
+	s := &rateLimitSettings{scope: scope, rate: rate, key: c.Key}
+	if len(s.key) == 0 {
+		s.key = "subject"
+	}
+	if !lo.Contains(rateLimitKeys, s.key) && !strings.HasPrefix(s.key, "header:") {
+		return nil, fmt.Errorf("unknown rate limit key %q", s.key)
+	}
+	for _, tier := range c.Tiers {
+		rule, value, found := strings.Cut(tier, "=>")
+		if !found {
+			return nil, fmt.Errorf("rate limit tier %q must be like <claim rule> => <rate>", tier)
+		}
+		matcher, err := parseClaimMatcher(rule)
+		if err != nil {
+			return nil, err
+		}
+		rate, err := limiter.NewRateFromFormatted(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid rate limit expression", strings.TrimSpace(value))
+		}
+		s.tiers = append(s.tiers, &rateLimitTier{matcher: matcher, rate: rate})
+	}
+	return s, nil
+}
+
+// limit returns the rate and counter key of request
+func (s *rateLimitSettings) limit(r *http.Request, proxies trustedProxies) (limiter.Rate, string) {
+	rate, scope := s.rate, s.scope
+	if identity := identityFromContext(r.Context()); identity != nil {
+		for i, tier := range s.tiers {
+			if tier.matcher.Match(identity.Claims) {
+				rate, scope = tier.rate, s.scope+":tier"+strconv.Itoa(i)
+				break
+			}
+		}
+	}
+	return rate, scope + ":" + requestKey(r, s.key, proxies)
+}
+
+// requestKey is the value of subject, api_key, ip or header:<name> key of request,
+// the client IP when the request has no such value
+func requestKey(r *http.Request, key string, proxies trustedProxies) string {
+	identity := identityFromContext(r.Context())
+	switch {
+	case key == "subject" && identity != nil && len(identity.Subject) > 0:
+		return identity.AuthMethod + ":" + identity.Subject
+	case key == "api_key" && identity != nil && identity.AuthMethod == "api_key":
+		if id, ok := identity.Claims["key_id"].(string); ok {
+			return "api_key:" + id
+		}
+	case strings.HasPrefix(key, "header:"):
+		if v := r.Header.Get(strings.TrimPrefix(key, "header:")); len(v) > 0 {
+			return key + ":" + v
+		}
+	}
+	return "ip:" + proxies.clientIP(r)
+}
+
+type RateLimiterMiddleware struct {
+	store    limiter.Store
+	settings *rateLimitSettings
+	proxies  trustedProxies
+	enabled  bool
+}
+
+// NewRateLimiterMiddleware limits by RATE_LIMIT, and the routes having their own rate limit
+func NewRateLimiterMiddleware(routes ...*Route) (*RateLimiterMiddleware, error) {
+	settings, err := rateLimitConfigFromEnv().parse("global")
+	if err != nil {
+		return nil, fmt.Errorf("rate limit is invalid: %w", err)
+	}
+	enabled := settings != nil || lo.ContainsBy(routes, func(route *Route) bool {
+		return route.rateLimit != nil
+	})
 	if !enabled {
 		return &RateLimiterMiddleware{
 			enabled: enabled,
-		}
+		}, nil
 	}
-	rate, error := limiter.NewRateFromFormatted(rateLimit)
-	if error != nil {
-		log.Fatalf("%s is not a valid rate limit expression", rateLimit)
+	proxies, err := parseTrustedProxies(getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES is invalid: %w", err)
 	}
-	store := memory.NewStore()
-	return &RateLimiterMiddleware{
-		store:   store,
-		rate:    rate,
-		enabled: enabled,
+	store, err := newRateLimitStore()
+	if err != nil {
+		return nil, fmt.Errorf("create rate limit store failed: %w", err)
 	}
+	return &RateLimiterMiddleware{
+		store:    store,
+		settings: settings,
+		proxies:  proxies,
+		enabled:  enabled,
+	}, nil
 }
 
 func (m *RateLimiterMiddleware) Name() string {
@@ -45,21 +183,78 @@ func (m *RateLimiterMiddleware) Enabled() bool {
 }
 
 func (m *RateLimiterMiddleware) Handler(next http.Handler) http.Handler {
-	middleware := limiterMiddlewareHandler.NewMiddleware(
-		limiter.New(
-			m.store,
-			m.rate,
-			limiter.WithTrustForwardHeader(true),
-		),
-		limiterMiddlewareHandler.WithLimitReachedHandler(
-			func(w http.ResponseWriter, r *http.Request) {
-				flushHttpResponseError(
-					w,
-					"Rate Limit Reached",
-					"RATE_LIMIT_REACH",
-				)
-			},
-		),
-	)
-	return middleware.Handler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings := m.settings
+		if route := routeFromContext(r.Context()); route != nil {
+			settings = route.rateLimit
+		}
+		if settings == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rate, key := settings.limit(r, m.proxies)
+		ctx, span := startSpan(r.Context(), "rate_limit.lookup", trace.WithAttributes(attribute.String("rate_limit.scope", settings.scope)))
+		result, err := limiter.New(m.store, rate).Get(ctx, key)
+		span.SetAttributes(attribute.Bool("rate_limit.reached", result.Reached), attribute.Int64("rate_limit.remaining", result.Remaining))
+		endSpan(span, err)
+		if err != nil {
+			// an unavailable store does not take the service down
+			log.Printf("rate limit store failed %s", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		resetAt := time.Unix(result.Reset, 0)
+		setRateLimitHeaders(w.Header(), rate, result, resetAt)
+		if result.Reached {
+			rateLimitRejectionsTotal.WithLabelValues(settings.scope).Inc()
+			flushRateLimitReached(w, resetAt)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimitErrorMessage is the ErrorMessage of 429 with the time the budget resets
+type RateLimitErrorMessage struct {
+	ErrorMessage
+	// ResetAt is RFC 3339 time the limit resets
+	ResetAt string
+	// RetryAfter is the seconds to wait, same as Retry-After header
+	RetryAfter int64
+}
+
+// secondsUntil rounds up, so clients waiting for it do not retry a moment too early
+func secondsUntil(t time.Time) int64 {
+	d := time.Until(t)
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// setRateLimitHeaders sets the RateLimit-* headers of IETF draft, and the X-RateLimit-*
+// headers of the former versions with reset in unix time
+func setRateLimitHeaders(h http.Header, rate limiter.Rate, result limiter.Context, resetAt time.Time) {
+	h.Set("RateLimit-Limit", strconv.FormatInt(result.Limit, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(result.Remaining, 10))
+	h.Set("RateLimit-Reset", strconv.FormatInt(secondsUntil(resetAt), 10))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rate.Limit, int64(rate.Period/time.Second)))
+	h.Set("X-RateLimit-Limit", strconv.FormatInt(result.Limit, 10))
+	h.Set("X-RateLimit-Remaining", strconv.FormatInt(result.Remaining, 10))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(result.Reset, 10))
+}
+
+func flushRateLimitReached(w http.ResponseWriter, resetAt time.Time) {
+	retryAfter := secondsUntil(resetAt)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(&RateLimitErrorMessage{
+		ErrorMessage: newErrorMessage(w, "Rate Limit Reached", "RATE_LIMIT_REACH"),
+		ResetAt:      resetAt.UTC().Format(time.RFC3339),
+		RetryAfter:   retryAfter,
+	})
 }
@@ -1,19 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"strings"
 	"testing"
+	"time"
 
+	"github.com/samber/lo"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestRateLimiterMiddleware(t *testing.T) {
+	isolateRateLimitStore(t)
 	t.Setenv("RATE_LIMIT", "10-M")
 
 	// Create a new RateLimiterMiddleware instance
-	rlm := NewRateLimiterMiddleware()
+	rlm := must(NewRateLimiterMiddleware())
 
 	// Create a new HTTP request to test the middleware
 	req, err := http.NewRequest("GET", "/", nil)
@@ -42,12 +45,17 @@ func TestRateLimiterMiddleware(t *testing.T) {
 	assert.Equal(t, "10", rr.Header().Get("X-RateLimit-Limit"))
 	assert.Equal(t, "9", rr.Header().Get("X-RateLimit-Remaining"))
 	assert.NotEmpty(t, rr.Header().Get("X-RateLimit-Reset"))
+	assert.Equal(t, "10", rr.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "9", rr.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", rr.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "10;w=60", rr.Header().Get("RateLimit-Policy"))
 }
 
 func TestRateLimiterMiddleware_Handler_RateLimitReached(t *testing.T) {
 	// Create a new RateLimiterMiddleware instance with a mock store and rate limit of 1 request per second
+	isolateRateLimitStore(t)
 	t.Setenv("RATE_LIMIT", "1-S")
-	middleware := NewRateLimiterMiddleware()
+	middleware := must(NewRateLimiterMiddleware())
 
 	// Create a new HTTP request with a mock handler
 	req, err := http.NewRequest("GET", "/test", nil)
@@ -62,15 +70,133 @@ func TestRateLimiterMiddleware_Handler_RateLimitReached(t *testing.T) {
 	middleware.Handler(handler).ServeHTTP(rr, req)
 
 	// Check if the response status code is correct
-	if status := rr.Code; status != http.StatusUnauthorized {
+	if status := rr.Code; status != http.StatusTooManyRequests {
 		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusUnauthorized)
+			status, http.StatusTooManyRequests)
 	}
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	assert.Equal(t, "0", rr.Header().Get("RateLimit-Remaining"))
 
 	// Check if the response body is correct
-	expectedBody := `{"Code":"RATE_LIMIT_REACH","ErrorMessage":"Rate Limit Reached"}`
-	if strings.TrimSpace(rr.Body.String()) != expectedBody {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			rr.Body.String(), expectedBody)
+	body := RateLimitErrorMessage{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, "RATE_LIMIT_REACH", body.Code)
+	assert.Equal(t, "Rate Limit Reached", body.ErrorMessage.ErrorMessage)
+	assert.Equal(t, int64(1), body.RetryAfter)
+	resetAt, err := time.Parse(time.RFC3339, body.ResetAt)
+	if assert.NoError(t, err) {
+		assert.WithinDuration(t, time.Now(), resetAt, 2*time.Second)
 	}
+
+	// the fields of other error bodies are shared
+	fields := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &fields))
+	assert.ElementsMatch(t, []string{"Code", "ErrorMessage", "ResetAt", "RetryAfter"}, lo.Keys(fields))
+}
+
+func TestRateLimiterMiddleware_IdentityKey(t *testing.T) {
+	isolateRateLimitStore(t)
+	t.Setenv("RATE_LIMIT", "1-M")
+	handler := must(NewRateLimiterMiddleware()).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(subject string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if len(subject) > 0 {
+			req = withIdentity(req, newIdentity("api_key", map[string]interface{}{"sub": subject}))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// each identity has its own budget, even from the same address
+	assert.Equal(t, http.StatusOK, serve("ci"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("ci"))
+	assert.Equal(t, http.StatusOK, serve("deploy"))
+	assert.Equal(t, http.StatusOK, serve(""))
+}
+
+func serveRateLimited(handler http.Handler, configure func(r *http.Request)) int {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	configure(req)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestRateLimiterMiddleware_ForwardedFor(t *testing.T) {
+	isolateRateLimitStore(t)
+	t.Setenv("RATE_LIMIT", "1-M")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	handler := must(NewRateLimiterMiddleware()).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	from := func(remote string, xff string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.RemoteAddr = remote
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+	}
+
+	assert.Equal(t, http.StatusOK, serveRateLimited(handler, from("203.0.113.9:1", "198.51.100.1")))
+	// spoofed header of a direct client does not reset the budget
+	assert.Equal(t, http.StatusTooManyRequests, serveRateLimited(handler, from("203.0.113.9:1", "198.51.100.2")))
+	// clients behind the trusted proxy are counted separately
+	assert.Equal(t, http.StatusOK, serveRateLimited(handler, from("10.0.0.1:1", "198.51.100.1")))
+	assert.Equal(t, http.StatusOK, serveRateLimited(handler, from("10.0.0.1:1", "198.51.100.2")))
+	assert.Equal(t, http.StatusTooManyRequests, serveRateLimited(handler, from("10.0.0.2:1", "198.51.100.2")))
+}
+
+func TestRateLimiterMiddleware_KeysAndTiers(t *testing.T) {
+	isolateRateLimitStore(t)
+	t.Setenv("RATE_LIMIT", "1-M")
+	t.Setenv("RATE_LIMIT_KEY", "header:X-Tenant")
+	t.Setenv("RATE_LIMIT_TIERS", "groups contains premium => 2-M")
+	handler := must(NewRateLimiterMiddleware()).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tenant := func(name string, groups ...interface{}) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("X-Tenant", name)
+			*r = *withIdentity(r, newIdentity("jwt", map[string]interface{}{"sub": "user", "groups": groups}))
+		}
+	}
+
+	assert.Equal(t, http.StatusOK, serveRateLimited(handler, tenant("acme")))
+	assert.Equal(t, http.StatusTooManyRequests, serveRateLimited(handler, tenant("acme")))
+	assert.Equal(t, http.StatusOK, serveRateLimited(handler, tenant("globex")))
+	assert.Equal(t, http.StatusOK, serveRateLimited(handler, tenant("premium", "premium")))
+	assert.Equal(t, http.StatusOK, serveRateLimited(handler, tenant("premium", "premium")))
+	assert.Equal(t, http.StatusTooManyRequests, serveRateLimited(handler, tenant("premium", "premium")))
+}
+
+func TestRateLimiterMiddleware_Route(t *testing.T) {
+	isolateRateLimitStore(t)
+	api := newEchoUpstream(t, "api")
+	t.Setenv("UPSTREAM", api.URL)
+	useConfig(t, &Config{Routes: []*Route{
+		{PathPrefix: "/api", Upstream: api.URL, RateLimit: &RateLimitConfig{Rate: "1-M", Key: "ip"}},
+	}})
+	handler := must(createHandler())
+	get := func(path string) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("/api/a"))
+	assert.Equal(t, http.StatusTooManyRequests, get("/api/b"))
+	// the catch-all route has no rate limit
+	assert.Equal(t, http.StatusOK, get("/other"))
+	assert.Equal(t, http.StatusOK, get("/other"))
+}
+
+func TestRateLimitConfig_Parse(t *testing.T) {
+	for _, c := range []RateLimitConfig{
+		{Rate: "ten"},
+		{Rate: "1-M", Key: "cookie:session"},
+		{Rate: "1-M", Tiers: []string{"plan == premium"}},
+		{Rate: "1-M", Tiers: []string{"plan == premium => lots"}},
+	} {
+		_, err := c.parse("global")
+		assert.Error(t, err, c)
+	}
+	settings, err := RateLimitConfig{}.parse("global")
+	assert.NoError(t, err)
+	assert.Nil(t, settings)
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedisServer is a local stand-in speaking the redis protocol, it supports the
+// subset of commands used by the proxy
+type fakeRedisServer struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	values   map[string]string
+	zsets    map[string]map[string]float64
+	expireAt map[string]time.Time
+}
+
+func newFakeRedisServer(t *testing.T, password string) *fakeRedisServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &fakeRedisServer{
+		listener: listener,
+		password: password,
+		values:   map[string]string{},
+		zsets:    map[string]map[string]float64{},
+		expireAt: map[string]time.Time{},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *fakeRedisServer) URL() string {
+	if len(s.password) > 0 {
+		return "redis://:" + s.password + "@" + s.listener.Addr().String() + "/1"
+	}
+	return "redis://" + s.listener.Addr().String() + "/1"
+}
+
+func (s *fakeRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authed := len(s.password) == 0
+	for {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		if cmd == "AUTH" {
+			authed = args[len(args)-1] == s.password
+			if !authed {
+				conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+				continue
+			}
+		}
+		if !authed {
+			conn.Write([]byte("-NOAUTH Authentication required\r\n"))
+			continue
+		}
+		conn.Write([]byte(s.exec(cmd, args[1:])))
+	}
+}
+
+func (s *fakeRedisServer) expired(key string) bool {
+	at, ok := s.expireAt[key]
+	if ok && time.Now().After(at) {
+		delete(s.values, key)
+		delete(s.zsets, key)
+		delete(s.expireAt, key)
+		return true
+	}
+	_, exists := s.values[key]
+	_, zexists := s.zsets[key]
+	return !exists && !zexists
+}
+
+// parseScore parses a score bound like 1.5, (1.5, +inf or -inf, returns if it is exclusive
+func parseScore(v string) (float64, bool) {
+	exclusive := strings.HasPrefix(v, "(")
+	score, _ := strconv.ParseFloat(strings.TrimPrefix(strings.TrimPrefix(v, "("), "+"), 64)
+	return score, exclusive
+}
+
+func inScoreRange(score float64, minArg string, maxArg string) bool {
+	min, minExclusive := parseScore(minArg)
+	max, maxExclusive := parseScore(maxArg)
+	return (score > min || !minExclusive && score == min) && (score < max || !maxExclusive && score == max)
+}
+
+func bulk(v string) string {
+	return "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+}
+
+func (s *fakeRedisServer) exec(cmd string, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch cmd {
+	case "AUTH", "SELECT", "PING":
+		return "+OK\r\n"
+	case "GET":
+		if s.expired(args[0]) {
+			return "$-1\r\n"
+		}
+		return bulk(s.values[args[0]])
+	case "SET":
+		s.values[args[0]] = args[1]
+		delete(s.expireAt, args[0])
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.Atoi(args[3])
+			s.expireAt[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		count := 0
+		for _, key := range args {
+			if !s.expired(key) {
+				count++
+			}
+			delete(s.values, key)
+			delete(s.zsets, key)
+			delete(s.expireAt, key)
+		}
+		return ":" + strconv.Itoa(count) + "\r\n"
+	case "INCRBY":
+		s.expired(args[0])
+		current, _ := strconv.ParseInt(s.values[args[0]], 10, 64)
+		delta, _ := strconv.ParseInt(args[1], 10, 64)
+		current += delta
+		s.values[args[0]] = strconv.FormatInt(current, 10)
+		return ":" + strconv.FormatInt(current, 10) + "\r\n"
+	case "PEXPIRE":
+		if s.expired(args[0]) {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[1])
+		s.expireAt[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "PERSIST":
+		if s.expired(args[0]) {
+			return ":0\r\n"
+		}
+		delete(s.expireAt, args[0])
+		return ":1\r\n"
+	case "ZADD":
+		if s.expired(args[0]) {
+			s.zsets[args[0]] = map[string]float64{}
+		}
+		score, _ := parseScore(args[1])
+		s.zsets[args[0]][args[2]] = score
+		return ":1\r\n"
+	case "ZREM":
+		if !s.expired(args[0]) {
+			delete(s.zsets[args[0]], args[1])
+		}
+		return ":1\r\n"
+	case "ZREMRANGEBYSCORE":
+		count := 0
+		if !s.expired(args[0]) {
+			for member, score := range s.zsets[args[0]] {
+				if inScoreRange(score, args[1], args[2]) {
+					delete(s.zsets[args[0]], member)
+					count++
+				}
+			}
+		}
+		return ":" + strconv.Itoa(count) + "\r\n"
+	case "ZRANGEBYSCORE":
+		members := []string{}
+		if !s.expired(args[0]) {
+			for member, score := range s.zsets[args[0]] {
+				if inScoreRange(score, args[1], args[2]) {
+					members = append(members, member)
+				}
+			}
+		}
+		sort.Strings(members)
+		reply := "*" + strconv.Itoa(len(members)) + "\r\n"
+		for _, member := range members {
+			reply += bulk(member)
+		}
+		return reply
+	case "PTTL":
+		if s.expired(args[0]) {
+			return ":-2\r\n"
+		}
+		at, ok := s.expireAt[args[0]]
+		if !ok {
+			return ":-1\r\n"
+		}
+		return ":" + strconv.FormatInt(time.Until(at).Milliseconds(), 10) + "\r\n"
+	case "SCAN":
+		pattern := "*"
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		keys := []string{}
+		for key := range s.values {
+			if matched, _ := path.Match(pattern, key); matched && !s.expired(key) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		reply := "*2\r\n" + bulk("0") + "*" + strconv.Itoa(len(keys)) + "\r\n"
+		for _, key := range keys {
+			reply += bulk(key)
+		}
+		return reply
+	}
+	return "-ERR unknown command '" + cmd + "'\r\n"
+}
+
+func TestRedisClient(t *testing.T) {
+	server := newFakeRedisServer(t, "secret")
+	client, err := newRedisClient(server.URL())
+	assert.NoError(t, err)
+	defer client.Close()
+	ctx := context.Background()
+
+	_, err = client.Do(ctx, "SET", "key", "value\r\nwith newline")
+	assert.NoError(t, err)
+
+	value, err := client.String(ctx, "GET", "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value\r\nwith newline", value)
+
+	_, err = client.String(ctx, "GET", "missing")
+	assert.ErrorIs(t, err, errRedisNil)
+
+	count, err := client.Int(ctx, "INCRBY", "counter", "2")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+
+	_, err = client.Do(ctx, "UNKNOWN")
+	assert.Error(t, err)
+	// connection is still usable after an error reply
+	count, err = client.Int(ctx, "DEL", "key")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestRedisClient_WrongPassword(t *testing.T) {
+	server := newFakeRedisServer(t, "secret")
+	client, err := newRedisClient("redis://:wrong@" + server.listener.Addr().String())
+	assert.NoError(t, err)
+	_, err = client.Do(context.Background(), "PING")
+	assert.Error(t, err)
+}
+
+func TestNewRedisClient_InvalidURL(t *testing.T) {
+	_, err := newRedisClient("http://localhost:6379")
+	assert.Error(t, err)
+	_, err = newRedisClient("redis://localhost:6379/abc")
+	assert.Error(t, err)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// defaultConfigWatchInterval is the interval of checking config file changes
+const defaultConfigWatchInterval = 5 * time.Second
+
+// reloadDrainTimeout is the grace period for in-flight requests of a replaced chain,
+// its background work and stores are closed when they finish or the period ends
+const reloadDrainTimeout = 30 * time.Second
+
+// reloadDrainPollInterval is the interval of checking in-flight requests of a replaced chain
+const reloadDrainPollInterval = 50 * time.Millisecond
+
+// reloadableHandler serves requests with the current handler chain, a reload swaps
+// the chain atomically, in-flight requests finish on the chain they started with
+type reloadableHandler struct {
+	build   func() (http.Handler, error)
+	current atomic.Pointer[servingChain]
+	mu      sync.Mutex
+}
+
+// servingChain is a handler chain with the count of requests it is serving
+type servingChain struct {
+	handler  http.Handler
+	inflight atomic.Int64
+}
+
+func newReloadableHandler(build func() (http.Handler, error)) (*reloadableHandler, error) {
+	h := &reloadableHandler{build: build}
+	handler, err := build()
+	if err != nil {
+		return nil, err
+	}
+	h.current.Store(&servingChain{handler: handler})
+	return h, nil
+}
+
+func (h *reloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for {
+		chain := h.current.Load()
+		chain.inflight.Add(1)
+		// the chain may be replaced and found drained before the request is counted
+		if h.current.Load() != chain {
+			chain.inflight.Add(-1)
+			continue
+		}
+		defer chain.inflight.Add(-1)
+		chain.handler.ServeHTTP(w, r)
+		return
+	}
+}
+
+// reload loads the config file and swaps the handler chain, the new config is only
+// published when it is valid and its chain is built, otherwise the current config
+// and chain are kept
+func (h *reloadableHandler) reload(configFile string) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	stageConfig(config)
+	defer stageConfig(nil)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("build handler failed: %v", r)
+		}
+	}()
+
+	if err := validateSettings(); err != nil {
+		return err
+	}
+	handler, err := h.build()
+	if err != nil {
+		return fmt.Errorf("build handler failed: %w", err)
+	}
+	setConfig(config)
+	replaced := h.current.Swap(&servingChain{handler: handler})
+	// background work of replaced chain (like health checks and jwks rotation) is stopped
+	// after its in-flight requests finish
+	go replaced.closeWhenDrained(reloadDrainTimeout)
+	return nil
+}
+
+// closeWhenDrained closes the chain when it serves no request, or when timeout passes
+func (c *servingChain) closeWhenDrained(timeout time.Duration) {
+	closer, ok := c.handler.(io.Closer)
+	if !ok {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	for c.inflight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(reloadDrainPollInterval)
+	}
+	closer.Close()
+}
+
+// watch reloads on SIGHUP, or when the modification time of config file changes
+func (h *reloadableHandler) watch(configFile string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.Tick(interval)
+	}
+
+	lastModified := time.Time{}
+	if stat, err := os.Stat(configFile); err == nil {
+		lastModified = stat.ModTime()
+	}
+
+	go func() {
+		for {
+			select {
+			case <-hup:
+				log.Printf("SIGHUP received, reload config file %s", configFile)
+			case <-tick:
+				stat, err := os.Stat(configFile)
+				if err != nil || stat.ModTime().Equal(lastModified) {
+					continue
+				}
+				lastModified = stat.ModTime()
+				log.Printf("config file %s changed, reload", configFile)
+			}
+			if err := h.reload(configFile); err != nil {
+				log.Printf("reload config file %s failed, keep the current config: %s", configFile, err)
+				continue
+			}
+			log.Printf("config file %s reloaded", configFile)
+		}
+	}()
+}
+
+// configWatchInterval reads CONFIG_WATCH_INTERVAL, 0 disables watching the file
+func configWatchInterval() time.Duration {
+	v := os.Getenv("CONFIG_WATCH_INTERVAL")
+	if len(v) == 0 {
+		return defaultConfigWatchInterval
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("%s is not a valid duration for CONFIG_WATCH_INTERVAL", v)
+	}
+	return d
+}
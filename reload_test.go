@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadableHandler(t *testing.T) {
+	file := writeConfig(t, "config.yaml", "upstream: http://localhost:3000\nrate_limit: 10-M\n")
+	config, _ := loadConfig(file)
+	useConfig(t, config)
+
+	builds := 0
+	release := make(chan struct{})
+	h := must(newReloadableHandler(func() (http.Handler, error) {
+		builds++
+		generation := builds
+		rateLimit := getenv("RATE_LIMIT")
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				<-release
+			}
+			w.Header().Set("X-Generation", string(rune('0'+generation)))
+			w.Write([]byte(rateLimit))
+		}), nil
+	}))
+
+	// in-flight request started on the first chain
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		slow <- rr
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	assert.NoError(t, os.WriteFile(file, []byte("upstream: http://localhost:3000\nrate_limit: 20-M\n"), 0600))
+	assert.NoError(t, h.reload(file))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "2", rr.Header().Get("X-Generation"))
+	assert.Equal(t, "20-M", rr.Body.String())
+
+	close(release)
+	rr = <-slow
+	assert.Equal(t, "1", rr.Header().Get("X-Generation"))
+	assert.Equal(t, "10-M", rr.Body.String())
+
+	// invalid config keeps the current one
+	assert.NoError(t, os.WriteFile(file, []byte("upstream: http://localhost:3000\nrate_limit: bad\n"), 0600))
+	assert.Error(t, h.reload(file))
+	assert.Equal(t, "20-M", getenv("RATE_LIMIT"))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "2", rr.Header().Get("X-Generation"))
+}
+
+func TestReloadableHandler_Staged(t *testing.T) {
+	file := writeConfig(t, "config.yaml", "upstream: http://localhost:3000\nrequest_id_header: X-Trace-Id\n")
+	config, _ := loadConfig(file)
+	useConfig(t, config)
+
+	served := ""
+	h := must(newReloadableHandler(func() (http.Handler, error) {
+		// a request served during the build sees the published config only
+		served = servingGetenv("REQUEST_ID_HEADER")
+		if getenv("RATE_LIMIT") == "bad" {
+			return nil, errors.New("bad rate limit")
+		}
+		return http.NotFoundHandler(), nil
+	}))
+
+	assert.NoError(t, os.WriteFile(file, []byte("upstream: http://localhost:3000\nrequest_id_header: X-Other-Id\nrate_limit: bad\n"), 0600))
+	assert.Error(t, h.reload(file))
+	assert.Equal(t, "X-Trace-Id", served)
+	assert.Equal(t, "X-Trace-Id", getenv("REQUEST_ID_HEADER"))
+	assert.Empty(t, getenv("RATE_LIMIT"))
+}
+
+type closeRecorder struct {
+	http.Handler
+	closed atomic.Bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestReloadableHandler_Drain(t *testing.T) {
+	file := writeConfig(t, "config.yaml", "upstream: http://localhost:3000\n")
+	config, _ := loadConfig(file)
+	useConfig(t, config)
+
+	release := make(chan struct{})
+	chains := []*closeRecorder{}
+	h := must(newReloadableHandler(func() (http.Handler, error) {
+		chain := &closeRecorder{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		})}
+		chains = append(chains, chain)
+		return chain, nil
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	assert.NoError(t, h.reload(file))
+	time.Sleep(3 * reloadDrainPollInterval)
+	assert.False(t, chains[0].closed.Load(), "closed with a request in flight")
+
+	close(release)
+	<-done
+	assert.Eventually(t, chains[0].closed.Load, time.Second, 10*time.Millisecond)
+	assert.False(t, chains[1].closed.Load())
+}
+
+func TestReloadableHandler_Watch(t *testing.T) {
+	file := writeConfig(t, "config.yaml", "upstream: http://localhost:3000\nrate_limit: 10-M\n")
+	config, _ := loadConfig(file)
+	useConfig(t, config)
+
+	h := must(newReloadableHandler(func() (http.Handler, error) {
+		rateLimit := getenv("RATE_LIMIT")
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(rateLimit))
+		}), nil
+	}))
+	h.watch(file, 10*time.Millisecond)
+
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.WriteFile(file, []byte("upstream: http://localhost:3000\nrate_limit: 30-M\n"), 0600))
+	assert.NoError(t, os.Chtimes(file, future, future))
+
+	assert.Eventually(t, func() bool {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rr.Body.String() == "30-M"
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestReloadableHandler_CreateHandler(t *testing.T) {
+	isolateRateLimitStore(t)
+	api := newEchoUpstream(t, "api")
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	file := writeConfig(t, "config.yaml", "upstream: "+api.URL+"\nrate_limit: 1-M\n")
+	config, _ := loadConfig(file)
+	useConfig(t, config)
+
+	h, err := newReloadableHandler(createHandler)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// a failed build keeps the current chain and config
+	assert.NoError(t, os.WriteFile(file, []byte("upstream: "+api.URL+"\nrate_limit: 1-M\n"+
+		"oidc:\n  issuer: "+unreachable.URL+"\n  client_id: app\n  session_secret: secret\n"), 0600))
+	assert.ErrorContains(t, h.reload(file), "discover oidc provider failed")
+	assert.Empty(t, getenv("ODIC_CLIENT_ID"))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	// the rate limit counters survive a reload
+	assert.NoError(t, os.WriteFile(file, []byte("upstream: "+api.URL+"\nrate_limit: 1-M\nrequest_id_header: X-Trace-Id\n"), 0600))
+	assert.NoError(t, h.reload(file))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("X-Trace-Id"))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+const defaultRequestIDHeader = "X-Request-Id"
+
+// requestIDPattern accepts the incoming ids of printable ASCII, others are replaced
+// so a client can not inject into logs or upstream headers
+var requestIDPattern = regexp.MustCompile(`^[\x21-\x7e]{1,128}$`)
+
+type requestIDContextKey struct{}
+
+// requestIDHeader is REQUEST_ID_HEADER, X-Request-Id by default
+func requestIDHeader() string {
+	if header := getenv("REQUEST_ID_HEADER"); len(header) > 0 {
+		return header
+	}
+	return defaultRequestIDHeader
+}
+
+// servingRequestIDHeader is requestIDHeader of the current config, a reload in progress
+// is not seen by the requests being served
+func servingRequestIDHeader() string {
+	if header := servingGetenv("REQUEST_ID_HEADER"); len(header) > 0 {
+		return header
+	}
+	return defaultRequestIDHeader
+}
+
+// requestIDFromContext returns the id of request, empty before RequestIDMiddleware
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// RequestIDMiddleware accepts the request id sent by client or generates one, the id
+// is forwarded to upstream, echoed on the response and reported in errors
+type RequestIDMiddleware struct {
+	header   string
+	generate func() (uuid.UUID, error)
+}
+
+func NewRequestIDMiddleware() (*RequestIDMiddleware, error) {
+	m := &RequestIDMiddleware{header: requestIDHeader(), generate: uuid.NewRandom}
+	switch version := getenv("REQUEST_ID_VERSION"); version {
+	case "", "v4":
+	case "v7":
+		m.generate = uuid.NewV7
+	default:
+		return nil, fmt.Errorf("REQUEST_ID_VERSION %q is unknown, must be v4 or v7", version)
+	}
+	return m, nil
+}
+
+func (m *RequestIDMiddleware) Name() string {
+	return "RequestIDMiddleware"
+}
+
+func (m *RequestIDMiddleware) Enabled() bool {
+	return true
+}
+
+func (m *RequestIDMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(m.header)
+		if !requestIDPattern.MatchString(id) {
+			id = uuid.Must(m.generate()).String()
+		}
+		w.Header().Set(m.header, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+	})
+}
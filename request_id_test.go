@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := must(NewRequestIDMiddleware()).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name     string
+		incoming string
+		accepted bool
+	}{
+		{"missing", "", false},
+		{"valid", "req-1", true},
+		{"with space", "req 1", false},
+		{"too long", string(make([]byte, 129)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if len(tt.incoming) > 0 {
+				req.Header.Set("X-Request-Id", tt.incoming)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, seen, rr.Header().Get("X-Request-Id"))
+			if tt.accepted {
+				assert.Equal(t, tt.incoming, seen)
+				return
+			}
+			id, err := uuid.Parse(seen)
+			if assert.NoError(t, err) {
+				assert.Equal(t, uuid.Version(4), id.Version())
+			}
+		})
+	}
+}
+
+func TestRequestIDMiddleware_V7(t *testing.T) {
+	t.Setenv("REQUEST_ID_VERSION", "v7")
+	t.Setenv("REQUEST_ID_HEADER", "X-Correlation-Id")
+	rr := httptest.NewRecorder()
+	must(NewRequestIDMiddleware()).Handler(http.NotFoundHandler()).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	id, err := uuid.Parse(rr.Header().Get("X-Correlation-Id"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, uuid.Version(7), id.Version())
+	}
+}
+
+func TestRequestID_Propagation(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Request-Id", r.Header.Get("X-Request-Id"))
+		w.Header().Set("X-Request-Id", "from-upstream")
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("UPSTREAM", upstream.URL)
+	handler := must(createHandler())
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-Id", "req-1")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, "req-1", rr.Header().Get("X-Upstream-Request-Id"))
+	assert.Equal(t, []string{"req-1"}, rr.Header().Values("X-Request-Id"))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.NotEmpty(t, rr.Header().Get("X-Upstream-Request-Id"))
+	assert.Equal(t, rr.Header().Get("X-Upstream-Request-Id"), rr.Header().Get("X-Request-Id"))
+}
+
+func TestRequestID_ErrorResponse(t *testing.T) {
+	api := newEchoUpstream(t, "api")
+	t.Setenv("UPSTREAM", api.URL)
+	t.Setenv("JWT_SECRET", "secret")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-Id", "req-1")
+	rr := httptest.NewRecorder()
+	must(createHandler()).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	body := ErrorMessage{}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+	assert.Equal(t, "req-1", body.RequestID)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+// routeMiddlewares are the middlewares a route can select, by key used in config,
+// the others (like authorization) always apply
+var routeMiddlewares = map[string][]string{
+	"oidc":              {"OidcMiddleware"},
+	"jwt":               {"JwtMiddleware"},
+	"rate_limit":        {"RateLimiterMiddleware"},
+	"concurrency_limit": {"ConcurrencyLimiterMiddleware"},
+	"mtls":              {"ClientCertMiddleware"},
+	"form":              {"FormLoginMiddleware"},
+	"basic_auth":        {"BasicAuthMiddleware"},
+	"api_key":           {"ApiKeyMiddleware"},
+}
+
+// Route forwards the requests matching host and path prefix to an upstream
+type Route struct {
+	// Host matches the request host, supports glob like *.example.com
+	Host string `yaml:"host" json:"host"`
+	// PathPrefix matches whole path segments, /api matches /api/users but not /apis
+	PathPrefix string `yaml:"path_prefix" json:"path_prefix"`
+	// Upstream is the upstream url, comma separated for multiple instances
+	Upstream string `yaml:"upstream" json:"upstream"`
+	// Upstreams are more instances balanced with Upstream
+	Upstreams []string `yaml:"upstreams" json:"upstreams"`
+	// LoadBalancer overrides the load balancing settings of UPSTREAM_* variables
+	LoadBalancer *LoadBalancerConfig `yaml:"load_balancer" json:"load_balancer"`
+	// Transport overrides the connection settings of UPSTREAM_* variables
+	Transport *TransportConfig `yaml:"transport" json:"transport"`
+	// RateLimit overrides the rate limit of RATE_LIMIT_* variables, counted separately
+	RateLimit *RateLimitConfig `yaml:"rate_limit" json:"rate_limit"`
+	// ConcurrencyLimit overrides the concurrency limit of CONCURRENCY_* variables
+	ConcurrencyLimit *ConcurrencyLimitConfig `yaml:"concurrency_limit" json:"concurrency_limit"`
+	// StripPrefix removes the path prefix before forwarding
+	StripPrefix bool `yaml:"strip_prefix" json:"strip_prefix"`
+	// RewritePrefix replaces the path prefix before forwarding
+	RewritePrefix string `yaml:"rewrite_prefix" json:"rewrite_prefix"`
+	// Middlewares selects mtls, api_key, basic_auth, form, oidc, jwt, rate_limit and concurrency_limit for the route, all enabled ones when
+	// absent, none when empty
+	Middlewares []string `yaml:"middlewares" json:"middlewares"`
+
+	upstreamURLs []*url.URL
+	balancer     *loadBalancerSettings
+	transport    *http.Transport
+	rateLimit    *rateLimitSettings
+	concurrency  *concurrencySettings
+	hostPattern  *regexp.Regexp
+	selected     []string
+}
+
+// RouteConfig is the route table, the first matched route wins
+type RouteConfig struct {
+	Routes []*Route `yaml:"routes" json:"routes"`
+}
+
+type routeContextKey struct{}
+
+// compile validates the route and prepares its patterns
+func (route *Route) compile() error {
+	route.upstreamURLs = nil
+	for _, upstream := range append(splitList(route.Upstream), route.Upstreams...) {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return err
+		}
+		if len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return fmt.Errorf("upstream %q must be an absolute url", upstream)
+		}
+		route.upstreamURLs = append(route.upstreamURLs, u)
+	}
+	if len(route.upstreamURLs) == 0 {
+		return errors.New("upstream is required")
+	}
+	balancer := loadBalancerConfigFromEnv()
+	if route.LoadBalancer != nil {
+		balancer = route.LoadBalancer.merge(balancer)
+	}
+	settings, err := balancer.parse()
+	if err != nil {
+		return err
+	}
+	route.balancer = settings
+	transport := transportConfigFromEnv()
+	if route.Transport != nil {
+		transport = route.Transport.merge(transport)
+	}
+	if route.transport, err = transport.build(); err != nil {
+		return err
+	}
+	route.hostPattern = nil
+	if len(route.Host) > 0 {
+		if route.hostPattern, err = globToRegexp(strings.ToLower(route.Host), "."); err != nil {
+			return err
+		}
+	}
+	if len(route.PathPrefix) == 0 {
+		route.PathPrefix = "/"
+	}
+	if !strings.HasPrefix(route.PathPrefix, "/") {
+		return fmt.Errorf("path_prefix %q must start with /", route.PathPrefix)
+	}
+	rateLimit, scope := rateLimitConfigFromEnv(), "global"
+	if route.RateLimit != nil {
+		rateLimit, scope = route.RateLimit.merge(rateLimit), "route:"+route.Host+route.PathPrefix
+	}
+	if route.rateLimit, err = rateLimit.parse(scope); err != nil {
+		return err
+	}
+	concurrency := concurrencyLimitConfigFromEnv()
+	if route.ConcurrencyLimit != nil {
+		concurrency = route.ConcurrencyLimit.merge(concurrency)
+	}
+	// every route has its own slots, the upstreams of routes are loaded separately
+	if route.concurrency, err = concurrency.parse("route:" + route.Host + route.PathPrefix); err != nil {
+		return err
+	}
+	route.selected = nil
+	for _, key := range route.Middlewares {
+		names, ok := routeMiddlewares[key]
+		if !ok {
+			return fmt.Errorf("unknown middleware %q, must be one of %v", key, lo.Keys(routeMiddlewares))
+		}
+		route.selected = append(route.selected, names...)
+	}
+	return nil
+}
+
+func (route *Route) Match(r *http.Request) bool {
+	if route.hostPattern != nil {
+		host := strings.ToLower(r.Host)
+		if h, _, found := strings.Cut(host, ":"); found {
+			host = h
+		}
+		if !route.hostPattern.MatchString(host) {
+			return false
+		}
+	}
+	prefix := strings.TrimSuffix(route.PathPrefix, "/")
+	return r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/")
+}
+
+// selects reports the middleware applies to the route
+func (route *Route) selects(name string) bool {
+	if route.Middlewares == nil {
+		return true
+	}
+	selectable := lo.Flatten(lo.Values(routeMiddlewares))
+	return !lo.Contains(selectable, name) || lo.Contains(route.selected, name)
+}
+
+// rewritePath strips or rewrites the path prefix of outgoing url
+func (route *Route) rewritePath(u *url.URL) {
+	if !route.StripPrefix && len(route.RewritePrefix) == 0 {
+		return
+	}
+	rewrite := func(path string) string {
+		path = strings.TrimSuffix(route.RewritePrefix, "/") + strings.TrimPrefix(path, strings.TrimSuffix(route.PathPrefix, "/"))
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		return path
+	}
+	if len(u.RawPath) > 0 {
+		u.RawPath = rewrite(u.RawPath)
+	}
+	u.Path = rewrite(u.Path)
+}
+
+// loadRouteConfig reads route table from YAML or JSON file
+func loadRouteConfig(file string) (*RouteConfig, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &RouteConfig{}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadRouteSettings loads the routes from ROUTES_FILE, or the routes inline in
+// config file, UPSTREAM is appended as the catch-all route
+func loadRouteSettings() ([]*Route, error) {
+	routes := []*Route{}
+	if file := getenv("ROUTES_FILE"); len(file) > 0 {
+		config, err := loadRouteConfig(file)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, config.Routes...)
+	} else if config := loadedConfig(); config != nil {
+		routes = append(routes, config.Routes...)
+	}
+	if upstream := getenv("UPSTREAM"); len(upstream) > 0 {
+		routes = append(routes, &Route{Upstream: upstream})
+	}
+	if len(routes) == 0 {
+		return nil, errors.New("UPSTREAM is required when no route is configured")
+	}
+	for i, route := range routes {
+		if err := route.compile(); err != nil {
+			return nil, fmt.Errorf("route %d is invalid: %w", i, err)
+		}
+	}
+	return routes, nil
+}
+
+// matchRoute returns the first route matching request, nil if none
+func matchRoute(routes []*Route, r *http.Request) *Route {
+	for _, route := range routes {
+		if route.Match(r) {
+			return route
+		}
+	}
+	return nil
+}
+
+func routeFromContext(ctx context.Context) *Route {
+	route, _ := ctx.Value(routeContextKey{}).(*Route)
+	return route
+}
+
+// RouteMatcher matches request against the route table, it must be the outermost
+// middleware so others know the route selected them or not
+type RouteMatcher struct {
+	routes []*Route
+}
+
+func (m *RouteMatcher) Name() string {
+	return "RouteMatcher"
+}
+
+func (m *RouteMatcher) Enabled() bool {
+	return len(m.routes) > 0
+}
+
+func (m *RouteMatcher) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cleanRequestPath(r.URL) {
+			flushJsonErrorResponse(w, "request path is not canonical", "PATH_INVALID", http.StatusBadRequest)
+			return
+		}
+		if route := matchRoute(m.routes, r); route != nil {
+			r = r.WithContext(context.WithValue(r.Context(), routeContextKey{}, route))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cleanRequestPath collapses the duplicated slashes of path, paths with dot segments,
+// backslashes or encoded slashes are rejected, so routes and authz rules match the
+// path as upstream resolves it
+func cleanRequestPath(u *url.URL) bool {
+	if lower := strings.ToLower(u.RawPath); strings.Contains(lower, "%2f") || strings.Contains(lower, "%5c") {
+		return false
+	}
+	if strings.Contains(u.Path, "\\") {
+		return false
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	cleaned := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if cleaned != u.Path {
+		u.Path, u.RawPath = cleaned, ""
+	}
+	return true
+}
+
+// routeScoped applies the middleware only to the routes selected it, the reserved
+// /_/ paths (like oidc callback) always go through all middlewares
+func routeScoped(m Middleware, next http.Handler) http.Handler {
+	handler := m.Handler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeFromContext(r.Context())
+		if route != nil && !strings.HasPrefix(r.URL.Path, "/_/") && !route.selects(m.Name()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
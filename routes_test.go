@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func newEchoUpstream(t *testing.T, name string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", name)
+		w.Header().Set("X-Upstream-Path", r.URL.Path)
+		w.Header().Set("X-Upstream-Subject", r.Header.Get("X-User-Subject"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRouting(t *testing.T) {
+	api := newEchoUpstream(t, "api")
+	admin := newEchoUpstream(t, "admin")
+	web := newEchoUpstream(t, "web")
+
+	t.Setenv("UPSTREAM", web.URL)
+	t.Setenv("JWT_SECRET", "secret")
+	useConfig(t, &Config{Routes: []*Route{
+		{Host: "admin.example.com", Upstream: admin.URL + "/console", Middlewares: []string{}},
+		{PathPrefix: "/api", Upstream: api.URL, StripPrefix: true, Middlewares: []string{"jwt"}},
+		{PathPrefix: "/legacy/", Upstream: api.URL, RewritePrefix: "/v1", Middlewares: []string{"jwt"}},
+	}})
+	handler := must(createHandler())
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user"}).SignedString([]byte("secret"))
+
+	cases := []struct {
+		url      string
+		token    bool
+		status   int
+		upstream string
+		path     string
+	}{
+		{"http://admin.example.com/users", false, http.StatusOK, "admin", "/console/users"},
+		{"http://app.example.com/api/users", false, http.StatusUnauthorized, "", ""},
+		{"http://app.example.com/api/users", true, http.StatusOK, "api", "/users"},
+		{"http://app.example.com/api", true, http.StatusOK, "api", "/"},
+		{"http://app.example.com/legacy/users", true, http.StatusOK, "api", "/v1/users"},
+		// segments are matched as a whole
+		{"http://app.example.com/apis", false, http.StatusUnauthorized, "", ""},
+		{"http://app.example.com/apis", true, http.StatusOK, "web", "/apis"},
+	}
+	for _, c := range cases {
+		t.Run(c.url, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, c.url, nil)
+			if c.token {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, c.status, rr.Code)
+			assert.Equal(t, c.upstream, rr.Header().Get("X-Upstream"))
+			assert.Equal(t, c.path, rr.Header().Get("X-Upstream-Path"))
+			if c.token {
+				assert.Equal(t, "user", rr.Header().Get("X-Upstream-Subject"))
+			}
+		})
+	}
+}
+
+func TestRouting_CleanPath(t *testing.T) {
+	api := newEchoUpstream(t, "api")
+	public := newEchoUpstream(t, "public")
+	t.Setenv("JWT_SECRET", "secret")
+	useConfig(t, &Config{Routes: []*Route{
+		{PathPrefix: "/public", Upstream: public.URL, Middlewares: []string{}},
+		{PathPrefix: "/api", Upstream: api.URL, Middlewares: []string{"jwt"}},
+	}})
+	handler := must(createHandler())
+
+	cases := []struct {
+		path   string
+		status int
+		// upstream path, empty when not proxied
+		upstream string
+	}{
+		{"/public/../api/users", http.StatusBadRequest, ""},
+		{"/public/%2e%2e/api/users", http.StatusBadRequest, ""},
+		{"/public/..%2fapi/users", http.StatusBadRequest, ""},
+		{"/public/.%5C..%5Capi", http.StatusBadRequest, ""},
+		{"/public/./users", http.StatusBadRequest, ""},
+		{"//api//users", http.StatusUnauthorized, ""},
+		{"/public//users/", http.StatusOK, "/public/users/"},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, c.path, nil))
+			assert.Equal(t, c.status, rr.Code)
+			assert.Equal(t, c.upstream, rr.Header().Get("X-Upstream-Path"))
+		})
+	}
+}
+
+func TestRouting_NotFound(t *testing.T) {
+	api := newEchoUpstream(t, "api")
+	useConfig(t, &Config{Routes: []*Route{{PathPrefix: "/api", Upstream: api.URL}}})
+	handler := must(createHandler())
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/other", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Contains(t, rr.Body.String(), "ROUTE_NOT_FOUND")
+}
+
+func TestLoadRouteSettings_Invalid(t *testing.T) {
+	_, err := loadRouteSettings()
+	assert.ErrorContains(t, err, "UPSTREAM is required")
+
+	for _, route := range []*Route{
+		{Upstream: "localhost:3000"},
+		{Upstream: "http://localhost:3000", PathPrefix: "api"},
+		{Upstream: "http://localhost:3000", Middlewares: []string{"saml"}},
+	} {
+		useConfig(t, &Config{Routes: []*Route{route}})
+		_, err := loadRouteSettings()
+		assert.Error(t, err)
+	}
+}
+
+func TestRoute_RewritePath(t *testing.T) {
+	route := &Route{Upstream: "http://localhost", PathPrefix: "/api/", RewritePrefix: "/v2/"}
+	assert.NoError(t, route.compile())
+	u, _ := url.Parse("http://proxy/api/a%2Fb")
+	route.rewritePath(u)
+	assert.Equal(t, "/v2/a%2Fb", u.EscapedPath())
+}
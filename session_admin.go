@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// sessionsPath lists the logged in sessions of server side store on ADMIN_LISTEN_ADDR,
+// DELETE sessionsPath/<id> revokes one of them
+const sessionsPath = "/_/sessions"
+
+// sessionInfo is the summary of an active session, the tokens are never exposed
+type sessionInfo struct {
+	ID         string    `json:"id"`
+	Subject    string    `json:"sub"`
+	AuthMethod string    `json:"auth_method"`
+	Name       string    `json:"name,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	LoginAt    time.Time `json:"login_at"`
+}
+
+func newSessionInfo(s activeSession) (sessionInfo, bool) {
+	sub, _ := s.Values["sub"].(string)
+	loginAt, ok := s.Values["login_at"].(int64)
+	if !ok {
+		// pre-login state
+		return sessionInfo{}, false
+	}
+	info := sessionInfo{ID: s.ID, Subject: sub, LoginAt: time.Unix(0, loginAt).UTC()}
+	info.AuthMethod, _ = s.Values["auth_method"].(string)
+	if len(info.AuthMethod) == 0 {
+		info.AuthMethod = "oidc"
+	}
+	info.Name, _ = s.Values["profile_name"].(string)
+	info.Email, _ = s.Values["profile_email"].(string)
+	return info, true
+}
+
+// serveSessions lists the logged in sessions, optionally of the sub query parameter
+func serveSessions(w http.ResponseWriter, r *http.Request) {
+	store := activeSessionStore.Load()
+	if store == nil {
+		flushJsonErrorResponse(w, "sessions are only managed with a server side session store", "ERR_SESSION_STORE", http.StatusNotFound)
+		return
+	}
+	active, err := store.Sessions(r.Context())
+	if err != nil {
+		flushJsonErrorResponse(w, err.Error(), "ERR_SESSION_STORE", http.StatusInternalServerError)
+		return
+	}
+	sub := r.URL.Query().Get("sub")
+	result := []sessionInfo{}
+	for _, s := range active {
+		if info, ok := newSessionInfo(s); ok && (len(sub) == 0 || info.Subject == sub) {
+			result = append(result, info)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].LoginAt.Before(result[j].LoginAt) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// serveRevokeSession deletes the session, the user has to login again
+func serveRevokeSession(w http.ResponseWriter, r *http.Request) {
+	store := activeSessionStore.Load()
+	if store == nil {
+		flushJsonErrorResponse(w, "sessions are only managed with a server side session store", "ERR_SESSION_STORE", http.StatusNotFound)
+		return
+	}
+	id := r.PathValue("id")
+	if !sessionIDPattern.MatchString(id) {
+		flushJsonErrorResponse(w, "session id is invalid", "ERR_SESSION_ID", http.StatusBadRequest)
+		return
+	}
+	if err := store.Revoke(r.Context(), id); err != nil {
+		flushJsonErrorResponse(w, err.Error(), "ERR_SESSION_STORE", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminSessions(t *testing.T) {
+	admin := createAdminHandler()
+	rr := httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, sessionsPath, nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	store := newServerSessionStore(newMemorySessionBackend(), []byte("secret"))
+	activeSessionStore.Store(store)
+	t.Cleanup(func() { activeSessionStore.Store(nil) })
+	ids := map[string]string{}
+	for _, values := range []map[interface{}]interface{}{
+		{"sub": "alice", "auth_method": "form", "login_at": time.Now().UnixNano()},
+		{"sub": "bob", "profile_email": "bob@example.com", "login_at": time.Now().UnixNano()},
+		{"oidc_state": "pending"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		s, _ := store.New(req, "user")
+		s.Values = values
+		assert.NoError(t, s.Save(req, httptest.NewRecorder()))
+		sub, _ := values["sub"].(string)
+		ids[sub] = s.ID
+	}
+	list := func(query string) []sessionInfo {
+		rr := httptest.NewRecorder()
+		admin.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, sessionsPath+query, nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		result := []sessionInfo{}
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&result))
+		return result
+	}
+
+	// sessions not logged in yet are not listed
+	assert.Len(t, list(""), 2)
+	bob := list("?sub=bob")
+	if assert.Len(t, bob, 1) {
+		assert.Equal(t, ids["bob"], bob[0].ID)
+		assert.Equal(t, "oidc", bob[0].AuthMethod)
+		assert.Equal(t, "bob@example.com", bob[0].Email)
+	}
+
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, sessionsPath+"/"+ids["alice"], nil))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	_, err := store.backend.Load(context.Background(), ids["alice"])
+	assert.ErrorIs(t, err, errSessionNotFound)
+	assert.Len(t, list(""), 1)
+
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, sessionsPath+"/..%2Fsecret", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
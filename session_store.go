@@ -0,0 +1,734 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// defaultSessionMaxAge is the lifetime of session in seconds, 30 days
+const defaultSessionMaxAge = 86400 * 30
+
+// preLoginSessionTTL is the lifetime of a session not logged in, like the oidc state
+// or the CSRF token of login page, so anonymous requests do not fill the store
+const preLoginSessionTTL = 10 * time.Minute
+
+// sessionSweepInterval is the interval of deleting expired sessions of the stores
+// without native expiration
+const sessionSweepInterval = 10 * time.Minute
+
+var errSessionNotFound = errors.New("session not found")
+
+// sharedMemorySessions keeps in-memory sessions across the rebuild of middlewares on config reload
+var sharedMemorySessions = newMemorySessionBackend()
+
+var sessionIDPattern = regexp.MustCompile(`^[A-Z2-7]+$`)
+
+// sessionIndexFields are the session values indexed for revocation, back-channel
+// logout revokes by sid or sub and deleting a user revokes by sub
+var sessionIndexFields = []string{"sid", "sub"}
+
+// sessionBackend persists serialized session data by session id
+type sessionBackend interface {
+	Load(ctx context.Context, id string) ([]byte, error)
+	Save(ctx context.Context, id string, data []byte, ttl time.Duration) error
+	Delete(ctx context.Context, id string) error
+	List(ctx context.Context) ([]string, error)
+	// Index adds the session id to the index key until ttl passes, 0 never expires
+	Index(ctx context.Context, key string, id string, ttl time.Duration) error
+	// Indexed lists the session ids of index key, some may be deleted already
+	Indexed(ctx context.Context, key string) ([]string, error)
+	Unindex(ctx context.Context, key string, id string) error
+}
+
+// sessionIndexKey is the index key of a session value
+func sessionIndexKey(field string, value string) string {
+	return field + "=" + value
+}
+
+// newSessionStore creates the session store selected by ODIC_SESSION_STORE,
+// cookie (default), memory, filesystem or redis
+func newSessionStore(keyPairs ...[]byte) (sessions.Store, error) {
+	kind := getenv("ODIC_SESSION_STORE")
+	switch kind {
+	case "", "cookie":
+		activeSessionStore.Store(nil)
+		return sessions.NewCookieStore(keyPairs...), nil
+	case "memory":
+		sweepSessions(sharedMemorySessions, sessionSweepInterval)
+		return trackSessions(newServerSessionStore(sharedMemorySessions, keyPairs...)), nil
+	case "filesystem":
+		path := getenv("ODIC_SESSION_STORE_PATH")
+		if len(path) == 0 {
+			path = filepath.Join(os.TempDir(), "secure-app-proxy-sessions")
+		}
+		backend, err := sharedFilesystemSessionBackend(path)
+		if err != nil {
+			return nil, err
+		}
+		sweepSessions(backend, sessionSweepInterval)
+		return trackSessions(newServerSessionStore(backend, keyPairs...)), nil
+	case "redis":
+		client, err := sharedRedisClient(getenv("ODIC_SESSION_STORE_REDIS_URL"))
+		if err != nil {
+			return nil, err
+		}
+		return trackSessions(newServerSessionStore(newRedisSessionBackend(client), keyPairs...)), nil
+	}
+	return nil, fmt.Errorf("unknown session store %q", kind)
+}
+
+// sweptSessionBackends are the backends swept in background, each is swept by one
+// goroutine for the life of process
+var (
+	sweptSessionBackends   = map[sessionBackend]bool{}
+	sweptSessionBackendsMu sync.Mutex
+)
+
+// sweepSessions deletes the expired sessions of backend periodically
+func sweepSessions(backend sessionBackend, interval time.Duration) {
+	sweptSessionBackendsMu.Lock()
+	defer sweptSessionBackendsMu.Unlock()
+	if sweptSessionBackends[backend] {
+		return
+	}
+	sweptSessionBackends[backend] = true
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := sweepExpiredSessions(context.Background(), backend); err != nil {
+				log.Printf("sweep expired sessions failed %s", err)
+			}
+		}
+	}()
+}
+
+// sweepExpiredSessions loads every session, the backend deletes the expired ones on load
+func sweepExpiredSessions(ctx context.Context, backend sessionBackend) error {
+	ids, err := backend.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := backend.Load(ctx, id); err != nil && !errors.Is(err, errSessionNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackSessions makes the store counted by the active sessions metric
+func trackSessions(st *serverSessionStore) *serverSessionStore {
+	activeSessionStore.Store(st)
+	return st
+}
+
+// activeSession is a session persisted in server side store
+type activeSession struct {
+	ID     string
+	Values map[interface{}]interface{}
+}
+
+// serverSessionStore keeps session values in a backend and only the signed
+// opaque session id in the cookie
+type serverSessionStore struct {
+	backend sessionBackend
+	codecs  []securecookie.Codec
+	options *sessions.Options
+	encoder securecookie.GobEncoder
+}
+
+func newServerSessionStore(backend sessionBackend, keyPairs ...[]byte) *serverSessionStore {
+	return &serverSessionStore{
+		backend: backend,
+		codecs:  securecookie.CodecsFromPairs(keyPairs...),
+		options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   defaultSessionMaxAge,
+			HttpOnly: true,
+		},
+	}
+}
+
+func (st *serverSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(st, name)
+}
+
+func (st *serverSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	s := sessions.NewSession(st, name)
+	opts := *st.options
+	s.Options = &opts
+	s.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return s, nil
+	}
+	if err := securecookie.DecodeMulti(name, c.Value, &s.ID, st.codecs...); err != nil {
+		return s, err
+	}
+	data, err := st.backend.Load(r.Context(), s.ID)
+	if errors.Is(err, errSessionNotFound) {
+		// expired or revoked, start over
+		s.ID = ""
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := st.encoder.Deserialize(data, &s.Values); err != nil {
+		return s, err
+	}
+	s.IsNew = false
+	return s, nil
+}
+
+func (st *serverSessionStore) Save(r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
+	if s.Options.MaxAge < 0 {
+		if len(s.ID) > 0 {
+			if err := st.backend.Delete(r.Context(), s.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(s.Name(), "", s.Options))
+		return nil
+	}
+	if len(s.ID) == 0 {
+		s.ID = newSessionID()
+	}
+	data, err := st.encoder.Serialize(s.Values)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(s.Options.MaxAge) * time.Second
+	_, loggedIn := s.Values["login_at"]
+	if !loggedIn && (ttl <= 0 || ttl > preLoginSessionTTL) {
+		ttl = preLoginSessionTTL
+	}
+	if err := st.backend.Save(r.Context(), s.ID, data, ttl); err != nil {
+		return err
+	}
+	if loggedIn {
+		for _, field := range sessionIndexFields {
+			if value, _ := s.Values[field].(string); len(value) > 0 {
+				if err := st.backend.Index(r.Context(), sessionIndexKey(field, value), s.ID, ttl); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	encoded, err := securecookie.EncodeMulti(s.Name(), s.ID, st.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(s.Name(), encoded, s.Options))
+	return nil
+}
+
+// Sessions lists the active sessions
+func (st *serverSessionStore) Sessions(ctx context.Context) ([]activeSession, error) {
+	ids, err := st.backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := []activeSession{}
+	for _, id := range ids {
+		data, err := st.backend.Load(ctx, id)
+		if errors.Is(err, errSessionNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values := map[interface{}]interface{}{}
+		if err := st.encoder.Deserialize(data, &values); err != nil {
+			continue
+		}
+		result = append(result, activeSession{ID: id, Values: values})
+	}
+	return result, nil
+}
+
+// Revoke deletes the session, the user has to login again
+func (st *serverSessionStore) Revoke(ctx context.Context, id string) error {
+	return st.backend.Delete(ctx, id)
+}
+
+// RevokeMatching deletes the logged in sessions whose field (one of sessionIndexFields)
+// is value and matching the predicate, nil matches all, returns deleted count. Only the
+// sessions in the index of value are loaded
+func (st *serverSessionStore) RevokeMatching(ctx context.Context, field string, value string, match func(values map[interface{}]interface{}) bool) (int, error) {
+	key := sessionIndexKey(field, value)
+	ids, err := st.backend.Indexed(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, id := range ids {
+		data, err := st.backend.Load(ctx, id)
+		if errors.Is(err, errSessionNotFound) {
+			// logged out or expired
+			if err := st.backend.Unindex(ctx, key, id); err != nil {
+				return count, err
+			}
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		values := map[interface{}]interface{}{}
+		if err := st.encoder.Deserialize(data, &values); err != nil {
+			continue
+		}
+		if values[field] != value || (match != nil && !match(values)) {
+			continue
+		}
+		if err := st.backend.Delete(ctx, id); err != nil {
+			return count, err
+		}
+		if err := st.backend.Unindex(ctx, key, id); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// renewSessionID gives the session a new id on login, so an id planted before login
+// is worthless, the values are kept
+func renewSessionID(store sessions.Store, r *http.Request, s *sessions.Session) {
+	if st, ok := store.(*serverSessionStore); ok && len(s.ID) > 0 {
+		if err := st.Revoke(r.Context(), s.ID); err != nil {
+			log.Printf("revoke pre-login session failed %s", err)
+		}
+		s.ID = ""
+	}
+}
+
+func newSessionID() string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+type memorySessionEntry struct {
+	data     []byte
+	expireAt time.Time
+}
+
+// memorySessionBackend keeps sessions in process, they are lost on restart
+type memorySessionBackend struct {
+	mu       sync.Mutex
+	sessions map[string]memorySessionEntry
+	// indexes are session ids with their expiry by index key
+	indexes map[string]map[string]time.Time
+}
+
+func newMemorySessionBackend() *memorySessionBackend {
+	return &memorySessionBackend{sessions: map[string]memorySessionEntry{}, indexes: map[string]map[string]time.Time{}}
+}
+
+func (b *memorySessionBackend) Load(ctx context.Context, id string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.sessions[id]
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	if !entry.expireAt.IsZero() && time.Now().After(entry.expireAt) {
+		delete(b.sessions, id)
+		return nil, errSessionNotFound
+	}
+	return entry.data, nil
+}
+
+func (b *memorySessionBackend) Save(ctx context.Context, id string, data []byte, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry := memorySessionEntry{data: data}
+	if ttl > 0 {
+		entry.expireAt = time.Now().Add(ttl)
+	}
+	b.sessions[id] = entry
+	return nil
+}
+
+func (b *memorySessionBackend) Delete(ctx context.Context, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.sessions, id)
+	return nil
+}
+
+func (b *memorySessionBackend) Index(ctx context.Context, key string, id string, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	index := b.pruneIndex(key)
+	if index == nil {
+		index = map[string]time.Time{}
+		b.indexes[key] = index
+	}
+	expireAt := time.Time{}
+	if ttl > 0 {
+		expireAt = time.Now().Add(ttl)
+	}
+	index[id] = expireAt
+	return nil
+}
+
+func (b *memorySessionBackend) Indexed(ctx context.Context, key string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := []string{}
+	for id := range b.pruneIndex(key) {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (b *memorySessionBackend) Unindex(ctx context.Context, key string, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.indexes[key], id)
+	b.pruneIndex(key)
+	return nil
+}
+
+// pruneIndex removes the expired ids of index key, an empty index is removed
+func (b *memorySessionBackend) pruneIndex(key string) map[string]time.Time {
+	index := b.indexes[key]
+	now := time.Now()
+	for id, expireAt := range index {
+		if !expireAt.IsZero() && now.After(expireAt) {
+			delete(index, id)
+		}
+	}
+	if index != nil && len(index) == 0 {
+		delete(b.indexes, key)
+		return nil
+	}
+	return index
+}
+
+func (b *memorySessionBackend) List(ctx context.Context) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	ids := []string{}
+	for id, entry := range b.sessions {
+		if !entry.expireAt.IsZero() && now.After(entry.expireAt) {
+			delete(b.sessions, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// filesystemSessionBackend stores each session in a file, prefixed with its expiry
+type filesystemSessionBackend struct {
+	path string
+}
+
+// sharedFilesystemSessionBackends keeps a backend per directory across the rebuild of
+// middlewares on config reload, it is swept once
+var (
+	sharedFilesystemSessionBackends   = map[string]*filesystemSessionBackend{}
+	sharedFilesystemSessionBackendsMu sync.Mutex
+)
+
+func sharedFilesystemSessionBackend(path string) (*filesystemSessionBackend, error) {
+	sharedFilesystemSessionBackendsMu.Lock()
+	defer sharedFilesystemSessionBackendsMu.Unlock()
+	if b, ok := sharedFilesystemSessionBackends[path]; ok {
+		return b, nil
+	}
+	b, err := newFilesystemSessionBackend(path)
+	if err != nil {
+		return nil, err
+	}
+	sharedFilesystemSessionBackends[path] = b
+	return b, nil
+}
+
+func newFilesystemSessionBackend(path string) (*filesystemSessionBackend, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	return &filesystemSessionBackend{path: path}, nil
+}
+
+func (b *filesystemSessionBackend) file(id string) (string, error) {
+	if !sessionIDPattern.MatchString(id) {
+		return "", fmt.Errorf("invalid session id %q", id)
+	}
+	return filepath.Join(b.path, "session_"+id), nil
+}
+
+func (b *filesystemSessionBackend) Load(ctx context.Context, id string) ([]byte, error) {
+	file, err := b.file(id)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < 8 {
+		return nil, errSessionNotFound
+	}
+	if expireAt := int64(binary.BigEndian.Uint64(content)); expireAt > 0 && time.Now().Unix() > expireAt {
+		os.Remove(file)
+		return nil, errSessionNotFound
+	}
+	return content[8:], nil
+}
+
+func (b *filesystemSessionBackend) Save(ctx context.Context, id string, data []byte, ttl time.Duration) error {
+	file, err := b.file(id)
+	if err != nil {
+		return err
+	}
+	var expireAt int64
+	if ttl > 0 {
+		expireAt = time.Now().Add(ttl).Unix()
+	}
+	content := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(content, uint64(expireAt))
+	content = append(content, data...)
+	// write then rename, readers never see partial content
+	tmp, err := os.CreateTemp(b.path, ".tmp_session_")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func (b *filesystemSessionBackend) Delete(ctx context.Context, id string) error {
+	file, err := b.file(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// indexDir is the directory of index key, holding a file with the expiry per session id
+func (b *filesystemSessionBackend) indexDir(key string) string {
+	return filepath.Join(b.path, "index_"+base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(key)))
+}
+
+func (b *filesystemSessionBackend) Index(ctx context.Context, key string, id string, ttl time.Duration) error {
+	if !sessionIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid session id %q", id)
+	}
+	if _, err := b.Indexed(ctx, key); err != nil {
+		return err
+	}
+	dir := b.indexDir(key)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	var expireAt int64
+	if ttl > 0 {
+		expireAt = time.Now().Add(ttl).Unix()
+	}
+	content := make([]byte, 8)
+	binary.BigEndian.PutUint64(content, uint64(expireAt))
+	return os.WriteFile(filepath.Join(dir, id), content, 0600)
+}
+
+// Indexed lists the ids of index key, the expired ones are removed
+func (b *filesystemSessionBackend) Indexed(ctx context.Context, key string) ([]string, error) {
+	dir := b.indexDir(key)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	ids := []string{}
+	for _, entry := range entries {
+		file := filepath.Join(dir, entry.Name())
+		content, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(content) == 8 {
+			if expireAt := int64(binary.BigEndian.Uint64(content)); expireAt > 0 && now > expireAt {
+				os.Remove(file)
+				continue
+			}
+		}
+		ids = append(ids, entry.Name())
+	}
+	return ids, nil
+}
+
+func (b *filesystemSessionBackend) Unindex(ctx context.Context, key string, id string) error {
+	if !sessionIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid session id %q", id)
+	}
+	if err := os.Remove(filepath.Join(b.indexDir(key), id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (b *filesystemSessionBackend) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(b.path)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, entry := range entries {
+		if id, ok := strings.CutPrefix(entry.Name(), "session_"); ok && !entry.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// redisSessionBackend stores sessions in redis with native key expiration, an index is
+// a sorted set of session ids scored by their expiry in unix milliseconds
+type redisSessionBackend struct {
+	client      *redisClient
+	prefix      string
+	indexPrefix string
+}
+
+func newRedisSessionBackend(client *redisClient) *redisSessionBackend {
+	return &redisSessionBackend{client: client, prefix: "secure-app-proxy:session:", indexPrefix: "secure-app-proxy:session-index:"}
+}
+
+func (b *redisSessionBackend) Load(ctx context.Context, id string) ([]byte, error) {
+	data, err := b.client.String(ctx, "GET", b.prefix+id)
+	if errors.Is(err, errRedisNil) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+func (b *redisSessionBackend) Save(ctx context.Context, id string, data []byte, ttl time.Duration) error {
+	args := []string{"SET", b.prefix + id, string(data)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := b.client.Do(ctx, args...)
+	return err
+}
+
+func (b *redisSessionBackend) Delete(ctx context.Context, id string) error {
+	_, err := b.client.Do(ctx, "DEL", b.prefix+id)
+	return err
+}
+
+func (b *redisSessionBackend) List(ctx context.Context) ([]string, error) {
+	ids := []string{}
+	cursor := "0"
+	for {
+		reply, err := b.client.Do(ctx, "SCAN", cursor, "MATCH", b.prefix+"*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply %v", reply)
+		}
+		cursor, _ = items[0].(string)
+		keys, _ := items[1].([]interface{})
+		for _, key := range keys {
+			if k, ok := key.(string); ok {
+				ids = append(ids, strings.TrimPrefix(k, b.prefix))
+			}
+		}
+		if cursor == "0" || len(cursor) == 0 {
+			return ids, nil
+		}
+	}
+}
+
+func (b *redisSessionBackend) Index(ctx context.Context, key string, id string, ttl time.Duration) error {
+	key = b.indexPrefix + key
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if _, err := b.client.Do(ctx, "ZREMRANGEBYSCORE", key, "-inf", "("+now); err != nil {
+		return err
+	}
+	score := "+inf"
+	if ttl > 0 {
+		score = strconv.FormatInt(time.Now().Add(ttl).UnixMilli(), 10)
+	}
+	if _, err := b.client.Do(ctx, "ZADD", key, score, id); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		_, err := b.client.Do(ctx, "PERSIST", key)
+		return err
+	}
+	// the index lives as long as its longest living session, -1 is never expiring
+	current, err := b.client.Int(ctx, "PTTL", key)
+	if err != nil || current == -1 || current >= ttl.Milliseconds() {
+		return err
+	}
+	_, err = b.client.Do(ctx, "PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (b *redisSessionBackend) Indexed(ctx context.Context, key string) ([]string, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	reply, err := b.client.Do(ctx, "ZRANGEBYSCORE", b.indexPrefix+key, now, "+inf")
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected ZRANGEBYSCORE reply %v", reply)
+	}
+	ids := []string{}
+	for _, item := range items {
+		if id, ok := item.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (b *redisSessionBackend) Unindex(ctx context.Context, key string, id string) error {
+	_, err := b.client.Do(ctx, "ZREM", b.indexPrefix+key, id)
+	return err
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSessionBackends(t *testing.T) map[string]sessionBackend {
+	fsBackend, err := newFilesystemSessionBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create filesystem backend: %v", err)
+	}
+	client, err := newRedisClient(newFakeRedisServer(t, "").URL())
+	if err != nil {
+		t.Fatalf("Failed to create redis client: %v", err)
+	}
+	return map[string]sessionBackend{
+		"memory":     newMemorySessionBackend(),
+		"filesystem": fsBackend,
+		"redis":      newRedisSessionBackend(client),
+	}
+}
+
+func TestSessionBackends(t *testing.T) {
+	ctx := context.Background()
+	for name, backend := range testSessionBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := backend.Load(ctx, "MISSING")
+			assert.ErrorIs(t, err, errSessionNotFound)
+
+			assert.NoError(t, backend.Save(ctx, "ABC", []byte("data"), time.Minute))
+			data, err := backend.Load(ctx, "ABC")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("data"), data)
+
+			ids, err := backend.List(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"ABC"}, ids)
+
+			assert.NoError(t, backend.Delete(ctx, "ABC"))
+			_, err = backend.Load(ctx, "ABC")
+			assert.ErrorIs(t, err, errSessionNotFound)
+
+			assert.NoError(t, backend.Index(ctx, "sub=alice", "ABC", time.Minute))
+			assert.NoError(t, backend.Index(ctx, "sub=alice", "DEF", 0))
+			assert.NoError(t, backend.Index(ctx, "sub=bob", "GHI", time.Minute))
+			ids, err = backend.Indexed(ctx, "sub=alice")
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, []string{"ABC", "DEF"}, ids)
+			assert.NoError(t, backend.Unindex(ctx, "sub=alice", "ABC"))
+			ids, err = backend.Indexed(ctx, "sub=alice")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"DEF"}, ids)
+			ids, err = backend.Indexed(ctx, "sub=carol")
+			assert.NoError(t, err)
+			assert.Empty(t, ids)
+
+			// expired session is gone
+			assert.NoError(t, backend.Save(ctx, "EXPIRED", []byte("data"), time.Millisecond))
+			assert.NoError(t, backend.Index(ctx, "sub=bob", "EXPIRED", time.Millisecond))
+			time.Sleep(1100 * time.Millisecond)
+			_, err = backend.Load(ctx, "EXPIRED")
+			assert.ErrorIs(t, err, errSessionNotFound)
+			ids, err = backend.Indexed(ctx, "sub=bob")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"GHI"}, ids)
+		})
+	}
+}
+
+func TestFilesystemSessionBackend_InvalidID(t *testing.T) {
+	backend, err := newFilesystemSessionBackend(t.TempDir())
+	assert.NoError(t, err)
+	_, err = backend.Load(context.Background(), "../../etc/passwd")
+	assert.Error(t, err)
+}
+
+func TestServerSessionStore(t *testing.T) {
+	store := newServerSessionStore(newMemorySessionBackend(), []byte("secret"))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s, err := store.Get(req, "user")
+	assert.NoError(t, err)
+	assert.True(t, s.IsNew)
+	s.Values["sub"] = "user-1"
+	rr := httptest.NewRecorder()
+	assert.NoError(t, s.Save(req, rr))
+
+	// only the opaque id is in the cookie
+	cookies := rr.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.NotContains(t, cookies[0].Value, "user-1")
+
+	req = withCookies(httptest.NewRequest(http.MethodGet, "/", nil), cookies)
+	s, err = store.Get(req, "user")
+	assert.NoError(t, err)
+	assert.False(t, s.IsNew)
+	assert.Equal(t, "user-1", s.Values["sub"])
+
+	active, err := store.Sessions(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, active, 1)
+	assert.Equal(t, "user-1", active[0].Values["sub"])
+
+	// revoked session starts over
+	assert.NoError(t, store.Revoke(context.Background(), active[0].ID))
+	req = withCookies(httptest.NewRequest(http.MethodGet, "/", nil), cookies)
+	s, err = store.Get(req, "user")
+	assert.NoError(t, err)
+	assert.True(t, s.IsNew)
+
+	// tampered cookie is rejected
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "user", Value: "tampered"})
+	_, err = store.Get(req, "user")
+	assert.Error(t, err)
+}
+
+func TestNewSessionStore(t *testing.T) {
+	t.Setenv("ODIC_SESSION_STORE", "")
+	store, err := newSessionStore([]byte("secret"))
+	assert.NoError(t, err)
+	assert.IsType(t, &sessions.CookieStore{}, store)
+
+	t.Setenv("ODIC_SESSION_STORE", "filesystem")
+	t.Setenv("ODIC_SESSION_STORE_PATH", t.TempDir())
+	store, err = newSessionStore([]byte("secret"))
+	assert.NoError(t, err)
+	assert.IsType(t, &serverSessionStore{}, store)
+
+	t.Setenv("ODIC_SESSION_STORE", "unknown")
+	_, err = newSessionStore([]byte("secret"))
+	assert.Error(t, err)
+}
+
+func TestOidcMiddleware_ServerSessionStore(t *testing.T) {
+	redis := newFakeRedisServer(t, "")
+	t.Setenv("ODIC_SESSION_STORE", "redis")
+	t.Setenv("ODIC_SESSION_STORE_REDIS_URL", redis.URL())
+	p := newMockOidcProvider(t)
+	m := newMockOidcMiddleware(t, p)
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	var planted []*http.Cookie
+	cookies := oidcLogin(t, p, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_/oidc/callback" {
+			planted = r.Cookies()
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	for _, c := range cookies {
+		assert.NotContains(t, c.Value, "access-token")
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, withCookies(httptest.NewRequest(http.MethodGet, "/app", nil), cookies))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// the login got a new session id, the one planted before login is not logged in
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, withCookies(httptest.NewRequest(http.MethodGet, "/app", nil), planted))
+	assert.Equal(t, http.StatusTemporaryRedirect, rr.Code)
+
+	// back-channel logout deletes the session in store
+	form := url.Values{"logout_token": {p.signToken(t, jwt.MapClaims{
+		"sub":    "user-1",
+		"jti":    "jti-1",
+		"events": map[string]interface{}{backChannelLogoutEvent: map[string]interface{}{}},
+	})}}
+	req := httptest.NewRequest(http.MethodPost, "/_/oidc/backchannel-logout", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	active, err := m.store.(*serverSessionStore).Sessions(context.Background())
+	assert.NoError(t, err)
+	for _, s := range active {
+		assert.NotContains(t, s.Values, "sub")
+	}
+}
+
+func TestServerSessionStore_RevokeMatching(t *testing.T) {
+	ctx := context.Background()
+	for name, backend := range testSessionBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			store := newServerSessionStore(backend, []byte("secret"))
+			save := func(values map[interface{}]interface{}) string {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				s, _ := store.New(req, "user")
+				s.Values = values
+				assert.NoError(t, s.Save(req, httptest.NewRecorder()))
+				return s.ID
+			}
+			now := time.Now().UnixNano()
+			form := save(map[interface{}]interface{}{"sub": "alice", "auth_method": "form", "login_at": now})
+			oidc := save(map[interface{}]interface{}{"sub": "alice", "sid": "sid-1", "auth_method": "oidc", "login_at": now})
+			bob := save(map[interface{}]interface{}{"sub": "bob", "sid": "sid-2", "auth_method": "oidc", "login_at": now})
+			// not logged in sessions are not indexed
+			save(map[interface{}]interface{}{"sub": "alice", "oidc_state": "state"})
+
+			ids, err := backend.Indexed(ctx, sessionIndexKey("sub", "alice"))
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, []string{form, oidc}, ids)
+
+			count, err := store.RevokeMatching(ctx, "sub", "alice", func(values map[interface{}]interface{}) bool {
+				return values["auth_method"] == "form"
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, 1, count)
+			_, err = backend.Load(ctx, form)
+			assert.ErrorIs(t, err, errSessionNotFound)
+
+			count, err = store.RevokeMatching(ctx, "sid", "sid-1", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, count)
+			_, err = backend.Load(ctx, oidc)
+			assert.ErrorIs(t, err, errSessionNotFound)
+
+			// a logged out session is dropped from the index
+			assert.NoError(t, store.Revoke(ctx, bob))
+			count, err = store.RevokeMatching(ctx, "sub", "bob", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, 0, count)
+			ids, err = backend.Indexed(ctx, sessionIndexKey("sub", "bob"))
+			assert.NoError(t, err)
+			assert.Empty(t, ids)
+		})
+	}
+}
+
+func TestServerSessionStore_PreLoginTTL(t *testing.T) {
+	backend := newMemorySessionBackend()
+	store := newServerSessionStore(backend, []byte("secret"))
+	save := func(values map[interface{}]interface{}) time.Duration {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		s, _ := store.New(req, "user")
+		s.Values = values
+		assert.NoError(t, s.Save(req, httptest.NewRecorder()))
+		return time.Until(backend.sessions[s.ID].expireAt)
+	}
+	assert.InDelta(t, preLoginSessionTTL, save(map[interface{}]interface{}{"oidc_state": "state"}), float64(time.Second))
+	assert.InDelta(t, defaultSessionMaxAge*time.Second, save(map[interface{}]interface{}{"sub": "alice", "login_at": time.Now().UnixNano()}), float64(time.Second))
+}
+
+func TestSweepExpiredSessions(t *testing.T) {
+	ctx := context.Background()
+	backend, err := newFilesystemSessionBackend(t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, backend.Save(ctx, "ACTIVE", []byte("data"), time.Hour))
+	expired := make([]byte, 8)
+	binary.BigEndian.PutUint64(expired, uint64(time.Now().Add(-time.Minute).Unix()))
+	assert.NoError(t, os.WriteFile(filepath.Join(backend.path, "session_EXPIRED"), expired, 0600))
+
+	assert.NoError(t, sweepExpiredSessions(ctx, backend))
+	ids, err := backend.List(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ACTIVE"}, ids)
+}
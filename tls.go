@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultTLSReloadInterval is the minimum interval between checks of certificate file changes
+const defaultTLSReloadInterval = 10 * time.Second
+
+// serverCipherSuites are the TLS 1.2 cipher suites accepted, TLS 1.3 suites are not configurable
+var serverCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// certificateStore serves the certificates selected by SNI, the files are checked
+// for changes during handshakes, at most once per interval
+type certificateStore struct {
+	certFiles []string
+	keyFiles  []string
+	interval  time.Duration
+
+	mu        sync.RWMutex
+	certs     []*tls.Certificate
+	modTimes  []time.Time
+	checkedAt time.Time
+}
+
+func newCertificateStore(certFiles []string, keyFiles []string, interval time.Duration) (*certificateStore, error) {
+	if len(certFiles) == 0 {
+		return nil, errors.New("no certificate file")
+	}
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("%d certificate files but %d key files", len(certFiles), len(keyFiles))
+	}
+	s := &certificateStore{certFiles: certFiles, keyFiles: keyFiles, interval: interval}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// modTime is the latest modification time of the files of a certificate
+func (s *certificateStore) modTime(i int) time.Time {
+	latest := time.Time{}
+	for _, file := range []string{s.certFiles[i], s.keyFiles[i]} {
+		if stat, err := os.Stat(file); err == nil && stat.ModTime().After(latest) {
+			latest = stat.ModTime()
+		}
+	}
+	return latest
+}
+
+func (s *certificateStore) load() error {
+	certs := []*tls.Certificate{}
+	modTimes := []time.Time{}
+	for i := range s.certFiles {
+		modTime := s.modTime(i)
+		cert, err := tls.LoadX509KeyPair(s.certFiles[i], s.keyFiles[i])
+		if err != nil {
+			return fmt.Errorf("load %s failed: %w", s.certFiles[i], err)
+		}
+		certs = append(certs, &cert)
+		modTimes = append(modTimes, modTime)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certs = certs
+	s.modTimes = modTimes
+	return nil
+}
+
+// reloadIfChanged reloads the certificates when any file changed, a broken file
+// (like partially written) keeps the current certificates until next check
+func (s *certificateStore) reloadIfChanged() {
+	s.mu.Lock()
+	if time.Since(s.checkedAt) < s.interval {
+		s.mu.Unlock()
+		return
+	}
+	s.checkedAt = time.Now()
+	changed := false
+	for i := range s.certFiles {
+		if !s.modTime(i).Equal(s.modTimes[i]) {
+			changed = true
+		}
+	}
+	s.mu.Unlock()
+	if !changed {
+		return
+	}
+	if err := s.load(); err != nil {
+		log.Printf("reload TLS certificates failed, keep the current ones: %s", err)
+		return
+	}
+	log.Printf("TLS certificates reloaded")
+}
+
+func (s *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.reloadIfChanged()
+	s.mu.RLock()
+	certs := s.certs
+	s.mu.RUnlock()
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate is loaded")
+	}
+	for _, cert := range certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return certs[0], nil
+}
+
+// newServerTLSConfig creates the TLS config of listener from TLS_CERT_FILE and TLS_KEY_FILE,
+// comma separated for multiple certificates selected by SNI
+func newServerTLSConfig() (*tls.Config, error) {
+	certFiles, keyFiles := splitList(getenv("TLS_CERT_FILE")), splitList(getenv("TLS_KEY_FILE"))
+	interval, err := parseDurationOr("TLS_RELOAD_INTERVAL", getenv("TLS_RELOAD_INTERVAL"), defaultTLSReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newCertificateStore(certFiles, keyFiles, interval)
+	if err != nil {
+		return nil, err
+	}
+	minVersion := uint16(tls.VersionTLS12)
+	if v := getenv("TLS_MIN_VERSION"); len(v) > 0 {
+		version, ok := tlsVersions[v]
+		if !ok {
+			return nil, fmt.Errorf("%s is not a valid TLS version for TLS_MIN_VERSION", v)
+		}
+		minVersion = version
+	}
+	clientCAs, err := loadClientCAs()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   serverCipherSuites,
+		GetCertificate: store.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if clientCAs != nil {
+		// ClientCertMiddleware requires the certificate, so public paths and
+		// other authentication methods still work without one
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// createHttpsRedirectHandler redirects plain HTTP requests to the TLS listener on tlsAddr
+func createHttpsRedirectHandler(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if len(port) > 0 && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := &url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, target.String(), status)
+	})
+}
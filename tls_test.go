@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startTLSServer serves handler with the TLS config of settings, returns its address
+func startTLSServer(t *testing.T, handler http.Handler) string {
+	config, err := newServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler, TLSConfig: config}
+	go server.ServeTLS(ln, "", "")
+	t.Cleanup(func() { server.Close() })
+	return ln.Addr().String()
+}
+
+func tlsClient(ca *testCertificate, serverName string) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: serverName},
+		ForceAttemptHTTP2: true,
+	}}
+}
+
+func TestServerTLS_SNI(t *testing.T) {
+	ca := newTestCA(t)
+	certA, keyA := newTestServerCertificate(t, ca, "a.example.com").writeFiles(t)
+	certB, keyB := newTestServerCertificate(t, ca, "b.example.com").writeFiles(t)
+	t.Setenv("TLS_CERT_FILE", certA+","+certB)
+	t.Setenv("TLS_KEY_FILE", keyA+","+keyB)
+
+	addr := startTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		resp, err := tlsClient(ca, name).Get("https://" + addr)
+		if assert.NoError(t, err) {
+			assert.Equal(t, name, resp.TLS.PeerCertificates[0].Subject.CommonName)
+			assert.Equal(t, "HTTP/2.0", resp.Header.Get("X-Proto"))
+			resp.Body.Close()
+		}
+	}
+}
+
+func TestServerTLS_Reload(t *testing.T) {
+	ca := newTestCA(t)
+	first := newTestServerCertificate(t, ca, "app.example.com")
+	certFile, keyFile := first.writeFiles(t)
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	t.Setenv("TLS_RELOAD_INTERVAL", "1ms")
+	addr := startTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serial := func() string {
+		client := tlsClient(ca, "app.example.com")
+		defer client.CloseIdleConnections()
+		resp, err := client.Get("https://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].SerialNumber.String()
+	}
+	assert.Equal(t, first.cert.SerialNumber.String(), serial())
+
+	// broken file keeps the current certificate
+	future := time.Now().Add(time.Minute)
+	os.WriteFile(certFile, []byte("broken"), 0600)
+	os.Chtimes(certFile, future, future)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, first.cert.SerialNumber.String(), serial())
+
+	second := newTestServerCertificate(t, ca, "app.example.com")
+	newCertFile, newKeyFile := second.writeFiles(t)
+	for from, to := range map[string]string{newCertFile: certFile, newKeyFile: keyFile} {
+		content, _ := os.ReadFile(from)
+		os.WriteFile(to, content, 0600)
+		future = future.Add(time.Second)
+		os.Chtimes(to, future, future)
+	}
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, second.cert.SerialNumber.String(), serial())
+}
+
+func TestServerTLS_MinVersion(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := newTestServerCertificate(t, ca, "app.example.com").writeFiles(t)
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	addr := startTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	client := tlsClient(ca, "app.example.com")
+	client.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tls.VersionTLS11
+	_, err := client.Get("https://" + addr)
+	assert.Error(t, err)
+
+	t.Setenv("TLS_MIN_VERSION", "1.5")
+	_, err = newServerTLSConfig()
+	assert.Error(t, err)
+	t.Setenv("TLS_MIN_VERSION", "")
+	t.Setenv("TLS_KEY_FILE", "")
+	_, err = newServerTLSConfig()
+	assert.Error(t, err)
+
+	// a list without any file is rejected instead of failing the handshake
+	t.Setenv("TLS_CERT_FILE", ",")
+	t.Setenv("TLS_KEY_FILE", ",")
+	_, err = newServerTLSConfig()
+	assert.Error(t, err)
+	_, err = (&certificateStore{}).GetCertificate(&tls.ClientHelloInfo{})
+	assert.Error(t, err)
+}
+
+func TestHttpsRedirectHandler(t *testing.T) {
+	rr := serve(createHttpsRedirectHandler(":8443"), httptest.NewRequest(http.MethodGet, "http://app.example.com:8080/a/b?c=d", nil))
+	assert.Equal(t, http.StatusMovedPermanently, rr.Code)
+	assert.Equal(t, "https://app.example.com:8443/a/b?c=d", rr.Header().Get("Location"))
+
+	rr = serve(createHttpsRedirectHandler(":443"), httptest.NewRequest(http.MethodPost, "http://app.example.com/form", nil))
+	assert.Equal(t, http.StatusPermanentRedirect, rr.Code)
+	assert.Equal(t, "https://app.example.com/form", rr.Header().Get("Location"))
+}
+
+func TestHstsMiddleware(t *testing.T) {
+	assert.False(t, must(NewHstsMiddleware()).Enabled())
+
+	t.Setenv("HSTS_MAX_AGE", "31536000")
+	t.Setenv("HSTS_INCLUDE_SUBDOMAINS", "true")
+	m := must(NewHstsMiddleware())
+	assert.True(t, m.Enabled())
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rr := serve(handler, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+	assert.Empty(t, rr.Header().Get("Strict-Transport-Security"))
+
+	rr = serve(handler, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+	assert.Equal(t, "max-age=31536000; includeSubDomains", rr.Header().Get("Strict-Transport-Security"))
+}
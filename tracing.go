@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/samber/lo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	tracerName                = "github.com/Soontao/secure-app-proxy"
+	defaultTracingServiceName = "secure-app-proxy"
+)
+
+// tracingExporters are the accepted values of TRACING_EXPORTER
+var tracingExporters = []string{"otlp", "stdout"}
+
+// tracePropagator reads and writes the W3C traceparent and tracestate headers
+var tracePropagator = propagation.TraceContext{}
+
+type tracingSettings struct {
+	exporter    string
+	endpoint    string
+	sampleRatio float64
+	serviceName string
+}
+
+func tracingSettingsFromEnv() (*tracingSettings, error) {
+	s := &tracingSettings{
+		exporter:    getenv("TRACING_EXPORTER"),
+		endpoint:    getenv("TRACING_OTLP_ENDPOINT"),
+		sampleRatio: 1,
+		serviceName: getenv("TRACING_SERVICE_NAME"),
+	}
+	if len(s.exporter) > 0 && !lo.Contains(tracingExporters, s.exporter) {
+		return nil, fmt.Errorf("TRACING_EXPORTER %q is unknown, must be one of %v", s.exporter, tracingExporters)
+	}
+	if v := getenv("TRACING_SAMPLE_RATIO"); len(v) > 0 {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("TRACING_SAMPLE_RATIO %q must be a number between 0 and 1", v)
+		}
+		s.sampleRatio = ratio
+	}
+	if len(s.serviceName) == 0 {
+		s.serviceName = defaultTracingServiceName
+	}
+	return s, nil
+}
+
+var (
+	sharedTracerProviderMu sync.Mutex
+	// sharedTracerProvider is installed as the global tracer provider, kept across the
+	// rebuild of middlewares on config reload unless the tracing settings changed
+	sharedTracerProvider    *sdktrace.TracerProvider
+	sharedTracerProviderKey string
+)
+
+// setupTracerProvider installs the tracer provider of settings, tracing is disabled
+// without exporter
+func setupTracerProvider(s *tracingSettings) error {
+	key := ""
+	if len(s.exporter) > 0 {
+		key = fmt.Sprintf("%+v", *s)
+	}
+	sharedTracerProviderMu.Lock()
+	defer sharedTracerProviderMu.Unlock()
+	if key == sharedTracerProviderKey {
+		return nil
+	}
+	var provider *sdktrace.TracerProvider
+	if len(key) > 0 {
+		exporter, err := newSpanExporter(s)
+		if err != nil {
+			return err
+		}
+		provider = sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(s.sampleRatio))),
+			sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(s.serviceName))),
+		)
+		otel.SetTracerProvider(provider)
+	} else {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	}
+	if previous := sharedTracerProvider; previous != nil {
+		// flushes the spans ended before reload
+		go previous.Shutdown(context.Background())
+	}
+	sharedTracerProvider, sharedTracerProviderKey = provider, key
+	return nil
+}
+
+func newSpanExporter(s *tracingSettings) (sdktrace.SpanExporter, error) {
+	if s.exporter == "stdout" {
+		return stdouttrace.New()
+	}
+	// the OTEL_EXPORTER_OTLP_* variables of the process apply when endpoint is absent
+	options := []otlptracehttp.Option{}
+	if len(s.endpoint) > 0 {
+		options = append(options, otlptracehttp.WithEndpointURL(s.endpoint))
+	}
+	return otlptracehttp.New(context.Background(), options...)
+}
+
+// startSpan starts a child span of the request span, a no-op when tracing is disabled
+func startSpan(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, options...)
+}
+
+// endSpan marks the span failed by err and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injectTraceContext writes the traceparent of span in ctx to the upstream request,
+// headers of client are passed through as is when the request is not traced
+func injectTraceContext(ctx context.Context, header http.Header) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	header.Del("Traceparent")
+	header.Del("Tracestate")
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// TracingMiddleware starts the span of request, continuing the trace of the
+// traceparent sent by client
+type TracingMiddleware struct {
+	enabled bool
+}
+
+func NewTracingMiddleware() (*TracingMiddleware, error) {
+	settings, err := tracingSettingsFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("tracing settings are invalid: %w", err)
+	}
+	if err := setupTracerProvider(settings); err != nil {
+		return nil, fmt.Errorf("setup tracing exporter failed: %w", err)
+	}
+	return &TracingMiddleware{enabled: len(settings.exporter) > 0}, nil
+}
+
+func (m *TracingMiddleware) Name() string {
+	return "TracingMiddleware"
+}
+
+func (m *TracingMiddleware) Enabled() bool {
+	return m.enabled
+}
+
+func (m *TracingMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeLabel(routeFromContext(ctx))
+		ctx, span := startSpan(ctx, methodLabel(r.Method)+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.ServerAddress(r.Host),
+				semconv.URLPath(r.URL.Path),
+				semconv.UserAgentOriginal(r.UserAgent()),
+			),
+		)
+		defer span.End()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpCollector is a stand-in of the OTLP/HTTP collector keeping the spans received
+type otlpCollector struct {
+	*httptest.Server
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func newOtlpCollector(t *testing.T) *otlpCollector {
+	c := &otlpCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// span returns the received span of name
+func (c *otlpCollector) span(name string) *tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// disableTracing restores the tracer provider after a test enabled tracing
+func disableTracing(t *testing.T) {
+	t.Cleanup(func() { setupTracerProvider(&tracingSettings{}) })
+}
+
+func TestTracing(t *testing.T) {
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+	}))
+	t.Cleanup(upstream.Close)
+	collector := newOtlpCollector(t)
+	disableTracing(t)
+	t.Setenv("UPSTREAM", upstream.URL)
+	t.Setenv("JWT_SECRET", "secret")
+	isolateRateLimitStore(t)
+	t.Setenv("RATE_LIMIT", "10-M")
+	t.Setenv("TRACING_EXPORTER", "otlp")
+	t.Setenv("TRACING_OTLP_ENDPOINT", collector.URL+"/v1/traces")
+	handler := must(createHandler())
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice"}).SignedString([]byte("secret"))
+	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("Tracestate", "vendor=value")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, sharedTracerProvider.ForceFlush(context.Background()))
+
+	server := collector.span("GET /")
+	if !assert.NotNil(t, server) {
+		return
+	}
+	assert.Equal(t, tracepb.Span_SPAN_KIND_SERVER, server.Kind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(server.TraceId))
+	assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(server.ParentSpanId))
+	assert.Equal(t, "vendor=value", server.TraceState)
+	for _, name := range []string{"jwt.verify", "rate_limit.lookup", "upstream GET"} {
+		if span := collector.span(name); assert.NotNil(t, span, name) {
+			assert.Equal(t, server.SpanId, span.ParentSpanId, name)
+		}
+	}
+	// the upstream continues the trace from the span of round trip
+	if span := collector.span("upstream GET"); span != nil {
+		assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+hex.EncodeToString(span.SpanId)+"-01", traceparent)
+	}
+}
+
+func TestTracing_Disabled(t *testing.T) {
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("UPSTREAM", upstream.URL)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	must(createHandler()).ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", traceparent)
+}
+
+func TestTracing_OidcExchange(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	p := newMockOidcProvider(t)
+	handler := newMockOidcMiddleware(t, p).Handler(http.NotFoundHandler())
+
+	oidcLogin(t, p, handler)
+
+	names := []string{}
+	for _, span := range recorder.Ended() {
+		names = append(names, span.Name())
+	}
+	assert.Contains(t, names, "oidc.exchange")
+}
+
+func TestTracingSettings(t *testing.T) {
+	for _, v := range []string{"-0.1", "2", "all"} {
+		t.Setenv("TRACING_SAMPLE_RATIO", v)
+		_, err := tracingSettingsFromEnv()
+		assert.Error(t, err, v)
+	}
+	t.Setenv("TRACING_SAMPLE_RATIO", "0.25")
+	t.Setenv("TRACING_EXPORTER", "jaeger")
+	_, err := tracingSettingsFromEnv()
+	assert.Error(t, err)
+
+	t.Setenv("TRACING_EXPORTER", "stdout")
+	settings, err := tracingSettingsFromEnv()
+	if assert.NoError(t, err) {
+		assert.Equal(t, &tracingSettings{exporter: "stdout", sampleRatio: 0.25, serviceName: "secure-app-proxy"}, settings)
+	}
+}
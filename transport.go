@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultMaxIdleConns        = 100
+)
+
+// tlsVersions are the accepted values of min_tls_version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TransportConfig is how the proxy connects to the upstreams of a route, empty
+// fields use the UPSTREAM_* environment variables
+type TransportConfig struct {
+	// CAFile is the PEM bundle trusted for upstream certificates, system pool when empty
+	CAFile string `yaml:"ca_file" json:"ca_file"`
+	// CertFile and KeyFile are the client certificate presented to upstream
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+	// ServerName overrides the SNI and the name verified in upstream certificate
+	ServerName    string `yaml:"server_name" json:"server_name"`
+	MinTLSVersion string `yaml:"min_tls_version" json:"min_tls_version"`
+	// InsecureSkipVerify disables upstream certificate verification, for development only
+	InsecureSkipVerify string `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+	// HTTP2 enables HTTP/2 to TLS upstreams, default true
+	HTTP2                 string `yaml:"http2" json:"http2"`
+	DialTimeout           string `yaml:"dial_timeout" json:"dial_timeout"`
+	TLSHandshakeTimeout   string `yaml:"tls_handshake_timeout" json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout string `yaml:"response_header_timeout" json:"response_header_timeout"`
+	IdleConnTimeout       string `yaml:"idle_conn_timeout" json:"idle_conn_timeout"`
+	MaxIdleConns          string `yaml:"max_idle_conns" json:"max_idle_conns"`
+	MaxIdleConnsPerHost   string `yaml:"max_idle_conns_per_host" json:"max_idle_conns_per_host"`
+	MaxConnsPerHost       string `yaml:"max_conns_per_host" json:"max_conns_per_host"`
+}
+
+func transportConfigFromEnv() TransportConfig {
+	return TransportConfig{
+		CAFile:                getenv("UPSTREAM_TLS_CA_FILE"),
+		CertFile:              getenv("UPSTREAM_TLS_CERT_FILE"),
+		KeyFile:               getenv("UPSTREAM_TLS_KEY_FILE"),
+		ServerName:            getenv("UPSTREAM_TLS_SERVER_NAME"),
+		MinTLSVersion:         getenv("UPSTREAM_TLS_MIN_VERSION"),
+		InsecureSkipVerify:    getenv("UPSTREAM_TLS_INSECURE_SKIP_VERIFY"),
+		HTTP2:                 getenv("UPSTREAM_HTTP2"),
+		DialTimeout:           getenv("UPSTREAM_DIAL_TIMEOUT"),
+		TLSHandshakeTimeout:   getenv("UPSTREAM_TLS_HANDSHAKE_TIMEOUT"),
+		ResponseHeaderTimeout: getenv("UPSTREAM_RESPONSE_HEADER_TIMEOUT"),
+		IdleConnTimeout:       getenv("UPSTREAM_IDLE_CONN_TIMEOUT"),
+		MaxIdleConns:          getenv("UPSTREAM_MAX_IDLE_CONNS"),
+		MaxIdleConnsPerHost:   getenv("UPSTREAM_MAX_IDLE_CONNS_PER_HOST"),
+		MaxConnsPerHost:       getenv("UPSTREAM_MAX_CONNS_PER_HOST"),
+	}
+}
+
+// merge fills the empty fields from defaults
+func (c TransportConfig) merge(defaults TransportConfig) TransportConfig {
+	pick := func(v string, d string) string {
+		if len(v) > 0 {
+			return v
+		}
+		return d
+	}
+	return TransportConfig{
+		CAFile:                pick(c.CAFile, defaults.CAFile),
+		CertFile:              pick(c.CertFile, defaults.CertFile),
+		KeyFile:               pick(c.KeyFile, defaults.KeyFile),
+		ServerName:            pick(c.ServerName, defaults.ServerName),
+		MinTLSVersion:         pick(c.MinTLSVersion, defaults.MinTLSVersion),
+		InsecureSkipVerify:    pick(c.InsecureSkipVerify, defaults.InsecureSkipVerify),
+		HTTP2:                 pick(c.HTTP2, defaults.HTTP2),
+		DialTimeout:           pick(c.DialTimeout, defaults.DialTimeout),
+		TLSHandshakeTimeout:   pick(c.TLSHandshakeTimeout, defaults.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: pick(c.ResponseHeaderTimeout, defaults.ResponseHeaderTimeout),
+		IdleConnTimeout:       pick(c.IdleConnTimeout, defaults.IdleConnTimeout),
+		MaxIdleConns:          pick(c.MaxIdleConns, defaults.MaxIdleConns),
+		MaxIdleConnsPerHost:   pick(c.MaxIdleConnsPerHost, defaults.MaxIdleConnsPerHost),
+		MaxConnsPerHost:       pick(c.MaxConnsPerHost, defaults.MaxConnsPerHost),
+	}
+}
+
+func parseBoolOr(name string, v string, d bool) (bool, error) {
+	if len(v) == 0 {
+		return d, nil
+	}
+	parsed, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s is not a valid boolean for %s", v, name)
+	}
+	return parsed, nil
+}
+
+// tlsConfig creates the client TLS config of upstream connections
+func (c TransportConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: c.ServerName}
+	if len(c.MinTLSVersion) > 0 {
+		version, ok := tlsVersions[c.MinTLSVersion]
+		if !ok {
+			return nil, fmt.Errorf("%s is not a valid TLS version for min_tls_version", c.MinTLSVersion)
+		}
+		config.MinVersion = version
+	}
+	if len(c.CAFile) > 0 {
+		content, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in %s", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if len(c.CertFile) > 0 || len(c.KeyFile) > 0 {
+		if len(c.CertFile) == 0 || len(c.KeyFile) == 0 {
+			return nil, errors.New("cert_file and key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	insecure, err := parseBoolOr("insecure_skip_verify", c.InsecureSkipVerify, false)
+	if err != nil {
+		return nil, err
+	}
+	config.InsecureSkipVerify = insecure
+	return config, nil
+}
+
+// build creates the transport of upstream connections
+func (c TransportConfig) build() (*http.Transport, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	http2, err := parseBoolOr("http2", c.HTTP2, true)
+	if err != nil {
+		return nil, err
+	}
+	dialTimeout, err := parseDurationOr("dial_timeout", c.DialTimeout, defaultDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	tlsHandshakeTimeout, err := parseDurationOr("tls_handshake_timeout", c.TLSHandshakeTimeout, defaultTLSHandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	responseHeaderTimeout, err := parseDurationOr("response_header_timeout", c.ResponseHeaderTimeout, 0)
+	if err != nil {
+		return nil, err
+	}
+	idleConnTimeout, err := parseDurationOr("idle_conn_timeout", c.IdleConnTimeout, defaultIdleConnTimeout)
+	if err != nil {
+		return nil, err
+	}
+	maxIdleConns, err := parseCountOr("max_idle_conns", c.MaxIdleConns, defaultMaxIdleConns)
+	if err != nil {
+		return nil, err
+	}
+	maxIdleConnsPerHost, err := parseCountOr("max_idle_conns_per_host", c.MaxIdleConnsPerHost, 0)
+	if err != nil {
+		return nil, err
+	}
+	maxConnsPerHost, err := parseCountOr("max_conns_per_host", c.MaxConnsPerHost, 0)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig.InsecureSkipVerify {
+		log.Printf("WARNING: upstream certificate verification is disabled")
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		IdleConnTimeout:       idleConnTimeout,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       maxConnsPerHost,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     http2,
+	}
+	if !http2 {
+		// non-nil empty map disables HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCertificate is a certificate and its key, issued by a test CA
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCertificate {
+	return issueTestCertificate(t, nil, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+}
+
+// issueTestCertificate signs template by ca, self-signed when ca is nil
+func issueTestCertificate(t *testing.T, ca *testCertificate, template *x509.Certificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCertificate{cert: cert, key: key}
+}
+
+func newTestServerCertificate(t *testing.T, ca *testCertificate, names ...string) *testCertificate {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: names[0]},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	return issueTestCertificate(t, ca, template)
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// writeFiles writes certificate and key as PEM files, returns their paths
+func (c *testCertificate) writeFiles(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	keyDer, _ := x509.MarshalECPrivateKey(c.key)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func newTestTLSUpstream(t *testing.T, cert *testCertificate, configure func(*tls.Config)) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Header().Set("X-Client", r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert.tlsCertificate()}}
+	if configure != nil {
+		configure(server.TLS)
+	}
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func proxyThrough(t *testing.T, upstream string, transport *TransportConfig) *httptest.ResponseRecorder {
+	route := &Route{Upstream: upstream, Transport: transport, LoadBalancer: &LoadBalancerConfig{MaxFails: "0"}}
+	if err := route.compile(); err != nil {
+		t.Fatal(err)
+	}
+	proxy := createProxyHandler([]*Route{route})
+	defer proxy.Close()
+	return serve((&RouteMatcher{routes: []*Route{route}}).Handler(proxy), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestTransport_PrivateCA(t *testing.T) {
+	ca := newTestCA(t)
+	caFile, _ := ca.writeFiles(t)
+	upstream := newTestTLSUpstream(t, newTestServerCertificate(t, ca, "127.0.0.1"), nil)
+
+	rr := proxyThrough(t, upstream.URL, &TransportConfig{})
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+
+	rr = proxyThrough(t, upstream.URL, &TransportConfig{CAFile: caFile})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "HTTP/2.0", rr.Header().Get("X-Proto"))
+
+	rr = proxyThrough(t, upstream.URL, &TransportConfig{CAFile: caFile, HTTP2: "false"})
+	assert.Equal(t, "HTTP/1.1", rr.Header().Get("X-Proto"))
+
+	rr = proxyThrough(t, upstream.URL, &TransportConfig{InsecureSkipVerify: "true"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestTransport_ServerName(t *testing.T) {
+	ca := newTestCA(t)
+	caFile, _ := ca.writeFiles(t)
+	upstream := newTestTLSUpstream(t, newTestServerCertificate(t, ca, "upstream.internal"), nil)
+
+	assert.Equal(t, http.StatusBadGateway, proxyThrough(t, upstream.URL, &TransportConfig{CAFile: caFile}).Code)
+	assert.Equal(t, http.StatusOK, proxyThrough(t, upstream.URL, &TransportConfig{CAFile: caFile, ServerName: "upstream.internal"}).Code)
+}
+
+func TestTransport_ClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	caFile, _ := ca.writeFiles(t)
+	upstream := newTestTLSUpstream(t, newTestServerCertificate(t, ca, "127.0.0.1"), func(c *tls.Config) {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		c.ClientCAs = x509.NewCertPool()
+		c.ClientCAs.AddCert(ca.cert)
+	})
+	client := issueTestCertificate(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	certFile, keyFile := client.writeFiles(t)
+
+	assert.Equal(t, http.StatusBadGateway, proxyThrough(t, upstream.URL, &TransportConfig{CAFile: caFile}).Code)
+	rr := proxyThrough(t, upstream.URL, &TransportConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "proxy", rr.Header().Get("X-Client"))
+}
+
+func TestTransport_HealthCheck(t *testing.T) {
+	ca := newTestCA(t)
+	caFile, _ := ca.writeFiles(t)
+	probes := atomic.Int32{}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			probes.Add(1)
+		}
+	}))
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{newTestServerCertificate(t, ca, "127.0.0.1").tlsCertificate()}}
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+
+	route := &Route{
+		Upstream:     upstream.URL,
+		Transport:    &TransportConfig{CAFile: caFile},
+		LoadBalancer: &LoadBalancerConfig{HealthCheckPath: "/healthz", HealthCheckInterval: "10ms"},
+	}
+	assert.NoError(t, route.compile())
+	proxy := createProxyHandler([]*Route{route})
+	t.Cleanup(func() { proxy.Close() })
+
+	// probes trust the upstream CA like proxied requests
+	assert.Eventually(t, func() bool { return probes.Load() >= 2 }, time.Second, 5*time.Millisecond)
+	assert.True(t, proxy.pools[route].targets[0].healthy.Load())
+	assert.Equal(t, http.StatusOK, serve((&RouteMatcher{routes: []*Route{route}}).Handler(proxy), httptest.NewRequest(http.MethodGet, "/", nil)).Code)
+}
+
+func TestTransport_MinTLSVersion(t *testing.T) {
+	ca := newTestCA(t)
+	caFile, _ := ca.writeFiles(t)
+	upstream := newTestTLSUpstream(t, newTestServerCertificate(t, ca, "127.0.0.1"), func(c *tls.Config) {
+		c.MaxVersion = tls.VersionTLS12
+	})
+	assert.Equal(t, http.StatusOK, proxyThrough(t, upstream.URL, &TransportConfig{CAFile: caFile, MinTLSVersion: "1.2"}).Code)
+	assert.Equal(t, http.StatusBadGateway, proxyThrough(t, upstream.URL, &TransportConfig{CAFile: caFile, MinTLSVersion: "1.3"}).Code)
+}
+
+func TestTransport_ResponseHeaderTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	rr := proxyThrough(t, slow.URL, &TransportConfig{ResponseHeaderTimeout: "20ms"})
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Contains(t, rr.Body.String(), "UPSTREAM_TIMEOUT")
+}
+
+func TestTransportConfig_Invalid(t *testing.T) {
+	for _, c := range []TransportConfig{
+		{CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		{CertFile: "cert.pem"},
+		{MinTLSVersion: "1.4"},
+		{HTTP2: "maybe"},
+		{DialTimeout: "soon"},
+		{MaxIdleConns: "many"},
+	} {
+		_, err := c.build()
+		assert.Error(t, err)
+	}
+
+	t.Setenv("UPSTREAM_MAX_IDLE_CONNS", "10")
+	transport, err := (&TransportConfig{MaxIdleConnsPerHost: "5"}).merge(transportConfigFromEnv()).build()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, transport.MaxIdleConns)
+	assert.Equal(t, 5, transport.MaxIdleConnsPerHost)
+}
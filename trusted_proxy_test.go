@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedProxies_ClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1, ::1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	cases := []struct {
+		remote string
+		xff    string
+		client string
+	}{
+		// direct clients can not spoof
+		{"203.0.113.9:1234", "198.51.100.1", "203.0.113.9"},
+		{"10.0.0.2:1234", "198.51.100.1", "198.51.100.1"},
+		// the spoofed leftmost hop is ignored
+		{"10.0.0.2:1234", "1.1.1.1, 198.51.100.1, 10.0.0.3", "198.51.100.1"},
+		{"192.168.1.1:1234", "", "192.168.1.1"},
+		{"[::1]:1234", "2001:db8::1", "2001:db8::1"},
+		{"10.0.0.2:1234", "garbage", "10.0.0.2"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = c.remote
+		if len(c.xff) > 0 {
+			req.Header.Set("X-Forwarded-For", c.xff)
+		}
+		assert.Equal(t, c.client, proxies.clientIP(req), c)
+	}
+
+	_, err = parseTrustedProxies("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = parseTrustedProxies("proxy.local")
+	assert.Error(t, err)
+}
@@ -5,6 +5,8 @@ import "net/http"
 type ErrorMessage struct {
 	Code         string
 	ErrorMessage string
+	// RequestID correlates the error with logs of proxy and upstream
+	RequestID string `json:",omitempty"`
 }
 
 type Middleware interface {
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+const (
+	lbRoundRobin     = "round_robin"
+	lbLeastConn      = "least_conn"
+	lbConsistentHash = "consistent_hash"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultMaxFails            = 3
+	defaultFailTimeout         = 30 * time.Second
+	// hashRingReplicas is the virtual nodes of each target on the hash ring
+	hashRingReplicas = 100
+)
+
+// LoadBalancerConfig is how the requests of a route are spread across its upstreams
+// and how their failures are handled, empty fields use the UPSTREAM_* environment
+// variables
+type LoadBalancerConfig struct {
+	// Strategy is round_robin (default), least_conn or consistent_hash
+	Strategy string `yaml:"strategy" json:"strategy"`
+	// HashKey is subject (default), ip, cookie:<name> or header:<name>
+	HashKey string `yaml:"hash_key" json:"hash_key"`
+	// HealthCheckPath enables active health probes when set
+	HealthCheckPath     string `yaml:"health_check_path" json:"health_check_path"`
+	HealthCheckInterval string `yaml:"health_check_interval" json:"health_check_interval"`
+	HealthCheckTimeout  string `yaml:"health_check_timeout" json:"health_check_timeout"`
+	// MaxFails is the consecutive failures ejecting a target, 0 disables ejection
+	MaxFails string `yaml:"max_fails" json:"max_fails"`
+	// FailTimeout is how long an ejected target stays out
+	FailTimeout string `yaml:"fail_timeout" json:"fail_timeout"`
+	// Retries is the retries of idempotent requests failed, default 0
+	Retries string `yaml:"retries" json:"retries"`
+	// RetryBackoff is the wait before first retry, doubled for each next one
+	RetryBackoff string `yaml:"retry_backoff" json:"retry_backoff"`
+	// RetryMaxBody is the largest request body in bytes buffered for retries
+	RetryMaxBody string `yaml:"retry_max_body" json:"retry_max_body"`
+	// CircuitBreakerThreshold is the consecutive failures opening the circuit, 0 disables
+	CircuitBreakerThreshold string `yaml:"circuit_breaker_threshold" json:"circuit_breaker_threshold"`
+	// CircuitBreakerTimeout is how long the circuit stays open before a trial request
+	CircuitBreakerTimeout string `yaml:"circuit_breaker_timeout" json:"circuit_breaker_timeout"`
+}
+
+// loadBalancerSettings is the parsed LoadBalancerConfig
+type loadBalancerSettings struct {
+	strategy            string
+	hashKey             string
+	healthCheckPath     string
+	healthCheckInterval time.Duration
+	healthCheckTimeout  time.Duration
+	maxFails            int
+	failTimeout         time.Duration
+	retries             int
+	retryBackoff        time.Duration
+	retryMaxBody        int64
+	breakerThreshold    int
+	breakerTimeout      time.Duration
+	// proxies resolves the client IP of ip hash key
+	proxies trustedProxies
+}
+
+func loadBalancerConfigFromEnv() LoadBalancerConfig {
+	return LoadBalancerConfig{
+		Strategy:                getenv("UPSTREAM_LB_STRATEGY"),
+		HashKey:                 getenv("UPSTREAM_HASH_KEY"),
+		HealthCheckPath:         getenv("UPSTREAM_HEALTH_CHECK_PATH"),
+		HealthCheckInterval:     getenv("UPSTREAM_HEALTH_CHECK_INTERVAL"),
+		HealthCheckTimeout:      getenv("UPSTREAM_HEALTH_CHECK_TIMEOUT"),
+		MaxFails:                getenv("UPSTREAM_MAX_FAILS"),
+		FailTimeout:             getenv("UPSTREAM_FAIL_TIMEOUT"),
+		Retries:                 getenv("UPSTREAM_RETRIES"),
+		RetryBackoff:            getenv("UPSTREAM_RETRY_BACKOFF"),
+		RetryMaxBody:            getenv("UPSTREAM_RETRY_MAX_BODY"),
+		CircuitBreakerThreshold: getenv("UPSTREAM_CIRCUIT_BREAKER_THRESHOLD"),
+		CircuitBreakerTimeout:   getenv("UPSTREAM_CIRCUIT_BREAKER_TIMEOUT"),
+	}
+}
+
+// merge fills the empty fields from defaults
+func (c LoadBalancerConfig) merge(defaults LoadBalancerConfig) LoadBalancerConfig {
+	pick := func(v string, d string) string {
+		if len(v) > 0 {
+			return v
+		}
+		return d
+	}
+	return LoadBalancerConfig{
+		Strategy:                pick(c.Strategy, defaults.Strategy),
+		HashKey:                 pick(c.HashKey, defaults.HashKey),
+		HealthCheckPath:         pick(c.HealthCheckPath, defaults.HealthCheckPath),
+		HealthCheckInterval:     pick(c.HealthCheckInterval, defaults.HealthCheckInterval),
+		HealthCheckTimeout:      pick(c.HealthCheckTimeout, defaults.HealthCheckTimeout),
+		MaxFails:                pick(c.MaxFails, defaults.MaxFails),
+		FailTimeout:             pick(c.FailTimeout, defaults.FailTimeout),
+		Retries:                 pick(c.Retries, defaults.Retries),
+		RetryBackoff:            pick(c.RetryBackoff, defaults.RetryBackoff),
+		RetryMaxBody:            pick(c.RetryMaxBody, defaults.RetryMaxBody),
+		CircuitBreakerThreshold: pick(c.CircuitBreakerThreshold, defaults.CircuitBreakerThreshold),
+		CircuitBreakerTimeout:   pick(c.CircuitBreakerTimeout, defaults.CircuitBreakerTimeout),
+	}
+}
+
+func parseDurationOr(name string, v string, d time.Duration) (time.Duration, error) {
+	if len(v) == 0 {
+		return d, nil
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid duration for %s", v, name)
+	}
+	return parsed, nil
+}
+
+// parsePositiveDurationOr rejects 0 and negative durations, e.g. of tickers and timeouts
+func parsePositiveDurationOr(name string, v string, d time.Duration) (time.Duration, error) {
+	parsed, err := parseDurationOr(name, v, d)
+	if err != nil {
+		return 0, err
+	}
+	if parsed <= 0 {
+		return 0, fmt.Errorf("%s must be positive for %s", v, name)
+	}
+	return parsed, nil
+}
+
+func parseCountOr(name string, v string, d int) (int, error) {
+	if len(v) == 0 {
+		return d, nil
+	}
+	parsed, err := strconv.Atoi(v)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("%s is not a valid number for %s", v, name)
+	}
+	return parsed, nil
+}
+
+func (c LoadBalancerConfig) parse() (*loadBalancerSettings, error) {
+	s := &loadBalancerSettings{
+		strategy:        c.Strategy,
+		hashKey:         c.HashKey,
+		healthCheckPath: c.HealthCheckPath,
+	}
+	switch s.strategy {
+	case "":
+		s.strategy = lbRoundRobin
+	case lbRoundRobin, lbLeastConn, lbConsistentHash:
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", s.strategy)
+	}
+	switch {
+	case s.hashKey == "":
+		s.hashKey = "subject"
+	case s.hashKey == "subject", s.hashKey == "ip":
+	case strings.HasPrefix(s.hashKey, "cookie:"), strings.HasPrefix(s.hashKey, "header:"):
+	default:
+		return nil, fmt.Errorf("unknown hash key %q", s.hashKey)
+	}
+	var err error
+	if s.healthCheckInterval, err = parsePositiveDurationOr("health_check_interval", c.HealthCheckInterval, defaultHealthCheckInterval); err != nil {
+		return nil, err
+	}
+	if s.healthCheckTimeout, err = parsePositiveDurationOr("health_check_timeout", c.HealthCheckTimeout, defaultHealthCheckTimeout); err != nil {
+		return nil, err
+	}
+	if s.failTimeout, err = parsePositiveDurationOr("fail_timeout", c.FailTimeout, defaultFailTimeout); err != nil {
+		return nil, err
+	}
+	if s.retryBackoff, err = parsePositiveDurationOr("retry_backoff", c.RetryBackoff, defaultRetryBackoff); err != nil {
+		return nil, err
+	}
+	if s.breakerTimeout, err = parsePositiveDurationOr("circuit_breaker_timeout", c.CircuitBreakerTimeout, defaultFailTimeout); err != nil {
+		return nil, err
+	}
+	if s.maxFails, err = parseCountOr("max_fails", c.MaxFails, defaultMaxFails); err != nil {
+		return nil, err
+	}
+	if s.retries, err = parseCountOr("retries", c.Retries, 0); err != nil {
+		return nil, err
+	}
+	if s.breakerThreshold, err = parseCountOr("circuit_breaker_threshold", c.CircuitBreakerThreshold, 0); err != nil {
+		return nil, err
+	}
+	retryMaxBody, err := parseCountOr("retry_max_body", c.RetryMaxBody, defaultRetryMaxBody)
+	if err != nil {
+		return nil, err
+	}
+	s.retryMaxBody = int64(retryMaxBody)
+	if s.proxies, err = parseTrustedProxies(getenv("TRUSTED_PROXIES")); err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES is invalid: %w", err)
+	}
+	return s, nil
+}
+
+// upstreamTarget is an instance of upstream
+type upstreamTarget struct {
+	url *url.URL
+	// inflight is the requests being proxied to the target
+	inflight atomic.Int64
+	// healthy is the result of the last active probe
+	healthy atomic.Bool
+
+	mu           sync.Mutex
+	fails        int
+	ejectedUntil time.Time
+}
+
+func (t *upstreamTarget) available(now time.Time) bool {
+	if !t.healthy.Load() {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !now.Before(t.ejectedUntil)
+}
+
+type hashRingNode struct {
+	hash   uint32
+	target *upstreamTarget
+}
+
+// upstreamPool selects the target of each request and tracks the health of targets
+type upstreamPool struct {
+	targets  []*upstreamTarget
+	settings *loadBalancerSettings
+	counter  atomic.Uint64
+	ring     []hashRingNode
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func upstreamTargetFromContext(ctx context.Context) *upstreamTarget {
+	if attempt := proxyAttemptFromContext(ctx); attempt != nil {
+		return attempt.target
+	}
+	return nil
+}
+
+func newUpstreamPool(urls []*url.URL, settings *loadBalancerSettings) *upstreamPool {
+	p := &upstreamPool{settings: settings, stop: make(chan struct{})}
+	for _, u := range urls {
+		target := &upstreamTarget{url: u}
+		target.healthy.Store(true)
+		p.targets = append(p.targets, target)
+		for i := 0; i < hashRingReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(u.String() + "#" + strconv.Itoa(i)))
+			p.ring = append(p.ring, hashRingNode{hash, target})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	return p
+}
+
+// pick selects the target for request, nil when no target is available
+func (p *upstreamPool) pick(r *http.Request) *upstreamTarget {
+	now := time.Now()
+	available := lo.Filter(p.targets, func(t *upstreamTarget, _ int) bool { return t.available(now) })
+	if len(available) == 0 {
+		return nil
+	}
+	start := int(p.counter.Add(1) - 1)
+	switch p.settings.strategy {
+	case lbLeastConn:
+		// scan from rotating offset, so ties are spread
+		selected := available[start%len(available)]
+		for i := 1; i < len(available); i++ {
+			candidate := available[(start+i)%len(available)]
+			if candidate.inflight.Load() < selected.inflight.Load() {
+				selected = candidate
+			}
+		}
+		return selected
+	case lbConsistentHash:
+		hash := crc32.ChecksumIEEE([]byte(p.hashKey(r)))
+		i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+		for n := 0; n < len(p.ring); n++ {
+			node := p.ring[(i+n)%len(p.ring)]
+			if node.target.available(now) {
+				return node.target
+			}
+		}
+		return nil
+	}
+	return available[start%len(available)]
+}
+
+// hashKey is the value of request hashed by consistent_hash, client ip when absent
+func (p *upstreamPool) hashKey(r *http.Request) string {
+	key := p.settings.hashKey
+	switch {
+	case key == "subject":
+		if identity := identityFromContext(r.Context()); identity != nil && len(identity.Subject) > 0 {
+			return identity.Subject
+		}
+	case strings.HasPrefix(key, "cookie:"):
+		if c, err := r.Cookie(strings.TrimPrefix(key, "cookie:")); err == nil {
+			return c.Value
+		}
+	case strings.HasPrefix(key, "header:"):
+		if v := r.Header.Get(strings.TrimPrefix(key, "header:")); len(v) > 0 {
+			return v
+		}
+	}
+	return p.settings.proxies.clientIP(r)
+}
+
+// report records the result of a proxied request, consecutive failures eject the target
+func (p *upstreamPool) report(t *upstreamTarget, failed bool) {
+	if t == nil || p.settings.maxFails == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !failed {
+		t.fails = 0
+		return
+	}
+	t.fails++
+	if t.fails >= p.settings.maxFails {
+		t.fails = 0
+		t.ejectedUntil = time.Now().Add(p.settings.failTimeout)
+		log.Printf("upstream %s is ejected for %s", t.url, p.settings.failTimeout)
+	}
+}
+
+// startHealthChecks probes the targets in background until the pool is closed
+func (p *upstreamPool) startHealthChecks(transport http.RoundTripper) {
+	if len(p.settings.healthCheckPath) == 0 {
+		return
+	}
+	// probes share the transport of route, so the upstream CA and client certificate apply
+	client := &http.Client{Transport: transport, Timeout: p.settings.healthCheckTimeout}
+	go func() {
+		ticker := time.NewTicker(p.settings.healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			for _, target := range p.targets {
+				p.probe(client, target)
+			}
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// probe marks target healthy on 2xx or 3xx response of the health check path
+func (p *upstreamPool) probe(client *http.Client, t *upstreamTarget) {
+	healthy := false
+	resp, err := client.Get(t.url.JoinPath(p.settings.healthCheckPath).String())
+	if err == nil {
+		resp.Body.Close()
+		healthy = resp.StatusCode >= 200 && resp.StatusCode < 400
+	}
+	if t.healthy.Swap(healthy) != healthy {
+		if healthy {
+			log.Printf("upstream %s is healthy again", t.url)
+		} else {
+			log.Printf("upstream %s failed health check", t.url)
+		}
+	}
+}
+
+// Close stops the health checks
+func (p *upstreamPool) Close() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testBackend is a local upstream instance, status and health can be switched
+type testBackend struct {
+	*httptest.Server
+	name    string
+	status  atomic.Int32
+	healthy atomic.Bool
+	release chan struct{}
+}
+
+func newTestBackend(t *testing.T, name string) *testBackend {
+	b := &testBackend{name: name}
+	b.status.Store(http.StatusOK)
+	b.healthy.Store(true)
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			if !b.healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		if r.URL.Path == "/slow" && b.release != nil {
+			<-b.release
+		}
+		w.Header().Set("X-Upstream", name)
+		w.WriteHeader(int(b.status.Load()))
+	}))
+	t.Cleanup(b.Server.Close)
+	return b
+}
+
+func newTestPoolHandler(t *testing.T, lb *LoadBalancerConfig, backends ...*testBackend) (http.Handler, *upstreamPool) {
+	route := &Route{LoadBalancer: lb}
+	for _, b := range backends {
+		route.Upstreams = append(route.Upstreams, b.URL)
+	}
+	assert.NoError(t, route.compile())
+	proxy := createProxyHandler([]*Route{route})
+	t.Cleanup(func() { proxy.Close() })
+	return (&RouteMatcher{routes: []*Route{route}}).Handler(proxy), proxy.pools[route]
+}
+
+func serve(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestUpstreamPool_RoundRobin(t *testing.T) {
+	a, b, c := newTestBackend(t, "a"), newTestBackend(t, "b"), newTestBackend(t, "c")
+	handler, _ := newTestPoolHandler(t, nil, a, b, c)
+
+	hits := map[string]int{}
+	for i := 0; i < 9; i++ {
+		hits[serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)).Header().Get("X-Upstream")]++
+	}
+	assert.Equal(t, map[string]int{"a": 3, "b": 3, "c": 3}, hits)
+}
+
+func TestUpstreamPool_LeastConn(t *testing.T) {
+	a, b := newTestBackend(t, "a"), newTestBackend(t, "b")
+	a.release = make(chan struct{})
+	b.release = make(chan struct{})
+	handler, pool := newTestPoolHandler(t, &LoadBalancerConfig{Strategy: lbLeastConn}, a, b)
+
+	// hold a request on one of the targets
+	done := make(chan string)
+	go func() {
+		done <- serve(handler, httptest.NewRequest(http.MethodGet, "/slow", nil)).Header().Get("X-Upstream")
+	}()
+	assert.Eventually(t, func() bool {
+		return pool.targets[0].inflight.Load()+pool.targets[1].inflight.Load() == 1
+	}, time.Second, time.Millisecond)
+	busy := "a"
+	if pool.targets[1].inflight.Load() == 1 {
+		busy = "b"
+	}
+
+	for i := 0; i < 4; i++ {
+		assert.NotEqual(t, busy, serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)).Header().Get("X-Upstream"))
+	}
+	close(a.release)
+	close(b.release)
+	assert.Equal(t, busy, <-done)
+}
+
+func TestUpstreamPool_ConsistentHash(t *testing.T) {
+	a, b, c := newTestBackend(t, "a"), newTestBackend(t, "b"), newTestBackend(t, "c")
+	handler, pool := newTestPoolHandler(t, &LoadBalancerConfig{Strategy: lbConsistentHash}, a, b, c)
+
+	request := func(subject string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = withIdentity(req, newIdentity("jwt", map[string]interface{}{"sub": subject}))
+		return serve(handler, req).Header().Get("X-Upstream")
+	}
+
+	assignment := map[string]string{}
+	used := map[string]bool{}
+	// enough subjects that every target gets some on the ring of random ports
+	for i := 0; i < 300; i++ {
+		subject := fmt.Sprintf("user-%d", i)
+		assignment[subject] = request(subject)
+		used[assignment[subject]] = true
+		// sticky
+		assert.Equal(t, assignment[subject], request(subject))
+	}
+	assert.Len(t, used, 3)
+
+	// removing a target only moves the subjects assigned to it
+	pool.targets[0].healthy.Store(false)
+	for subject, name := range assignment {
+		if name != "a" {
+			assert.Equal(t, name, request(subject))
+		} else {
+			assert.NotEqual(t, "a", request(subject))
+		}
+	}
+}
+
+func TestUpstreamPool_HashKeyCookie(t *testing.T) {
+	pool := newUpstreamPool([]*url.URL{{Scheme: "http", Host: "a"}}, &loadBalancerSettings{hashKey: "cookie:session"})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "10.0.0.1", pool.hashKey(req))
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	assert.Equal(t, "abc", pool.hashKey(req))
+}
+
+func TestUpstreamPool_HashKeyIP(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	settings, err := (&LoadBalancerConfig{Strategy: lbConsistentHash, HashKey: "ip"}).parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	pool := newUpstreamPool([]*url.URL{{Scheme: "http", Host: "a"}}, settings)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	// the client behind the trusted load balancer
+	assert.Equal(t, "203.0.113.9", pool.hashKey(req))
+
+	// a client can not pick the target by spoofing the header
+	req.RemoteAddr = "198.51.100.1:1234"
+	assert.Equal(t, "198.51.100.1", pool.hashKey(req))
+}
+
+func TestUpstreamPool_PassiveEjection(t *testing.T) {
+	a, b := newTestBackend(t, "a"), newTestBackend(t, "b")
+	a.status.Store(http.StatusBadGateway)
+	handler, _ := newTestPoolHandler(t, &LoadBalancerConfig{MaxFails: "2", FailTimeout: "100ms"}, a, b)
+
+	failures := 0
+	for i := 0; i < 10; i++ {
+		if serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)).Code == http.StatusBadGateway {
+			failures++
+		}
+	}
+	assert.Equal(t, 2, failures)
+
+	// re-admitted after fail timeout
+	a.status.Store(http.StatusOK)
+	time.Sleep(150 * time.Millisecond)
+	hits := map[string]int{}
+	for i := 0; i < 4; i++ {
+		hits[serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)).Header().Get("X-Upstream")]++
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, hits)
+}
+
+func TestUpstreamPool_ConnectionError(t *testing.T) {
+	a, b := newTestBackend(t, "a"), newTestBackend(t, "b")
+	handler, _ := newTestPoolHandler(t, &LoadBalancerConfig{MaxFails: "1"}, a, b)
+	a.Close()
+
+	codes := []int{}
+	for i := 0; i < 4; i++ {
+		codes = append(codes, serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)).Code)
+	}
+	assert.Equal(t, 1, strings.Count(fmt.Sprint(codes), "502"))
+
+	b.Close()
+	rr := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	rr = serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), "UPSTREAM_UNAVAILABLE")
+}
+
+func TestUpstreamPool_ActiveHealthCheck(t *testing.T) {
+	a, b := newTestBackend(t, "a"), newTestBackend(t, "b")
+	a.healthy.Store(false)
+	handler, pool := newTestPoolHandler(t, &LoadBalancerConfig{HealthCheckPath: "/healthz", HealthCheckInterval: "10ms"}, a, b)
+
+	assert.Eventually(t, func() bool { return !pool.targets[0].healthy.Load() }, time.Second, 5*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "b", serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)).Header().Get("X-Upstream"))
+	}
+
+	a.healthy.Store(true)
+	assert.Eventually(t, func() bool { return pool.targets[0].healthy.Load() }, time.Second, 5*time.Millisecond)
+}
+
+func TestLoadBalancerConfig_Invalid(t *testing.T) {
+	for _, c := range []LoadBalancerConfig{
+		{Strategy: "random"},
+		{HashKey: "query:a"},
+		{HealthCheckInterval: "often"},
+		{HealthCheckInterval: "0s"},
+		{FailTimeout: "-1s"},
+		{CircuitBreakerTimeout: "0"},
+		{RetryBackoff: "-5ms"},
+		{MaxFails: "-1"},
+	} {
+		_, err := c.parse()
+		assert.Error(t, err)
+	}
+	t.Setenv("UPSTREAM_LB_STRATEGY", lbLeastConn)
+	s, err := (&LoadBalancerConfig{MaxFails: "0"}).merge(loadBalancerConfigFromEnv()).parse()
+	assert.NoError(t, err)
+	assert.Equal(t, lbLeastConn, s.strategy)
+	assert.Equal(t, 0, s.maxFails)
+}
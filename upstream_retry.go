@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+const (
+	defaultRetryBackoff = 100 * time.Millisecond
+	// defaultRetryMaxBody is the largest request body buffered for retries
+	defaultRetryMaxBody = 1 << 20
+)
+
+// idempotentMethods are the methods safe to retry
+var idempotentMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete,
+}
+
+// errRetryableResponse is returned by ModifyResponse to discard a response will be retried
+var errRetryableResponse = errors.New("upstream response is retryable")
+
+// proxyAttempt is an attempt of proxying the request to an upstream target
+type proxyAttempt struct {
+	target *upstreamTarget
+	// retryable is set when another attempt follows a failure
+	retryable bool
+	// retry is set when this attempt failed and nothing was written
+	retry bool
+	// failed is set on connection error or 502, 503 and 504 response
+	failed bool
+	// canceled is set when the request ended before upstream responded
+	canceled bool
+	// status is the status code of upstream response, 0 on connection error
+	status int
+}
+
+type proxyAttemptContextKey struct{}
+
+func proxyAttemptFromContext(ctx context.Context) *proxyAttempt {
+	attempt, _ := ctx.Value(proxyAttemptContextKey{}).(*proxyAttempt)
+	return attempt
+}
+
+// retryableStatus are the responses retried, the request likely did not reach the application
+func retryableStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// bufferRequestBody reads the body for replay in retries, nil and false when it is
+// larger than limit, the body is kept readable anyway
+func bufferRequestBody(r *http.Request, limit int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > limit {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(body)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	return body, true
+}
+
+// retryAttempts is the attempts allowed for request, retries are only for idempotent
+// methods with body fits the buffer
+func retryAttempts(r *http.Request, settings *loadBalancerSettings) (int, []byte) {
+	if settings.retries == 0 || !lo.Contains(idempotentMethods, r.Method) {
+		return 1, nil
+	}
+	body, ok := bufferRequestBody(r, settings.retryMaxBody)
+	if !ok {
+		return 1, nil
+	}
+	return settings.retries + 1, body
+}
+
+// retryBackoff waits exponentially longer before each retry, false when request is canceled
+func retryBackoff(ctx context.Context, backoff time.Duration, retry int) bool {
+	timer := time.NewTimer(backoff << (retry - 1))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// flushUpstreamError reports the proxy failure as UPSTREAM_TIMEOUT or UPSTREAM_UNAVAILABLE
+func flushUpstreamError(w http.ResponseWriter, err error) {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		flushJsonErrorResponse(w, "upstream did not respond in time", "UPSTREAM_TIMEOUT", http.StatusGatewayTimeout)
+		return
+	}
+	flushJsonErrorResponse(w, "upstream is unavailable", "UPSTREAM_UNAVAILABLE", http.StatusBadGateway)
+}
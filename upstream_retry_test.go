@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxy_UpstreamErrors(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	handler, _ := newTestPoolHandler(t, nil, &testBackend{Server: down})
+	rr := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), "UPSTREAM_UNAVAILABLE")
+
+	handler, _ = newTestPoolHandler(t, nil, &testBackend{Server: slow})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	rr = serve(handler, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Contains(t, rr.Body.String(), "UPSTREAM_TIMEOUT")
+}
+
+func TestProxy_Retries(t *testing.T) {
+	var calls atomic.Int32
+	bodies := make(chan string, 10)
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		if calls.Add(1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer flaky.Close()
+
+	lb := &LoadBalancerConfig{Retries: "2", RetryBackoff: "1ms", RetryMaxBody: "8", MaxFails: "0"}
+	handler, _ := newTestPoolHandler(t, lb, &testBackend{Server: flaky})
+
+	// idempotent request is retried with its body replayed
+	rr := serve(handler, httptest.NewRequest(http.MethodPut, "/", strings.NewReader("payload")))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "ok", rr.Body.String())
+	assert.Equal(t, int32(3), calls.Load())
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "payload", <-bodies)
+	}
+
+	// non idempotent request is not retried
+	calls.Store(0)
+	rr = serve(handler, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload")))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, int32(1), calls.Load())
+	<-bodies
+
+	// body larger than buffer limit is not retried, but still forwarded
+	calls.Store(0)
+	rr = serve(handler, httptest.NewRequest(http.MethodPut, "/", strings.NewReader("large payload")))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, "large payload", <-bodies)
+
+	// retries exhausted, the last response is returned
+	a := newTestBackend(t, "a")
+	a.status.Store(http.StatusServiceUnavailable)
+	handler, _ = newTestPoolHandler(t, lb, a)
+	rr = serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "a", rr.Header().Get("X-Upstream"))
+}
+
+func TestProxy_RetryAnotherTarget(t *testing.T) {
+	a, b := newTestBackend(t, "a"), newTestBackend(t, "b")
+	a.Close()
+	handler, _ := newTestPoolHandler(t, &LoadBalancerConfig{Retries: "1", RetryBackoff: "1ms"}, a, b)
+	for i := 0; i < 4; i++ {
+		rr := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "b", rr.Header().Get("X-Upstream"))
+	}
+}
+
+func TestProxy_CircuitBreaker(t *testing.T) {
+	a := newTestBackend(t, "a")
+	a.status.Store(http.StatusInternalServerError)
+	lb := &LoadBalancerConfig{CircuitBreakerThreshold: "2", CircuitBreakerTimeout: "50ms", MaxFails: "0"}
+	handler, _ := newTestPoolHandler(t, lb, a)
+
+	// 500 of the application is not a failure of upstream
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusInternalServerError, serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)).Code)
+	}
+
+	a.status.Store(http.StatusServiceUnavailable)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)).Code)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)).Code)
+
+	// open, fast-fail
+	rr := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), "UPSTREAM_UNAVAILABLE")
+
+	// half-open trial failed, open again
+	time.Sleep(60 * time.Millisecond)
+	rr = serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "a", rr.Header().Get("X-Upstream"))
+	rr = serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), "UPSTREAM_UNAVAILABLE")
+
+	// half-open trial succeeded, closed
+	a.status.Store(http.StatusOK)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)).Code)
+	}
+}
+
+func TestProxy_ClientCanceled(t *testing.T) {
+	a := newTestBackend(t, "a")
+	a.release = make(chan struct{})
+	lb := &LoadBalancerConfig{CircuitBreakerThreshold: "1", MaxFails: "1"}
+	handler, _ := newTestPoolHandler(t, lb, a)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	serve(handler, httptest.NewRequest(http.MethodGet, "/slow", nil).WithContext(ctx))
+	close(a.release)
+
+	// neither ejected nor tripped by the client going away
+	rr := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "a", rr.Header().Get("X-Upstream"))
+}
+
+func TestCircuitBreaker_SingleTrial(t *testing.T) {
+	b := newCircuitBreaker("test", 1, time.Millisecond)
+	b.record(true, false)
+	allowed, _ := b.allow()
+	assert.False(t, allowed)
+	time.Sleep(2 * time.Millisecond)
+	allowed, trial := b.allow()
+	assert.True(t, allowed)
+	assert.True(t, trial)
+	// only one trial while half-open
+	allowed, _ = b.allow()
+	assert.False(t, allowed)
+	// results of requests sent before the circuit opened are ignored
+	b.record(false, false)
+	allowed, _ = b.allow()
+	assert.False(t, allowed)
+
+	// a trial ended without result frees the slot
+	b.release(trial)
+	allowed, trial = b.allow()
+	assert.True(t, allowed)
+	b.record(false, trial)
+	allowed, trial = b.allow()
+	assert.True(t, allowed)
+	assert.False(t, trial)
+
+	assert.Nil(t, newCircuitBreaker("disabled", 0, time.Second))
+	allowed, _ = (*circuitBreaker)(nil).allow()
+	assert.True(t, allowed)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// usersPath lists the users of embedded form login store on ADMIN_LISTEN_ADDR,
+// PUT usersPath/<username> creates or replaces one, DELETE removes it
+const usersPath = "/_/users"
+
+// userInfo is the profile of a user, the password hash is never exposed
+type userInfo struct {
+	Username string   `json:"username"`
+	Name     string   `json:"name,omitempty"`
+	Email    string   `json:"email,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// userUpdate is the body of PUT, either the plain password to be hashed with bcrypt
+// or an existing bcrypt or argon2 hash
+type userUpdate struct {
+	Password     string   `json:"password"`
+	PasswordHash string   `json:"password_hash"`
+	Name         string   `json:"name"`
+	Email        string   `json:"email"`
+	Groups       []string `json:"groups"`
+}
+
+func embeddedUserStore(w http.ResponseWriter) *boltUserStore {
+	store := activeUserStore.Load()
+	if store == nil {
+		flushJsonErrorResponse(w, "users are only managed with the embedded form login storage", "ERR_USER_STORE", http.StatusNotFound)
+	}
+	return store
+}
+
+// serveUsers lists the users ordered by username
+func serveUsers(w http.ResponseWriter, r *http.Request) {
+	store := embeddedUserStore(w)
+	if store == nil {
+		return
+	}
+	users, err := store.list()
+	if err != nil {
+		flushJsonErrorResponse(w, err.Error(), "ERR_USER_STORE", http.StatusInternalServerError)
+		return
+	}
+	result := []userInfo{}
+	for _, user := range users {
+		result = append(result, userInfo{Username: user.Username, Name: user.Name, Email: user.Email, Groups: user.Groups})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// servePutUser creates or replaces the user
+func servePutUser(w http.ResponseWriter, r *http.Request) {
+	store := embeddedUserStore(w)
+	if store == nil {
+		return
+	}
+	update := userUpdate{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&update); err != nil {
+		flushJsonErrorResponse(w, "request body is not a valid user", "ERR_USER_INVALID", http.StatusBadRequest)
+		return
+	}
+	if (len(update.Password) > 0) == (len(update.PasswordHash) > 0) {
+		flushJsonErrorResponse(w, "one of password and password_hash is required", "ERR_USER_INVALID", http.StatusBadRequest)
+		return
+	}
+	hash := update.PasswordHash
+	if len(update.Password) > 0 {
+		generated, err := bcrypt.GenerateFromPassword([]byte(update.Password), bcrypt.DefaultCost)
+		if err != nil {
+			flushJsonErrorResponse(w, err.Error(), "ERR_USER_INVALID", http.StatusBadRequest)
+			return
+		}
+		hash = string(generated)
+	}
+	user := &formUser{Username: r.PathValue("username"), Password: hash, Name: update.Name, Email: update.Email, Groups: update.Groups}
+	if err := store.put(user); err != nil {
+		flushJsonErrorResponse(w, err.Error(), "ERR_USER_INVALID", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveDeleteUser removes the user and revokes the sessions it logged in by form
+func serveDeleteUser(w http.ResponseWriter, r *http.Request) {
+	store := embeddedUserStore(w)
+	if store == nil {
+		return
+	}
+	username := r.PathValue("username")
+	found, err := store.remove(username)
+	if err != nil {
+		flushJsonErrorResponse(w, err.Error(), "ERR_USER_STORE", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		flushJsonErrorResponse(w, "user is not found", "ERR_USER_NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	if sessions := activeSessionStore.Load(); sessions != nil {
+		_, err := sessions.RevokeMatching(r.Context(), "sub", username, func(values map[interface{}]interface{}) bool {
+			return values["auth_method"] == "form"
+		})
+		if err != nil {
+			flushJsonErrorResponse(w, err.Error(), "ERR_SESSION_STORE", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
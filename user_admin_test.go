@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminUsers(t *testing.T) {
+	admin := createAdminHandler()
+	rr := httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, usersPath, nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	t.Setenv("FORM_LOGIN_STORAGE", "embedded")
+	t.Setenv("FORM_LOGIN_STORAGE_PATH", filepath.Join(t.TempDir(), "users.db"))
+	t.Cleanup(func() { activeUserStore.Store(nil) })
+	store := must(newUserStore())
+	put := func(username string, body string) int {
+		rr := httptest.NewRecorder()
+		admin.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, usersPath+"/"+username, strings.NewReader(body)))
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, put("alice", `{"password":"secret","name":"Alice","groups":["admin"]}`))
+	assert.Equal(t, http.StatusNoContent, put("bob", `{"password_hash":"`+testPasswordHash(t, "hunter2")+`"}`))
+	assert.Equal(t, http.StatusBadRequest, put("carol", `{"password_hash":"plain"}`))
+	assert.Equal(t, http.StatusBadRequest, put("carol", `{}`))
+
+	user, err := authenticateUser(store, "alice", "secret")
+	assert.NoError(t, err)
+	assert.NotNil(t, user)
+	user, _ = authenticateUser(store, "bob", "hunter2")
+	assert.NotNil(t, user)
+
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, usersPath, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "$2a$")
+	users := []userInfo{}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&users))
+	assert.Equal(t, []userInfo{{Username: "alice", Name: "Alice", Groups: []string{"admin"}}, {Username: "bob"}}, users)
+
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, usersPath+"/alice", nil))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	user, _ = authenticateUser(store, "alice", "secret")
+	assert.Nil(t, user)
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, usersPath+"/alice", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
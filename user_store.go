@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// formUser is an account of form login, Password is the bcrypt or argon2 hash
+type formUser struct {
+	Username string   `yaml:"username" json:"username"`
+	Password string   `yaml:"password" json:"password"`
+	Name     string   `yaml:"name" json:"name"`
+	Email    string   `yaml:"email" json:"email"`
+	Groups   []string `yaml:"groups" json:"groups"`
+}
+
+// claims are the claims of identity logged in
+func (u *formUser) claims() map[string]interface{} {
+	claims := map[string]interface{}{"sub": u.Username}
+	if len(u.Name) > 0 {
+		claims["name"] = u.Name
+	}
+	if len(u.Email) > 0 {
+		claims["email"] = u.Email
+	}
+	if len(u.Groups) > 0 {
+		groups := []interface{}{}
+		for _, g := range u.Groups {
+			groups = append(groups, g)
+		}
+		claims["groups"] = groups
+	}
+	return claims
+}
+
+// userStore looks up the accounts of form login, nil user when not found
+type userStore interface {
+	lookup(username string) (*formUser, error)
+}
+
+// fileUserStore reads the accounts from a file, reloaded when the file changed
+type fileUserStore struct {
+	path  string
+	parse func(content []byte) (map[string]*formUser, error)
+
+	mu      sync.Mutex
+	users   map[string]*formUser
+	modTime time.Time
+}
+
+// newUserStore creates the store of FORM_LOGIN_STORAGE, htpasswd (default) is a
+// file of user:hash lines, embedded is a bbolt database of users with profile
+func newUserStore() (userStore, error) {
+	path := getenv("FORM_LOGIN_STORAGE_PATH")
+	if len(path) == 0 {
+		return nil, errors.New("FORM_LOGIN_STORAGE_PATH is required")
+	}
+	switch kind := getenv("FORM_LOGIN_STORAGE"); kind {
+	case "", "htpasswd":
+		activeUserStore.Store(nil)
+		return newFileUserStore(path, parseHtpasswd)
+	case "embedded":
+		store, err := sharedBoltUserStore(path)
+		if err != nil {
+			return nil, err
+		}
+		activeUserStore.Store(store)
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown form login storage %q", kind)
+	}
+}
+
+func newFileUserStore(path string, parse func(content []byte) (map[string]*formUser, error)) (*fileUserStore, error) {
+	s := &fileUserStore{path: path, parse: parse}
+	if err := s.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileUserStore) reloadIfChanged() error {
+	stat, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stat.ModTime().Equal(s.modTime) && s.users != nil {
+		return nil
+	}
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	users, err := s.parse(content)
+	if err != nil {
+		return fmt.Errorf("load users from %s failed: %w", s.path, err)
+	}
+	s.users = users
+	s.modTime = stat.ModTime()
+	return nil
+}
+
+func (s *fileUserStore) lookup(username string) (*formUser, error) {
+	// a broken file keeps the users loaded before
+	if err := s.reloadIfChanged(); err != nil && s.users == nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.users[username], nil
+}
+
+func parseHtpasswd(content []byte) (map[string]*formUser, error) {
+	users := map[string]*formUser{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		if err := validatePasswordHash(username, hash); err != nil {
+			return nil, err
+		}
+		users[username] = &formUser{Username: username, Password: hash}
+	}
+	return users, scanner.Err()
+}
+
+// usersBucket holds the JSON encoded formUser by username
+var usersBucket = []byte("users")
+
+// boltUserStore keeps the accounts in an embedded bbolt database, managed on the
+// admin endpoints. bbolt locks the file, only one process can open it
+type boltUserStore struct {
+	db *bolt.DB
+}
+
+var (
+	boltUserStoresMu sync.Mutex
+	// sharedBoltUserStores keeps the databases open across reloads, by path
+	sharedBoltUserStores = map[string]*boltUserStore{}
+)
+
+// activeUserStore is the embedded store of form login managed by the admin endpoints
+var activeUserStore atomic.Pointer[boltUserStore]
+
+func sharedBoltUserStore(path string) (*boltUserStore, error) {
+	boltUserStoresMu.Lock()
+	defer boltUserStoresMu.Unlock()
+	if store, ok := sharedBoltUserStores[path]; ok {
+		return store, nil
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open user database %s failed: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open user database %s failed: %w", path, err)
+	}
+	store := &boltUserStore{db: db}
+	sharedBoltUserStores[path] = store
+	return store, nil
+}
+
+func (s *boltUserStore) lookup(username string) (*formUser, error) {
+	var user *formUser
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(usersBucket).Get([]byte(username))
+		if data == nil {
+			return nil
+		}
+		user = &formUser{}
+		return json.Unmarshal(data, user)
+	})
+	return user, err
+}
+
+// list returns all the users ordered by username
+func (s *boltUserStore) list() ([]*formUser, error) {
+	users := []*formUser{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(_, data []byte) error {
+			user := &formUser{}
+			if err := json.Unmarshal(data, user); err != nil {
+				return err
+			}
+			users = append(users, user)
+			return nil
+		})
+	})
+	return users, err
+}
+
+// put creates or replaces the user, the password must be hashed already
+func (s *boltUserStore) put(user *formUser) error {
+	if len(user.Username) == 0 {
+		return errors.New("username is required")
+	}
+	if err := validatePasswordHash(user.Username, user.Password); err != nil {
+		return err
+	}
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).Put([]byte(user.Username), data)
+	})
+}
+
+// remove deletes the user, false when there is no such user
+func (s *boltUserStore) remove(username string) (bool, error) {
+	found := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		found = bucket.Get([]byte(username)) != nil
+		return bucket.Delete([]byte(username))
+	})
+	return found, err
+}
+
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// authenticateUser verifies the password, unknown user costs the same time so the
+// usernames can not be probed
+func authenticateUser(store userStore, username string, password string) (*formUser, error) {
+	user, err := store.lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return nil, nil
+	}
+	if !verifyPasswordHash(user.Password, password) {
+		return nil, nil
+	}
+	return user, nil
+}
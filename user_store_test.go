@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testPasswordHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	return string(hash)
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	hash := testPasswordHash(t, "secret")
+	users, err := parseHtpasswd([]byte("# admins\nalice:" + hash + "\n\n"))
+	if assert.NoError(t, err) {
+		assert.Len(t, users, 1)
+		assert.Equal(t, "alice", users["alice"].Username)
+	}
+
+	// only bcrypt hashes are accepted
+	_, err = parseHtpasswd([]byte("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="))
+	assert.Error(t, err)
+	_, err = parseHtpasswd([]byte("bob"))
+	assert.Error(t, err)
+}
+
+func TestBoltUserStore(t *testing.T) {
+	t.Setenv("FORM_LOGIN_STORAGE", "embedded")
+	t.Setenv("FORM_LOGIN_STORAGE_PATH", filepath.Join(t.TempDir(), "users.db"))
+	t.Cleanup(func() { activeUserStore.Store(nil) })
+	store, err := newUserStore()
+	if !assert.NoError(t, err) {
+		return
+	}
+	embedded := activeUserStore.Load()
+	assert.NoError(t, embedded.put(&formUser{
+		Username: "alice",
+		Password: testPasswordHash(t, "secret"),
+		Name:     "Alice",
+		Email:    "alice@example.com",
+		Groups:   []string{"admin", "dev"},
+	}))
+	assert.Error(t, embedded.put(&formUser{Username: "bob", Password: "plain"}))
+
+	user, err := authenticateUser(store, "alice", "secret")
+	if assert.NoError(t, err) && assert.NotNil(t, user) {
+		claims := user.claims()
+		assert.Equal(t, "alice", claims["sub"])
+		assert.Equal(t, "alice@example.com", claims["email"])
+		assert.Equal(t, []string{"admin", "dev"}, newIdentity("form", claims).Groups)
+	}
+
+	// the database stays open on reload, bbolt locks the file
+	again, err := newUserStore()
+	assert.NoError(t, err)
+	assert.Same(t, store, again)
+
+	found, err := embedded.remove("alice")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	user, _ = authenticateUser(store, "alice", "secret")
+	assert.Nil(t, user)
+}
+
+func TestFileUserStore(t *testing.T) {
+	file := writeConfig(t, "htpasswd", "alice:"+testPasswordHash(t, "secret")+"\n")
+	t.Setenv("FORM_LOGIN_STORAGE_PATH", file)
+	store, err := newUserStore()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	user, err := authenticateUser(store, "alice", "secret")
+	assert.NoError(t, err)
+	assert.NotNil(t, user)
+	user, _ = authenticateUser(store, "alice", "wrong")
+	assert.Nil(t, user)
+	user, _ = authenticateUser(store, "nobody", "secret")
+	assert.Nil(t, user)
+
+	// the file is reloaded when changed
+	os.WriteFile(file, []byte("bob:"+testPasswordHash(t, "secret")+"\n"), 0600)
+	os.Chtimes(file, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	user, _ = authenticateUser(store, "bob", "secret")
+	assert.NotNil(t, user)
+
+	t.Setenv("FORM_LOGIN_STORAGE", "sqlite")
+	_, err = newUserStore()
+	assert.Error(t, err)
+}